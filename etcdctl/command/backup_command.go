@@ -44,41 +44,53 @@ func NewBackupCommand() cli.Command {
 
 // handleBackup handles a request that intends to do a backup.
 func handleBackup(c *cli.Context) {
-	srcSnap := path.Join(c.String("data-dir"), "snap")
-	destSnap := path.Join(c.String("backup-dir"), "snap")
-	srcWAL := path.Join(c.String("data-dir"), "wal")
-	destWAL := path.Join(c.String("backup-dir"), "wal")
+	if err := backup(c.String("data-dir"), c.String("backup-dir")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// backup copies the latest snapshot of the etcd data dir to the backup dir,
+// and writes a new WAL there with the records of the WAL after it.
+func backup(dataDir, backupDir string) error {
+	srcSnap := path.Join(dataDir, "snap")
+	destSnap := path.Join(backupDir, "snap")
+	srcWAL := path.Join(dataDir, "wal")
+	destWAL := path.Join(backupDir, "wal")
 
 	if err := os.MkdirAll(destSnap, 0700); err != nil {
-		log.Fatalf("failed creating backup snapshot dir %v: %v", destSnap, err)
+		return fmt.Errorf("failed creating backup snapshot dir %v: %v", destSnap, err)
 	}
 	ss := snap.New(srcSnap)
 	snapshot, err := ss.Load()
 	if err != nil && err != snap.ErrNoSnapshot {
-		log.Fatal(err)
+		return err
 	}
 	var walsnap walpb.Snapshot
 	if snapshot != nil {
 		walsnap.Index, walsnap.Term = snapshot.Metadata.Index, snapshot.Metadata.Term
 		newss := snap.New(destSnap)
 		if err := newss.SaveSnap(*snapshot); err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
 
 	w, err := wal.OpenNotInUse(srcWAL, walsnap)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer w.Close()
 	wmetadata, state, ents, err := w.ReadAll()
 	switch err {
 	case nil:
-	case wal.ErrSnapshotNotFound:
+	case wal.ErrSnapshotTooOld:
+		// the entries between the snapshot and the first entry of the
+		// WAL are lost, so it cannot be fixed by adding the snapshot
+		return fmt.Errorf("snapshot %+v is older than the records in wal %v: %v", walsnap, srcWAL, err)
+	case wal.ErrSnapshotNotFound, wal.ErrSnapshotTooNew:
 		fmt.Printf("Failed to find the match snapshot record %+v in wal %v.", walsnap, srcWAL)
 		fmt.Printf("etcdctl will add it back. Start auto fixing...")
 	default:
-		log.Fatal(err)
+		return err
 	}
 	var metadata etcdserverpb.Metadata
 	pbutil.MustUnmarshal(&metadata, wmetadata)
@@ -88,13 +100,11 @@ func handleBackup(c *cli.Context) {
 
 	neww, err := wal.Create(destWAL, pbutil.MustMarshal(&metadata))
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer neww.Close()
 	if err := neww.Save(state, ents); err != nil {
-		log.Fatal(err)
-	}
-	if err := neww.SaveSnapshot(walsnap); err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return neww.SaveSnapshot(walsnap)
 }
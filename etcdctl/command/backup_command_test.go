@@ -0,0 +1,116 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/pkg/pbutil"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/snap"
+	"github.com/coreos/etcd/wal"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestBackup(t *testing.T) {
+	tests := []struct {
+		snapi uint64
+
+		wents []raftpb.Entry
+		werr  bool
+	}{
+		{5, []raftpb.Entry{{Index: 6, Term: 1}}, false},
+		// the entries before the first one in the WAL are lost
+		{3, nil, true},
+	}
+	for i, tt := range tests {
+		dataDir := mustMakeDataDir(t)
+		ss := snap.New(path.Join(dataDir, "snap"))
+		s := raftpb.Snapshot{Data: []byte("data"), Metadata: raftpb.SnapshotMetadata{Index: tt.snapi, Term: 1}}
+		if err := ss.SaveSnap(s); err != nil {
+			t.Fatal(err)
+		}
+		backupDir, err := ioutil.TempDir(os.TempDir(), "backuptest")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = backup(dataDir, backupDir)
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want failure %v", i, err, tt.werr)
+		}
+		destWAL := path.Join(backupDir, "wal")
+		if tt.werr {
+			if wal.Exist(destWAL) {
+				t.Errorf("#%d: backup WAL is created", i)
+			}
+		} else {
+			w, err := wal.Open(destWAL, walpb.Snapshot{Index: tt.snapi, Term: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, ents, err := w.ReadAll()
+			w.Close()
+			if err != nil {
+				t.Fatalf("#%d: err = %v", i, err)
+			}
+			if !reflect.DeepEqual(ents, tt.wents) {
+				t.Errorf("#%d: ents = %+v, want %+v", i, ents, tt.wents)
+			}
+		}
+		os.RemoveAll(dataDir)
+		os.RemoveAll(backupDir)
+	}
+}
+
+// mustMakeDataDir builds an etcd data dir whose WAL holds the entries of
+// index 5 and 6, after the records before the snapshot at index 5 are
+// compacted away.
+func mustMakeDataDir(t *testing.T) string {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "backuptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(path.Join(dataDir, "snap"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	md := pbutil.MustMarshal(&etcdserverpb.Metadata{NodeID: 1, ClusterID: 1})
+	w, err := wal.Create(path.Join(dataDir, "wal"), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i := uint64(1); i <= 6; i++ {
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: i}, []raftpb.Entry{{Index: i, Term: 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap := walpb.Snapshot{Index: 5, Term: 1}
+	if err = w.SaveSnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Compact(snap); err != nil {
+		t.Fatal(err)
+	}
+	return dataDir
+}
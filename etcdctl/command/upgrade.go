@@ -17,13 +17,18 @@
 package command
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path"
 
 	"github.com/coreos/etcd/Godeps/_workspace/src/github.com/codegangsta/cli"
 	"github.com/coreos/etcd/pkg/transport"
+	"github.com/coreos/etcd/wal"
 )
 
 func UpgradeCommand() cli.Command {
@@ -37,6 +42,8 @@ func UpgradeCommand() cli.Command {
 			cli.StringFlag{Name: "peer-cert-file", Value: "", Usage: "identify HTTPS peer using this SSL certificate file"},
 			cli.StringFlag{Name: "peer-key-file", Value: "", Usage: "identify HTTPS peer using this SSL key file"},
 			cli.StringFlag{Name: "peer-ca-file", Value: "", Usage: "verify certificates of HTTPS-enabled peers using this CA bundle"},
+			cli.BoolFlag{Name: "dry-run", Usage: "print the upgrade plan without upgrading the cluster"},
+			cli.StringFlag{Name: "data-dir", Value: "", Usage: "data dir of the local machine, whose layout is inspected with --dry-run"},
 		},
 		Action: handleUpgrade,
 	}
@@ -61,6 +68,13 @@ func handleUpgrade(c *cli.Context) {
 		log.Fatal(err)
 	}
 	client := http.Client{Transport: t}
+	if c.Bool("dry-run") {
+		if err := printUpgradePlan(&client, c.String("peer-url"), c.String("data-dir")); err != nil {
+			fmt.Printf("Cluster cannot upgrade to 2: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	resp, err := client.Get(c.String("peer-url") + "/v2/admin/next-internal-version")
 	if err != nil {
 		fmt.Printf("Failed to send upgrade request to %s: %v\n", c.String("peer-url"), err)
@@ -76,3 +90,126 @@ func handleUpgrade(c *cli.Context) {
 	}
 	fmt.Printf("Faild to send upgrade request to %s: bad status code %d\n", c.String("cluster-url"), resp.StatusCode)
 }
+
+// machine4 is a machine of an etcd 0.4 cluster.
+type machine4 struct {
+	Name      string `json:"name"`
+	State     string `json:"state"`
+	ClientURL string `json:"clientURL"`
+	PeerURL   string `json:"peerURL"`
+}
+
+// clusterConfig4 is the cluster config of an etcd 0.4 cluster.
+type clusterConfig4 struct {
+	ActiveSize   int     `json:"activeSize"`
+	RemoveDelay  float64 `json:"removeDelay"`
+	SyncInterval float64 `json:"syncInterval"`
+}
+
+// printUpgradePlan prints what upgrading the cluster of the given peer
+// would do, without upgrading it. The data dirs of the machines are not
+// reachable through the peer, so only the layout of the given data dir is
+// inspected, if it is not empty. It returns an error if the cluster cannot
+// be upgraded.
+func printUpgradePlan(client *http.Client, peerURL, dataDir string) error {
+	var cfg clusterConfig4
+	if err := getJSON(client, peerURL+"/v2/admin/config", &cfg); err != nil {
+		return fmt.Errorf("failed to get cluster config from %s: %v", peerURL, err)
+	}
+	var machines []machine4
+	if err := getJSON(client, peerURL+"/v2/admin/machines", &machines); err != nil {
+		return fmt.Errorf("failed to get machines from %s: %v", peerURL, err)
+	}
+	fmt.Printf("Cluster config: active size %d, remove delay %vs, sync interval %vs\n", cfg.ActiveSize, cfg.RemoveDelay, cfg.SyncInterval)
+
+	blocked := false
+	var members, standbys []machine4
+	for _, m := range machines {
+		ver, err := internalVersion(client, m.ClientURL)
+		switch {
+		case err != nil:
+			fmt.Printf("Machine %s is unreachable at %s: %v\n", m.Name, m.ClientURL, err)
+			blocked = true
+		case ver != "1":
+			fmt.Printf("Machine %s has internal version %s, want 1\n", m.Name, ver)
+			blocked = true
+		}
+		if m.State == "standby" {
+			standbys = append(standbys, m)
+		} else {
+			members = append(members, m)
+		}
+	}
+
+	fmt.Println("Planned members of the upgraded cluster:")
+	for _, m := range members {
+		fmt.Printf("  %s: peer URL %s, client URL %s\n", m.Name, m.PeerURL, m.ClientURL)
+	}
+	for _, m := range standbys {
+		fmt.Printf("  %s: standby, will run as a proxy\n", m.Name)
+	}
+	if dataDir != "" && !printDataDirLayout(dataDir) {
+		blocked = true
+	}
+	fmt.Println("Upgrade steps:")
+	fmt.Println("  1. The cluster records internal version 2 as the next version, and every machine exits in 10 seconds.")
+	fmt.Println("  2. Each machine is restarted with etcd 2 and its data dir.")
+	fmt.Println("  3. The log, snapshot and conf of the data dir are converted into the member/wal and member/snap dirs.")
+	fmt.Println("  4. Standbys start as proxies of the members.")
+	if blocked {
+		return errors.New("some machines or the data dir are not ready")
+	}
+	fmt.Println("Cluster can upgrade to 2. Run the command without --dry-run to upgrade.")
+	return nil
+}
+
+// printDataDirLayout prints the layout of the given data dir, and returns
+// whether it holds the data of etcd 0.4, which etcd 2 converts.
+func printDataDirLayout(dataDir string) bool {
+	ver, err := wal.DetectVersion(dataDir)
+	if err != nil {
+		fmt.Printf("Data dir %s cannot be read: %v\n", dataDir, err)
+		return false
+	}
+	switch ver {
+	case wal.WALv0_4:
+		snaps, err := ioutil.ReadDir(path.Join(dataDir, "snapshot"))
+		if err != nil {
+			fmt.Printf("Data dir %s cannot be read: %v\n", dataDir, err)
+			return false
+		}
+		fmt.Printf("Data dir %s holds the log, the conf and %d snapshot files of etcd 0.4\n", dataDir, len(snaps))
+		return true
+	case wal.WALv0_5:
+		fmt.Printf("Data dir %s is already converted to the member/wal and member/snap dirs\n", dataDir)
+	case wal.WALNotExist:
+		fmt.Printf("Data dir %s holds no data to convert\n", dataDir)
+	default:
+		fmt.Printf("Data dir %s has an unknown layout\n", dataDir)
+	}
+	return false
+}
+
+func internalVersion(client *http.Client, clientURL string) (string, error) {
+	var m map[string]string
+	if err := getJSON(client, clientURL+"/version", &m); err != nil {
+		return "", err
+	}
+	return m["internalVersion"], nil
+}
+
+func getJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status code %d", resp.StatusCode)
+	}
+	return json.Unmarshal(b, v)
+}
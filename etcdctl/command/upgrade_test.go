@@ -0,0 +1,98 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPrintUpgradePlan(t *testing.T) {
+	var ver string
+	clientSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"releaseVersion": "0.4.7", "internalVersion": ver})
+	}))
+	defer clientSrv.Close()
+	peerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/admin/config":
+			json.NewEncoder(w).Encode(clusterConfig4{ActiveSize: 3, RemoveDelay: 1800, SyncInterval: 5})
+		case "/v2/admin/machines":
+			json.NewEncoder(w).Encode([]machine4{
+				{Name: "node0", State: "leader", ClientURL: clientSrv.URL},
+				{Name: "node1", State: "follower", ClientURL: clientSrv.URL},
+			})
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer peerSrv.Close()
+
+	tests := []struct {
+		ver   string
+		wfail bool
+	}{
+		{"1", false},
+		{"2", true},
+	}
+	for i, tt := range tests {
+		ver = tt.ver
+		err := printUpgradePlan(http.DefaultClient, peerSrv.URL, "")
+		if (err != nil) != tt.wfail {
+			t.Errorf("#%d: err = %v, want failure %v", i, err, tt.wfail)
+		}
+	}
+
+	ver = "1"
+	dataDir := mustMakeDataDir4(t)
+	defer os.RemoveAll(dataDir)
+	if err := printUpgradePlan(http.DefaultClient, peerSrv.URL, dataDir); err != nil {
+		t.Errorf("err = %v, want nil for a 0.4 data dir", err)
+	}
+	if err := os.Remove(path.Join(dataDir, "log")); err != nil {
+		t.Fatal(err)
+	}
+	if err := printUpgradePlan(http.DefaultClient, peerSrv.URL, dataDir); err == nil {
+		t.Errorf("err = nil, want an error for an unknown data dir layout")
+	}
+
+	clientSrv.Close()
+	if err := printUpgradePlan(http.DefaultClient, peerSrv.URL, ""); err == nil {
+		t.Errorf("err = nil, want an error for unreachable machines")
+	}
+}
+
+// mustMakeDataDir4 builds a data dir in the layout of etcd 0.4.
+func mustMakeDataDir4(t *testing.T) string {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "upgradetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(path.Join(dataDir, "snapshot"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"conf", "log"} {
+		if err = ioutil.WriteFile(path.Join(dataDir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dataDir
+}
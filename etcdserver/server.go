@@ -290,19 +290,30 @@ func (s *EtcdServer) start() {
 
 func (s *EtcdServer) purgeFile() {
 	var serrc, werrc <-chan error
+	// wretryc fires when purging the wal files is restarted after an error
+	var wretryc <-chan time.Time
 	if s.cfg.MaxSnapFiles > 0 {
 		serrc = fileutil.PurgeFile(s.cfg.SnapDir(), "snap", s.cfg.MaxSnapFiles, purgeFileInterval, s.done)
 	}
 	if s.cfg.MaxWALFiles > 0 {
 		werrc = fileutil.PurgeFile(s.cfg.WALDir(), "wal", s.cfg.MaxWALFiles, purgeFileInterval, s.done)
 	}
-	select {
-	case e := <-werrc:
-		log.Fatalf("etcdserver: failed to purge wal file %v", e)
-	case e := <-serrc:
-		log.Fatalf("etcdserver: failed to purge snap file %v", e)
-	case <-s.done:
-		return
+	for {
+		select {
+		case e := <-werrc:
+			// the wal files are still safe to use, so a failed purge
+			// is retried on the next interval instead of stopping the
+			// server, since the error may be transient.
+			log.Printf("etcdserver: failed to purge wal file %v", e)
+			werrc, wretryc = nil, time.After(purgeFileInterval)
+		case <-wretryc:
+			wretryc = nil
+			werrc = fileutil.PurgeFile(s.cfg.WALDir(), "wal", s.cfg.MaxWALFiles, purgeFileInterval, s.done)
+		case e := <-serrc:
+			log.Fatalf("etcdserver: failed to purge snap file %v", e)
+		case <-s.done:
+			return
+		}
 	}
 }
 
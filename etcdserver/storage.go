@@ -15,7 +15,10 @@
 package etcdserver
 
 import (
+	"errors"
 	"log"
+	"os"
+	"path"
 
 	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
 	"github.com/coreos/etcd/migrate"
@@ -59,8 +62,9 @@ func (st *storage) SaveSnap(snap raftpb.Snapshot) error {
 		return err
 	}
 	walsnap := walpb.Snapshot{
-		Index: snap.Metadata.Index,
-		Term:  snap.Metadata.Term,
+		Index:     snap.Metadata.Index,
+		Term:      snap.Metadata.Term,
+		ConfState: pbutil.MustMarshal(&snap.Metadata.ConfState),
 	}
 	err = st.WAL.SaveSnapshot(walsnap)
 	if err != nil {
@@ -73,14 +77,41 @@ func (st *storage) SaveSnap(snap raftpb.Snapshot) error {
 	return nil
 }
 
-func readWAL(waldir string, snap walpb.Snapshot) (w *wal.WAL, id, cid types.ID, st raftpb.HardState, ents []raftpb.Entry) {
-	var err error
-	if w, err = wal.Open(waldir, snap); err != nil {
-		log.Fatalf("etcdserver: open wal error: %v", err)
+// createWAL creates the WAL of a new member in waldir. Its records are
+// padded, so that readWAL tells a write torn by a crash apart from a
+// corrupted record and repairs it. The WALs created by older versions keep
+// their framing, and are not repaired.
+func createWAL(waldir string, metadata []byte) *wal.WAL {
+	w, err := wal.Create(waldir, metadata, wal.WithPadding())
+	if err != nil {
+		log.Fatalf("etcdserver: create wal error: %v", err)
 	}
-	var wmetadata []byte
-	if wmetadata, st, ents, err = w.ReadAll(); err != nil {
-		log.Fatalf("etcdserver: read wal error: %v", err)
+	return w
+}
+
+func readWAL(waldir string, snap walpb.Snapshot) (w *wal.WAL, id, cid types.ID, st raftpb.HardState, ents []raftpb.Entry) {
+	var (
+		err       error
+		wmetadata []byte
+	)
+	for repaired := false; ; repaired = true {
+		if w, err = wal.Open(waldir, snap); err != nil {
+			log.Fatalf("etcdserver: open wal error: %v", err)
+		}
+		if wmetadata, st, ents, err = w.ReadAll(); err == nil {
+			break
+		}
+		w.Close()
+		// a write torn by a crash was never synced, so it is dropped;
+		// any other error means the WAL is corrupted
+		var terr *wal.TornTailError
+		if repaired || !errors.As(err, &terr) {
+			log.Fatalf("etcdserver: read wal error: %v", err)
+		}
+		log.Printf("etcdserver: truncating the torn write at offset %d in %q", terr.Offset, terr.File)
+		if err = os.Truncate(path.Join(waldir, terr.File), terr.Offset); err != nil {
+			log.Fatalf("etcdserver: truncate wal error: %v", err)
+		}
 	}
 	var metadata pb.Metadata
 	pbutil.MustUnmarshal(&metadata, wmetadata)
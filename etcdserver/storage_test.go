@@ -0,0 +1,90 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/pkg/pbutil"
+	"github.com/coreos/etcd/pkg/types"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestReadWALRepairsTornTail(t *testing.T) {
+	tests := []struct {
+		cut int64 // bytes of the torn record left in the file
+	}{
+		{3},  // in the middle of its length
+		{12}, // in the middle of its data
+	}
+	for i, tt := range tests {
+		p, err := ioutil.TempDir(os.TempDir(), "etcdserver")
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata := pbutil.MustMarshal(&pb.Metadata{NodeID: 1, ClusterID: 2})
+		w := createWAL(p, metadata)
+		ents := []raftpb.Entry{{Index: 1, Term: 1, Data: []byte("a")}}
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: 1}, ents); err != nil {
+			t.Fatal(err)
+		}
+		// the file is preallocated, so the next record is appended where
+		// the records read end rather than at its size
+		fpath := path.Join(p, w.LockedFiles()[0])
+		off := mustEndOffset(t, p)
+		if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 2, Term: 1, Data: make([]byte, 64)}}); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		if err = os.Truncate(fpath, off+tt.cut); err != nil {
+			t.Fatal(err)
+		}
+
+		w, id, cid, st, entries := readWAL(p, walpb.Snapshot{})
+		w.Close()
+		if id != types.ID(1) || cid != types.ID(2) {
+			t.Errorf("#%d: id, cid = %s, %s, want 1, 2", i, id, cid)
+		}
+		if wst := (raftpb.HardState{Term: 1, Commit: 1}); !reflect.DeepEqual(st, wst) {
+			t.Errorf("#%d: state = %+v, want %+v", i, st, wst)
+		}
+		if !reflect.DeepEqual(entries, ents) {
+			t.Errorf("#%d: ents = %+v, want %+v", i, entries, ents)
+		}
+		os.RemoveAll(p)
+	}
+}
+
+// mustEndOffset returns the offset where the records of the WAL in dirpath
+// end, in its last file.
+func mustEndOffset(t *testing.T, dirpath string) int64 {
+	r, err := wal.OpenReadOnly(dirpath, walpb.Snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, _, _, err = r.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	_, off := r.Position()
+	return off
+}
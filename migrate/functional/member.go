@@ -15,19 +15,27 @@
 package functional
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+var captureLogs = flag.Bool("capture-logs", false, "capture the stdout and stderr of all the etcd processes")
+
 type Proc struct {
 	*exec.Cmd
 	Name    string
@@ -35,7 +43,10 @@ type Proc struct {
 	URL     string
 	PeerURL string
 
-	stderr io.ReadCloser
+	stdout, stderr *logBuffer
+	// inheritEnv is set once the environment of the test is added to the
+	// environment of the process
+	inheritEnv bool
 }
 
 func NewProcWithDefaultFlags(path string) *Proc {
@@ -58,6 +69,9 @@ func NewProcWithDefaultFlags(path string) *Proc {
 	p.Env = append(p.Env,
 		"ETCD_BINARY_DIR="+binDir,
 	)
+	if *captureLogs {
+		p.CaptureLogs()
+	}
 	return p
 }
 
@@ -143,6 +157,47 @@ func (p *Proc) SetPeerTLS(certFile, keyFile, caFile string) {
 	p.PeerURL = u.String()
 }
 
+// SetEnv sets the given environment variables of the process, which
+// otherwise inherits the environment of the test. A key set again
+// overrides the value set before.
+func (p *Proc) SetEnv(kv map[string]string) {
+	if !p.inheritEnv {
+		p.Env = append(os.Environ(), p.Env...)
+		p.inheritEnv = true
+	}
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var env []string
+		for _, e := range p.Env {
+			if !strings.HasPrefix(e, k+"=") {
+				env = append(env, e)
+			}
+		}
+		p.Env = append(env, k+"="+kv[k])
+	}
+}
+
+// CaptureLogs keeps the stdout and stderr of the process in memory, so
+// they can be read with Logs. It must be called before the process is
+// started.
+func (p *Proc) CaptureLogs() {
+	p.stdout, p.stderr = &logBuffer{}, &logBuffer{}
+	p.Stdout, p.Stderr = p.stdout, p.stderr
+}
+
+// Logs returns the stdout and stderr of the process written so far, or
+// empty strings if they are not captured.
+func (p *Proc) Logs() (string, string) {
+	if p.stdout == nil {
+		return "", ""
+	}
+	return p.stdout.String(), p.stderr.String()
+}
+
 func (p *Proc) CleanUnsuppportedV1Flags() {
 	var args []string
 	for _, arg := range p.Args {
@@ -168,6 +223,10 @@ func (p *Proc) Start() error {
 }
 
 func (p *Proc) Stop() {
+	// the process is not started
+	if p.Cmd.Process == nil {
+		return
+	}
 	if err := p.Cmd.Process.Kill(); err != nil {
 		fmt.Printf("Process Kill error: %v", err)
 		return
@@ -175,16 +234,113 @@ func (p *Proc) Stop() {
 	p.Cmd.Wait()
 }
 
+// Shutdown stops the process gracefully. It sends SIGTERM, and waits up to
+// the timeout for the process to exit, so it can sync its WAL and release
+// the locks of its files. If the process does not exit in time, it is
+// killed, and Shutdown returns true. The process is reaped either way.
+func (p *Proc) Shutdown(timeout time.Duration) (killed bool, err error) {
+	if err := p.Cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return false, err
+	}
+	// the exit status of a process terminated by the signal is an error
+	donec := make(chan struct{})
+	go func() {
+		p.Cmd.Wait()
+		close(donec)
+	}()
+	select {
+	case <-donec:
+		return false, nil
+	case <-time.After(timeout):
+	}
+	if err := p.Cmd.Process.Kill(); err != nil {
+		fmt.Printf("Process Kill error: %v", err)
+	}
+	<-donec
+	return true, nil
+}
+
+// Restart stops the process, and starts it again with the same flags,
+// environment and data dir once its ports are released, so it recovers
+// from its data dir as after a crash.
 func (p *Proc) Restart() error {
 	p.Stop()
+	for _, u := range []string{p.URL, p.PeerURL} {
+		if err := waitPortReleased(u); err != nil {
+			return err
+		}
+	}
+	// a command cannot be started twice
+	cmd := exec.Command(p.Path, p.Args[1:]...)
+	cmd.Env, cmd.Dir = p.Env, p.Dir
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = p.Stdin, p.Stdout, p.Stderr
+	p.Cmd = cmd
 	return p.Start()
 }
 
+// waitPortReleased waits until the port of the given URL can be bound.
+func waitPortReleased(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	for k := 0; k < 50; k++ {
+		l, err := net.Listen("tcp", u.Host)
+		if err == nil {
+			return l.Close()
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("port of %s is not released after a long time", rawurl)
+}
+
 func (p *Proc) Terminate() {
 	p.Stop()
 	os.RemoveAll(p.DataDir)
 }
 
+// State returns the raft state that the member reports in its stats, which
+// is "StateLeader" or "leader" for the leader, depending on its version.
+func (p *Proc) State() (string, error) {
+	resp, err := http.Get(p.URL + "/v2/stats/self")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var stats struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return "", err
+	}
+	return stats.State, nil
+}
+
+func isLeaderState(state string) bool {
+	return state == "StateLeader" || state == "leader"
+}
+
+// logBuffer is a buffer that the process writes to while it is read.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
 type ProcGroup []*Proc
 
 func NewProcInProcGroupWithV1Flags(path string, num int, idx int) *Proc {
@@ -193,31 +349,94 @@ func NewProcInProcGroupWithV1Flags(path string, num int, idx int) *Proc {
 }
 
 func NewProcGroupWithV1Flags(path string, num int) ProcGroup {
-	pg := make([]*Proc, num)
-	for i := 0; i < num; i++ {
+	return NewProcGroupWithV1FlagsAt(path, DefaultAddrs(num))
+}
+
+// NewProcGroupWithV1FlagsAt is similar to NewProcGroupWithV1Flags, but the
+// i-th process listens on the i-th of the given addresses, and the others
+// join the first one.
+func NewProcGroupWithV1FlagsAt(path string, addrs []Addrs) ProcGroup {
+	pg := make([]*Proc, len(addrs))
+	for i := range pg {
 		pg[i] = NewProcWithDefaultFlags(path)
 		pg[i].SetName(fmt.Sprintf("etcd%d", i))
-		pg[i].SetV1PeerAddr(fmt.Sprintf("127.0.0.1:%d", 7001+i))
-		pg[i].SetV1Addr(fmt.Sprintf("127.0.0.1:%d", 4001+i))
+		pg[i].SetV1PeerAddr(addrs[i].Peer)
+		pg[i].SetV1Addr(addrs[i].Client)
 		if i > 0 {
-			pg[i].SetV1Peers([]string{"127.0.0.1:7001"})
+			pg[i].SetV1Peers([]string{addrs[0].Peer})
 		}
 	}
 	return pg
 }
 
 func NewProcGroupViaDiscoveryWithV1Flags(path string, num int, url string) ProcGroup {
-	pg := make([]*Proc, num)
+	return NewProcGroupViaDiscoveryWithV1FlagsAt(path, url, DefaultAddrs(num))
+}
+
+// NewProcGroupViaDiscoveryWithV1FlagsAt is similar to
+// NewProcGroupViaDiscoveryWithV1Flags, but the i-th process listens on the
+// i-th of the given addresses.
+func NewProcGroupViaDiscoveryWithV1FlagsAt(path string, url string, addrs []Addrs) ProcGroup {
+	pg := make([]*Proc, len(addrs))
 	for i := range pg {
 		pg[i] = NewProcWithDefaultFlags(path)
 		pg[i].SetName(fmt.Sprintf("etcd%d", i))
 		pg[i].SetDiscovery(url)
-		pg[i].SetV1PeerAddr(fmt.Sprintf("127.0.0.1:%d", 7001+i))
-		pg[i].SetV1Addr(fmt.Sprintf("127.0.0.1:%d", 4001+i))
+		pg[i].SetV1PeerAddr(addrs[i].Peer)
+		pg[i].SetV1Addr(addrs[i].Client)
 	}
 	return pg
 }
 
+// Addrs are the client and peer addresses that a process listens on, as
+// host:port.
+type Addrs struct {
+	Client, Peer string
+}
+
+// DefaultAddrs returns the addresses of num processes from the default
+// ports of etcd 0.4 on, 4001 for clients and 7001 for peers.
+func DefaultAddrs(num int) []Addrs {
+	addrs := make([]Addrs, num)
+	for i := range addrs {
+		addrs[i] = Addrs{
+			Client: fmt.Sprintf("127.0.0.1:%d", 4001+i),
+			Peer:   fmt.Sprintf("127.0.0.1:%d", 7001+i),
+		}
+	}
+	return addrs
+}
+
+// FreeAddrs returns the addresses of num processes on ports that are free,
+// so that groups of processes can run in parallel. The ports are found by
+// listening on port 0, and may be taken by another process before they are
+// used. The same addresses must be given to the group of processes that
+// inherits the data dirs of another, since the addresses are recorded in
+// the data dirs.
+func FreeAddrs(num int) ([]Addrs, error) {
+	var ls []net.Listener
+	defer func() {
+		for _, l := range ls {
+			l.Close()
+		}
+	}()
+	// keep listening until all the ports are found, so none is found twice
+	ports := make([]string, 2*num)
+	for i := range ports {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		ls = append(ls, l)
+		ports[i] = l.Addr().String()
+	}
+	addrs := make([]Addrs, num)
+	for i := range addrs {
+		addrs[i] = Addrs{Client: ports[2*i], Peer: ports[2*i+1]}
+	}
+	return addrs, nil
+}
+
 func (pg ProcGroup) SetPeerTLS(certFile, keyFile, caFile string) {
 	for i := range pg {
 		pg[i].SetPeerTLS(certFile, keyFile, caFile)
@@ -236,6 +455,12 @@ func (pg ProcGroup) SetSnapCount(count int) {
 	}
 }
 
+func (pg ProcGroup) CaptureLogs() {
+	for _, p := range pg {
+		p.CaptureLogs()
+	}
+}
+
 func (pg ProcGroup) CleanUnsuppportedV1Flags() {
 	for _, p := range pg {
 		p.CleanUnsuppportedV1Flags()
@@ -254,6 +479,36 @@ func (pg ProcGroup) Start() error {
 	return nil
 }
 
+// WaitForLeader waits until a member reports itself as the leader, and
+// returns its index in the group. If no leader is found before the timeout,
+// the error lists the state last seen for each member.
+func (pg ProcGroup) WaitForLeader(timeout time.Duration) (int, error) {
+	states := make([]string, len(pg))
+	deadline := time.Now().Add(timeout)
+	for {
+		for i, p := range pg {
+			state, err := p.State()
+			if err != nil {
+				states[i] = err.Error()
+				continue
+			}
+			if isLeaderState(state) {
+				return i, nil
+			}
+			states[i] = state
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	ss := make([]string, len(pg))
+	for i, p := range pg {
+		ss[i] = fmt.Sprintf("%s: %s", p.Name, states[i])
+	}
+	return -1, fmt.Errorf("no leader elected after %v (%s)", timeout, strings.Join(ss, "; "))
+}
+
 func (pg ProcGroup) Wait() error {
 	for _, p := range pg {
 		if err := p.Wait(); err != nil {
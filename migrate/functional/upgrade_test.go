@@ -10,7 +10,11 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/coreos/etcd/pkg/fileutil"
 )
 
 var (
@@ -63,6 +67,133 @@ func TestStartNewMember(t *testing.T) {
 	}
 }
 
+func TestStartNewMemberWithEnv(t *testing.T) {
+	p := NewProcWithDefaultFlags(v2BinPath)
+	// the name is given by the environment instead of the flag
+	var args []string
+	for _, arg := range p.Args {
+		if !strings.HasPrefix(arg, "--name=") {
+			args = append(args, arg)
+		}
+	}
+	p.Args = args
+	p.SetEnv(map[string]string{"ETCD_NAME": "default"})
+	p.SetEnv(map[string]string{"ETCD_NAME": "envname"})
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer p.Terminate()
+
+	resp, err := http.Get(p.URL + "/v2/members")
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	defer resp.Body.Close()
+	var ms struct {
+		Members []struct {
+			Name string `json:"name"`
+		} `json:"members"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		t.Fatalf("Decode error: %v", err)
+	}
+	if len(ms.Members) != 1 || ms.Members[0].Name != "envname" {
+		t.Errorf("members = %+v, want one named %s", ms.Members, "envname")
+	}
+}
+
+func TestStartNewMemberLogs(t *testing.T) {
+	p := NewProcWithDefaultFlags(v2BinPath)
+	p.Args = append(p.Args, "-unknown-flag")
+	p.CaptureLogs()
+	if err := p.Start(); err == nil {
+		p.Terminate()
+		t.Fatalf("Start succeeded, want error")
+	}
+	p.Wait()
+	os.RemoveAll(p.DataDir)
+
+	if _, stderr := p.Logs(); !strings.Contains(stderr, "unknown-flag") {
+		t.Errorf("stderr = %q, want it to contain %q", stderr, "unknown-flag")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	p := NewProcWithDefaultFlags(v2BinPath)
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer p.Terminate()
+
+	req, err := http.NewRequest("PUT", p.URL+"/v2/keys/foo", strings.NewReader("value=bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT error: %v", err)
+	}
+	resp.Body.Close()
+
+	if err = p.Restart(); err != nil {
+		t.Fatalf("Restart error: %v", err)
+	}
+	resp, err = http.Get(p.URL + "/v2/keys/foo")
+	if err != nil {
+		t.Fatalf("GET error: %v", err)
+	}
+	defer resp.Body.Close()
+	var r struct {
+		Node struct {
+			Value string `json:"value"`
+		} `json:"node"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Node.Value != "bar" {
+		t.Errorf("value = %q, want %q", r.Node.Value, "bar")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	p := NewProcWithDefaultFlags(v2BinPath)
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer os.RemoveAll(p.DataDir)
+
+	killed, err := p.Shutdown(10 * time.Second)
+	if err != nil {
+		t.Fatalf("Shutdown error: %v", err)
+	}
+	if killed {
+		t.Errorf("killed = %v, want false", killed)
+	}
+	// the WAL files are not locked by the process anymore
+	waldir := path.Join(p.DataDir, "wal")
+	names, err := fileutil.ReadDir(waldir)
+	if err != nil {
+		t.Fatalf("ReadDir error: %v", err)
+	}
+	if len(names) == 0 {
+		t.Fatalf("no WAL file in %s", waldir)
+	}
+	for _, name := range names {
+		l, err := fileutil.NewLock(path.Join(waldir, name))
+		if err != nil {
+			t.Fatalf("NewLock error: %v", err)
+		}
+		if err = l.TryLock(); err != nil {
+			t.Errorf("%s: TryLock error: %v", name, err)
+		} else {
+			l.Unlock()
+		}
+		l.Destroy()
+	}
+}
+
 func TestStartV2Member(t *testing.T) {
 	tests := []*Proc{
 		NewProcWithDefaultFlags(v2BinPath),
@@ -121,6 +252,32 @@ func TestStartV1Member(t *testing.T) {
 	}
 }
 
+func TestWaitForLeader(t *testing.T) {
+	pg := NewProcGroupWithV1Flags(v1BinPath, 3)
+	if err := pg.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer pg.Terminate()
+
+	idx, err := pg.WaitForLeader(10 * time.Second)
+	if err != nil {
+		t.Fatalf("WaitForLeader error: %v", err)
+	}
+	var leaders []int
+	for i, p := range pg {
+		state, err := p.State()
+		if err != nil {
+			t.Fatalf("#%d: State error: %v", i, err)
+		}
+		if isLeaderState(state) {
+			leaders = append(leaders, i)
+		}
+	}
+	if len(leaders) != 1 || leaders[0] != idx {
+		t.Errorf("leaders = %v, want [%d]", leaders, idx)
+	}
+}
+
 func TestUpgradeV1Cluster(t *testing.T) {
 	// get v2-desired v1 data dir
 	pg := NewProcGroupWithV1Flags(v1BinPath, 3)
@@ -158,6 +315,40 @@ func TestUpgradeV1Cluster(t *testing.T) {
 	}
 }
 
+func TestUpgradeV1ClusterDryRun(t *testing.T) {
+	pg := NewProcGroupWithV1Flags(v1BinPath, 3)
+	if err := pg.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer pg.Terminate()
+	cmd := exec.Command(etcdctlBinPath, "upgrade", "--dry-run", "--peer-url", pg[1].PeerURL, "--data-dir", pg[1].DataDir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("CombinedOutput error: %v, output: %s", err, out)
+	}
+	for _, p := range pg {
+		if !bytes.Contains(out, []byte(p.Name)) {
+			t.Errorf("output = %s, want member %s planned", out, p.Name)
+		}
+	}
+
+	// a real upgrade makes the cluster exit in 10 seconds, so the members
+	// are polled past it, and the first one that stops serving version 1
+	// fails the test right away
+	for deadline := time.Now().Add(12 * time.Second); time.Now().Before(deadline); {
+		for _, p := range pg {
+			ver, err := checkInternalVersion(p.URL)
+			if err != nil {
+				t.Fatalf("checkVersion error: %v", err)
+			}
+			if ver != "1" {
+				t.Fatalf("internal version = %s, want %s", ver, "1")
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 func TestUpgradeV1SnapshotedCluster(t *testing.T) {
 	// get v2-desired v1 data dir
 	pg := NewProcGroupWithV1Flags(v1BinPath, 3)
@@ -231,21 +422,28 @@ func TestJoinV1Cluster(t *testing.T) {
 }
 
 func TestJoinV1ClusterViaDiscovery(t *testing.T) {
+	t.Parallel()
+	addrs, err := FreeAddrs(4)
+	if err != nil {
+		t.Fatalf("FreeAddrs error: %v", err)
+	}
 	dp := NewProcWithDefaultFlags(v1BinPath)
-	dp.SetV1Addr("127.0.0.1:5001")
-	dp.SetV1PeerAddr("127.0.0.1:8001")
+	dp.SetV1Addr(addrs[0].Client)
+	dp.SetV1PeerAddr(addrs[0].Peer)
 	if err := dp.Start(); err != nil {
 		t.Fatalf("Start error: %v", err)
 	}
 	defer dp.Terminate()
 
-	durl := "http://127.0.0.1:5001/v2/keys/cluster/"
-	pg := NewProcGroupViaDiscoveryWithV1Flags(v1BinPath, 1, durl)
+	durl := dp.URL + "/v2/keys/cluster/"
+	// the member of the v2 group that inherits the data dir keeps its
+	// addresses
+	pg := NewProcGroupViaDiscoveryWithV1FlagsAt(v1BinPath, durl, addrs[1:2])
 	if err := pg.Start(); err != nil {
 		t.Fatalf("Start error: %v", err)
 	}
 	pg.Stop()
-	npg := NewProcGroupViaDiscoveryWithV1Flags(v2BinPath, 3, durl)
+	npg := NewProcGroupViaDiscoveryWithV1FlagsAt(v2BinPath, durl, addrs[1:])
 	npg[0].SetDataDir(pg[0].DataDir)
 	if err := npg.Start(); err != nil {
 		t.Fatalf("Start error: %v", err)
@@ -413,3 +611,45 @@ func checkInternalVersion(url string) (string, error) {
 	err = json.Unmarshal(b, &m)
 	return m["internalVersion"], err
 }
+
+func TestProcGroupsInParallel(t *testing.T) {
+	t.Parallel()
+	addrs, err := FreeAddrs(6)
+	if err != nil {
+		t.Fatalf("FreeAddrs error: %v", err)
+	}
+	groups := []ProcGroup{
+		NewProcGroupWithV1FlagsAt(v2BinPath, addrs[:3]),
+		NewProcGroupWithV1FlagsAt(v2BinPath, addrs[3:]),
+	}
+	// the groups are terminated even if one of them fails to start
+	for _, pg := range groups {
+		defer pg.Terminate()
+	}
+	errc := make(chan error, len(groups))
+	for _, pg := range groups {
+		go func(pg ProcGroup) { errc <- pg.Start() }(pg)
+	}
+	// every start returns before the groups can be terminated
+	var errs []error
+	for range groups {
+		if err := <-errc; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		t.Fatalf("Start error: %v", errs[0])
+	}
+
+	for i, pg := range groups {
+		for _, p := range pg {
+			ver, err := checkInternalVersion(p.URL)
+			if err != nil {
+				t.Fatalf("#%d: checkVersion error: %v", i, err)
+			}
+			if ver != "2" {
+				t.Errorf("#%d: internal version = %s, want %s", i, ver, "2")
+			}
+		}
+	}
+}
@@ -17,7 +17,7 @@ package fileutil
 import (
 	"io/ioutil"
 	"os"
-	"path"
+	"path/filepath"
 	"sort"
 )
 
@@ -28,7 +28,7 @@ const (
 // IsDirWriteable checks if dir is writable by writing and removing a file
 // to dir. It returns nil if dir is writable.
 func IsDirWriteable(dir string) error {
-	f := path.Join(dir, ".touch")
+	f := filepath.Join(dir, ".touch")
 	if err := ioutil.WriteFile(f, []byte(""), privateFileMode); err != nil {
 		return err
 	}
@@ -64,3 +64,23 @@ func TestReadDir(t *testing.T) {
 		t.Fatalf("ReadDir: got %v, want %v", fs, wfs)
 	}
 }
+
+func TestSyncDir(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected ioutil.TempDir error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := ioutil.WriteFile(filepath.Join(tmpdir, "abc"), []byte("abc"), privateFileMode); err != nil {
+		t.Fatalf("unexpected ioutil.WriteFile error: %v", err)
+	}
+	if err := SyncDir(tmpdir); err != nil {
+		t.Fatalf("unexpected SyncDir error: %v", err)
+	}
+	if err := os.Remove(filepath.Join(tmpdir, "abc")); err != nil {
+		t.Fatalf("unexpected os.Remove error: %v", err)
+	}
+	if err := SyncDir(tmpdir); err != nil {
+		t.Fatalf("unexpected SyncDir error: %v", err)
+	}
+}
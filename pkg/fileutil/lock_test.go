@@ -17,6 +17,7 @@ package fileutil
 import (
 	"io/ioutil"
 	"os"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -94,3 +95,30 @@ func TestLockAndUnlock(t *testing.T) {
 		t.Error("unexpected blocking")
 	}
 }
+
+func TestLockOwner(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the owner of a lock is only found on linux")
+	}
+	f, err := ioutil.TempFile("", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if pid := LockOwner(f.Name()); pid != 0 {
+		t.Errorf("pid = %d, want 0", pid)
+	}
+	l, err := NewLock(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Destroy()
+	if err = l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if pid := LockOwner(f.Name()); pid != os.Getpid() {
+		t.Errorf("pid = %d, want %d", pid, os.Getpid())
+	}
+}
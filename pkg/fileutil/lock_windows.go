@@ -12,6 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build windows
 // +build windows
 
 package fileutil
@@ -19,10 +20,23 @@ package fileutil
 import (
 	"errors"
 	"os"
+	"syscall"
+	"unsafe"
 )
 
 var (
 	ErrLocked = errors.New("file already locked")
+
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	errLockViolation  syscall.Errno = 0x21 // ERROR_LOCK_VIOLATION
+	lockfileFailNow   uint32        = 0x1  // LOCKFILE_FAIL_IMMEDIATELY
+	lockfileExclusive uint32        = 0x2  // LOCKFILE_EXCLUSIVE_LOCK
+	lockOffsetHigh    uint32        = 0x7fffffff
 )
 
 type Lock interface {
@@ -34,7 +48,7 @@ type Lock interface {
 }
 
 type lock struct {
-	fd   int
+	fd   syscall.Handle
 	file *os.File
 }
 
@@ -44,19 +58,29 @@ func (l *lock) Name() string {
 
 // TryLock acquires exclusivity on the lock without blocking
 func (l *lock) TryLock() error {
-	return nil
+	err := lockFileEx(l.fd, lockfileExclusive|lockfileFailNow)
+	if err != nil && err == errLockViolation {
+		return ErrLocked
+	}
+	return err
 }
 
-// Lock acquires exclusivity on the lock without blocking
+// Lock acquires exclusivity on the lock, blocking until it is released
 func (l *lock) Lock() error {
-	return nil
+	return lockFileEx(l.fd, lockfileExclusive)
 }
 
 // Unlock unlocks the lock
 func (l *lock) Unlock() error {
+	ol := lockOverlapped()
+	r, _, err := procUnlockFileEx.Call(uintptr(l.fd), 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r == 0 {
+		return err
+	}
 	return nil
 }
 
+// Destroy closes the file, which releases the lock if it is held.
 func (l *lock) Destroy() error {
 	return l.file.Close()
 }
@@ -66,6 +90,22 @@ func NewLock(file string) (Lock, error) {
 	if err != nil {
 		return nil, err
 	}
-	l := &lock{int(f.Fd()), f}
+	l := &lock{syscall.Handle(f.Fd()), f}
 	return l, nil
 }
+
+// lockOverlapped returns the location of the locked byte. Locks on Windows
+// are mandatory, so the byte is far beyond the end of the file, where it
+// never blocks reading or writing the file through other handles.
+func lockOverlapped() *syscall.Overlapped {
+	return &syscall.Overlapped{OffsetHigh: lockOffsetHigh}
+}
+
+func lockFileEx(h syscall.Handle, flags uint32) error {
+	ol := lockOverlapped()
+	r, _, err := procLockFileEx.Call(uintptr(h), uintptr(flags), 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
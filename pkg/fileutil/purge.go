@@ -17,55 +17,23 @@ package fileutil
 import (
 	"log"
 	"os"
-	"path"
+	"path/filepath"
 	"sort"
 	"strings"
 	"time"
 )
 
+// PurgeFile removes the oldest files with the given suffix in the directory
+// every interval, until at most max of them remain, as PurgeFileOnce does,
+// until stop is closed. It returns the channel of the error that stops it.
 func PurgeFile(dirname string, suffix string, max uint, interval time.Duration, stop <-chan struct{}) <-chan error {
 	errC := make(chan error, 1)
 	go func() {
 		for {
-			fnames, err := ReadDir(dirname)
-			if err != nil {
+			if _, err := PurgeFileOnce(dirname, suffix, max); err != nil {
 				errC <- err
 				return
 			}
-			newfnames := make([]string, 0)
-			for _, fname := range fnames {
-				if strings.HasSuffix(fname, suffix) {
-					newfnames = append(newfnames, fname)
-				}
-			}
-			sort.Strings(newfnames)
-			for len(newfnames) > int(max) {
-				f := path.Join(dirname, newfnames[0])
-				l, err := NewLock(f)
-				if err != nil {
-					errC <- err
-					return
-				}
-				err = l.TryLock()
-				if err != nil {
-					break
-				}
-				err = os.Remove(f)
-				if err != nil {
-					errC <- err
-					return
-				}
-				err = l.Unlock()
-				if err != nil {
-					log.Printf("filePurge: unlock %s error %v", l.Name(), err)
-				}
-				err = l.Destroy()
-				if err != nil {
-					log.Printf("filePurge: destroy lock %s error %v", l.Name(), err)
-				}
-				log.Printf("filePurge: successfully removed file %s", f)
-				newfnames = newfnames[1:]
-			}
 			select {
 			case <-time.After(interval):
 			case <-stop:
@@ -75,3 +43,55 @@ func PurgeFile(dirname string, suffix string, max uint, interval time.Duration,
 	}()
 	return errC
 }
+
+// PurgeFileOnce removes the oldest files with the given suffix in the
+// directory, until at most max of them remain. It stops at the first file
+// that is locked, which is still in use. It returns the names of the files
+// removed.
+func PurgeFileOnce(dirname string, suffix string, max uint) ([]string, error) {
+	fnames, err := ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	newfnames := make([]string, 0)
+	for _, fname := range fnames {
+		if strings.HasSuffix(fname, suffix) {
+			newfnames = append(newfnames, fname)
+		}
+	}
+	sort.Strings(newfnames)
+	var removed []string
+	for len(newfnames) > int(max) {
+		f := filepath.Join(dirname, newfnames[0])
+		l, err := NewLock(f)
+		if err != nil {
+			return removed, err
+		}
+		err = l.TryLock()
+		if err != nil {
+			break
+		}
+		err = os.Remove(f)
+		if err != nil {
+			return removed, err
+		}
+		// sync the directory, so the removed file is not resurrected
+		// on a power failure
+		err = SyncDir(dirname)
+		if err != nil {
+			return removed, err
+		}
+		err = l.Unlock()
+		if err != nil {
+			log.Printf("filePurge: unlock %s error %v", l.Name(), err)
+		}
+		err = l.Destroy()
+		if err != nil {
+			log.Printf("filePurge: destroy lock %s error %v", l.Name(), err)
+		}
+		log.Printf("filePurge: successfully removed file %s", f)
+		removed = append(removed, newfnames[0])
+		newfnames = newfnames[1:]
+	}
+	return removed, nil
+}
@@ -130,3 +130,44 @@ func TestPurgeFileHoldingLock(t *testing.T) {
 
 	close(stop)
 }
+
+func TestPurgeFileOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purgefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 10; i++ {
+		_, err := os.Create(path.Join(dir, fmt.Sprintf("%d.test", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// create a purge barrier at 5
+	l, err := NewLock(path.Join(dir, fmt.Sprintf("%d.test", 5)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Destroy()
+
+	removed, err := PurgeFileOnce(dir, "test", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wremoved := []string{"0.test", "1.test", "2.test", "3.test", "4.test"}
+	if !reflect.DeepEqual(removed, wremoved) {
+		t.Errorf("removed = %v, want %v", removed, wremoved)
+	}
+	fnames, err := ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wnames := []string{"5.test", "6.test", "7.test", "8.test", "9.test"}
+	if !reflect.DeepEqual(fnames, wnames) {
+		t.Errorf("filenames = %v, want %v", fnames, wnames)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// Backup copies the WAL files that w is holding locks on into destDir,
+// which is created if needed, while w is in use. The WAL is synced first,
+// and the copy of the file being appended is cut at the synced offset, so
+// the copy can be opened at the returned snapshot even if records are
+// appended meanwhile. Appending is blocked only while the file being
+// appended is synced and copied; the older files are copied after. It
+// returns the last snapshot read or saved, and the index of the last entry
+// saved, which the copy ends with. The older files must not be purged
+// until Backup returns.
+func (w *WAL) Backup(destDir string) (snap walpb.Snapshot, lastIndex uint64, err error) {
+	if w.readOnly {
+		return snap, 0, ErrReadOnly
+	}
+	if w.encoder == nil {
+		return snap, 0, ErrNotAppending
+	}
+	if err = os.MkdirAll(destDir, privateDirMode); err != nil {
+		return snap, 0, err
+	}
+	paths, snap, lastIndex, err := w.backupTail(destDir)
+	if err != nil {
+		return snap, 0, err
+	}
+	for _, p := range paths[:len(paths)-1] {
+		if err = copyFile(filepath.Join(destDir, filepath.Base(p)), p, -1, w.fileMode); err != nil {
+			return snap, 0, err
+		}
+	}
+	if err = syncDir(destDir); err != nil {
+		return snap, 0, err
+	}
+	return snap, lastIndex, nil
+}
+
+// backupTail syncs w, and copies the file being appended into destDir up
+// to the synced offset. It returns the paths of the files w is holding
+// locks on, the last snapshot and the index of the last entry.
+func (w *WAL) backupTail(destDir string) ([]string, walpb.Snapshot, uint64, error) {
+	w.lockAppend()
+	defer w.unlockAppend()
+	if err := w.sync(); err != nil {
+		return nil, walpb.Snapshot{}, 0, err
+	}
+	w.mu.Lock()
+	paths := make([]string, len(w.locks))
+	for i, l := range w.locks {
+		paths[i] = l.Name()
+	}
+	w.mu.Unlock()
+	last := paths[len(paths)-1]
+	if err := copyFile(filepath.Join(destDir, filepath.Base(last)), last, w.off, w.fileMode); err != nil {
+		return nil, walpb.Snapshot{}, 0, err
+	}
+	return paths, w.lastSnap, w.enti, nil
+}
+
+// copyFile copies the first n bytes of the file at src, or all of it if n
+// is negative, into a new file at dst with the given mode, and syncs it.
+func copyFile(dst, src string, n int64, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = in
+	if n >= 0 {
+		r = io.LimitReader(in, n)
+	}
+	if _, err = io.Copy(out, r); err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p, dest := path.Join(dir, "wal"), path.Join(dir, "backup")
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var ents []raftpb.Entry
+	save := func(index uint64) {
+		e := raftpb.Entry{Index: index, Term: 1, Data: []byte("data")}
+		if err := w.SaveNoSync(raftpb.HardState{Term: 1, Commit: index}, []raftpb.Entry{e}); err != nil {
+			t.Error(err)
+		}
+		ents = append(ents, e)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		save(i)
+		if i == 5 {
+			if err = w.Cut(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	wsnap := walpb.Snapshot{Index: 3, Term: 1}
+	if err = w.SaveSnapshot(wsnap); err != nil {
+		t.Fatal(err)
+	}
+	// the entries appended last are not synced yet
+	save(11)
+
+	// appending goes on during the backup
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			e := raftpb.Entry{Index: uint64(12 + i), Term: 1}
+			if err := w.Save(raftpb.HardState{Term: 1}, []raftpb.Entry{e}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	snap, lastIndex, err := w.Backup(dest)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snap, wsnap) {
+		t.Errorf("snap = %+v, want %+v", snap, wsnap)
+	}
+	if lastIndex < 11 {
+		t.Errorf("last index = %d, want at least 11", lastIndex)
+	}
+
+	names, err := fileutil.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wnames := w.LockedFiles(); !reflect.DeepEqual(names, wnames) {
+		t.Errorf("names = %v, want %v", names, wnames)
+	}
+	r, err := Open(dest, snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, _, entries, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(entries); n == 0 || entries[n-1].Index != lastIndex {
+		t.Fatalf("entries = %+v, want to end at %d", entries, lastIndex)
+	}
+	if !reflect.DeepEqual(entries[:8], ents[3:]) {
+		t.Errorf("ents = %+v, want %+v", entries[:8], ents[3:])
+	}
+}
+
+func TestBackupNotAppending(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, _, err = w.Backup(path.Join(p, "backup")); err != ErrNotAppending {
+		t.Errorf("err = %v, want %v", err, ErrNotAppending)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+
+	"github.com/coreos/etcd/pkg/crc"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// Checksum identifies the algorithm used to checksum the records of a WAL.
+type Checksum byte
+
+const (
+	// ChecksumCRC32C is CRC-32 with the Castagnoli polynomial, which is
+	// computed in hardware on CPUs that support SSE4.2. It is the default,
+	// and the one used by WAL files that do not record their checksum.
+	ChecksumCRC32C Checksum = iota
+	// ChecksumCRC32IEEE is CRC-32 with the IEEE polynomial, which is faster
+	// than CRC-32C on CPUs without SSE4.2.
+	ChecksumCRC32IEEE
+	// ChecksumCRC32Koopman is CRC-32 with the Koopman polynomial, which
+	// detects more errors than the others for large records.
+	ChecksumCRC32Koopman
+	// ChecksumCRC64ISO is CRC-64 with the ISO polynomial. 64-bit checksums
+	// make an undetected corruption of a large WAL much less likely, at the
+	// cost of 8 more bytes per record.
+	ChecksumCRC64ISO
+	// ChecksumCRC64ECMA is CRC-64 with the ECMA polynomial.
+	ChecksumCRC64ECMA
+)
+
+// Hash is the running checksum chained over the records of a WAL.
+type Hash interface {
+	io.Writer
+	// Sum64 returns the checksum of all the data written so far.
+	// 32-bit checksums are returned in the low bits.
+	Sum64() uint64
+}
+
+// formatVersion is the version of the WAL file format, which is recorded
+// in the crc record at the head of each WAL file.
+const formatVersion byte = 1
+
+var (
+	crcTables = map[Checksum]*crc32.Table{
+		ChecksumCRC32C:       crcTable,
+		ChecksumCRC32IEEE:    crc32.IEEETable,
+		ChecksumCRC32Koopman: crc32.MakeTable(crc32.Koopman),
+	}
+	crc64Tables = map[Checksum]*crc64.Table{
+		ChecksumCRC64ISO:  crc64.MakeTable(crc64.ISO),
+		ChecksumCRC64ECMA: crc64.MakeTable(crc64.ECMA),
+	}
+)
+
+func (c Checksum) valid() bool {
+	return crcTables[c] != nil || c.wide()
+}
+
+// wide reports whether the checksum is 64-bit, in which case it is stored
+// in the crc64 field of the records, and its low 32 bits in the crc field.
+func (c Checksum) wide() bool {
+	return crc64Tables[c] != nil
+}
+
+// newHash returns a hash of the checksum that continues from prev.
+func (c Checksum) newHash(prev uint64) Hash {
+	if c.wide() {
+		return &crc64Hash{crc: prev, tab: crc64Tables[c]}
+	}
+	return crc32Hash{crc.New(uint32(prev), crcTables[c])}
+}
+
+// setCrc sets the checksum of the record to sum.
+func (c Checksum) setCrc(rec *walpb.Record, sum uint64) {
+	rec.Crc = uint32(sum)
+	if c.wide() {
+		// copied, so that sum is not moved to the heap for narrow checksums
+		s := sum
+		rec.Crc64 = &s
+	}
+}
+
+// validate checks the checksum of the record against sum.
+func (c Checksum) validate(rec *walpb.Record, sum uint64) error {
+	if !c.wide() {
+		return rec.Validate(uint32(sum))
+	}
+	if rec.Crc64 != nil && *rec.Crc64 == sum {
+		return nil
+	}
+	rec.Reset()
+	return walpb.ErrCRCMismatch
+}
+
+// recordCrc returns the checksum stored in the record.
+func recordCrc(rec *walpb.Record) uint64 {
+	if rec.Crc64 != nil {
+		return *rec.Crc64
+	}
+	return uint64(rec.Crc)
+}
+
+type crc32Hash struct {
+	hash.Hash32
+}
+
+func (h crc32Hash) Sum64() uint64 { return uint64(h.Sum32()) }
+
+type crc64Hash struct {
+	crc uint64
+	tab *crc64.Table
+}
+
+func (h *crc64Hash) Write(p []byte) (int, error) {
+	h.crc = crc64.Update(h.crc, h.tab, p)
+	return len(p), nil
+}
+
+func (h *crc64Hash) Sum64() uint64 { return h.crc }
+
+// formatData returns the data of the crc record at the head of a WAL file,
+// which describes the format of the records in the file. The flags byte is
+// only written for encrypted files, so the others are unchanged.
+func formatData(c Checksum, encrypted bool) []byte {
+	if encrypted {
+		return []byte{formatVersion, byte(c), formatEncrypted}
+	}
+	return []byte{formatVersion, byte(c)}
+}
+
+// parseFormat returns the checksum described by the data of a crc record.
+// The crc record of the WAL files written before the format was recorded
+// has no data, and these files are checksummed with CRC-32C.
+func parseFormat(d []byte) (Checksum, error) {
+	if len(d) == 0 {
+		return ChecksumCRC32C, nil
+	}
+	if len(d) < 2 || d[0] > formatVersion {
+		return 0, ErrUnsupportedFormat
+	}
+	c := Checksum(d[1])
+	if !c.valid() || !formatCompression(d).valid() {
+		return 0, ErrUnsupportedFormat
+	}
+	return c, nil
+}
+
+// format returns the data of the crc record at the head of the files of w
+// checksummed with c. The compression of the entries appended is recorded
+// after the flags byte, so the files written without it are unchanged.
+func (w *WAL) format(c Checksum) []byte {
+	d := formatData(c, w.aead != nil)
+	if w.padded {
+		if len(d) == 2 {
+			d = append(d, 0)
+		}
+		d[2] |= formatPadded
+	}
+	if w.cp == nil {
+		return d
+	}
+	if len(d) == 2 {
+		d = append(d, 0)
+	}
+	return append(d, byte(w.cp.c))
+}
@@ -0,0 +1,168 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestCreateWithChecksum(t *testing.T) {
+	cs := []Checksum{ChecksumCRC32C, ChecksumCRC32IEEE, ChecksumCRC32Koopman, ChecksumCRC64ISO, ChecksumCRC64ECMA}
+	for _, c := range cs {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := Create(p, []byte("metadata"), WithChecksum(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ents := []raftpb.Entry{{Index: 1, Term: 1, Data: []byte{1}}}
+		if err = w.Save(raftpb.HardState{}, ents); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+
+		// the checksum is detected from the files, and kept for appending
+		if w, err = Open(p, walpb.Snapshot{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err = w.ReadAll(); err != nil {
+			t.Fatalf("checksum %d: err = %v, want nil", c, err)
+		}
+		if w.checksum != c {
+			t.Errorf("checksum = %d, want %d", w.checksum, c)
+		}
+		es := []raftpb.Entry{{Index: 2, Term: 1, Data: []byte{2}}}
+		if err = w.Save(raftpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+		ents = append(ents, es...)
+		w.Close()
+
+		if w, err = Open(p, walpb.Snapshot{}); err != nil {
+			t.Fatal(err)
+		}
+		metadata, _, entries, err := w.ReadAll()
+		if err != nil {
+			t.Fatalf("checksum %d: err = %v, want nil", c, err)
+		}
+		if !reflect.DeepEqual(metadata, []byte("metadata")) {
+			t.Errorf("checksum %d: metadata = %s, want %s", c, metadata, "metadata")
+		}
+		if !reflect.DeepEqual(entries, ents) {
+			t.Errorf("checksum %d: ents = %+v, want %+v", c, entries, ents)
+		}
+		w.Close()
+		os.RemoveAll(p)
+	}
+}
+
+func TestCreateWithUnsupportedChecksum(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	if _, err = Create(p, nil, WithChecksum(Checksum(100))); err != ErrUnsupportedFormat {
+		t.Errorf("err = %v, want %v", err, ErrUnsupportedFormat)
+	}
+}
+
+func TestReadAllMixedChecksums(t *testing.T) {
+	ents := []raftpb.Entry{{Index: 1, Term: 1, Data: []byte{1}}}
+	dirs := make([]string, 2)
+	for i, c := range []Checksum{ChecksumCRC32C, ChecksumCRC64ISO} {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(p)
+		w, err := Create(p, []byte("metadata"), WithChecksum(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Save(raftpb.HardState{}, ents); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		dirs[i] = p
+	}
+
+	// replace the second file with one checksummed differently
+	name := walName(1, 2)
+	b, err := ioutil.ReadFile(path.Join(dirs[1], name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path.Join(dirs[0], name), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := Open(dirs[0], walpb.Snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, _, _, err = w.ReadAll(); err != ErrChecksumConflict {
+		t.Errorf("err = %v, want %v", err, ErrChecksumConflict)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		data []byte
+		wc   Checksum
+		werr error
+	}{
+		// written before the format was recorded
+		{nil, ChecksumCRC32C, nil},
+		{formatData(ChecksumCRC32C, false), ChecksumCRC32C, nil},
+		{formatData(ChecksumCRC32IEEE, false), ChecksumCRC32IEEE, nil},
+		{formatData(ChecksumCRC32Koopman, false), ChecksumCRC32Koopman, nil},
+		{formatData(ChecksumCRC64ISO, false), ChecksumCRC64ISO, nil},
+		{formatData(ChecksumCRC64ECMA, false), ChecksumCRC64ECMA, nil},
+		{[]byte{formatVersion}, 0, ErrUnsupportedFormat},
+		{[]byte{formatVersion + 1, byte(ChecksumCRC32C)}, 0, ErrUnsupportedFormat},
+		{[]byte{formatVersion, 100}, 0, ErrUnsupportedFormat},
+		// the compression of the entries is recorded after the flags
+		{[]byte{formatVersion, byte(ChecksumCRC32C), 0, byte(CompressionZstd)}, ChecksumCRC32C, nil},
+		{[]byte{formatVersion, byte(ChecksumCRC32C), 0, 100}, 0, ErrUnsupportedFormat},
+	}
+	for i, tt := range tests {
+		c, err := parseFormat(tt.data)
+		if c != tt.wc {
+			t.Errorf("#%d: checksum = %d, want %d", i, c, tt.wc)
+		}
+		if err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/pkg/pbutil"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// Compact rewrites the records of the WAL in the given directory from the
+// given snapshot on into a single new WAL file, which replaces all the
+// files in the directory. The metadata, the checksum, the snapshot, the
+// latest state and the entries after the snapshot are kept.
+// The new file is written into a temporary directory first, which is then
+// renamed into place, so a Compact that is interrupted can be run again.
+// Compact returns a *LockedError if the WAL is in use. The options
+// apply to the new WAL file, and must give the key of an encrypted WAL.
+func Compact(dirpath string, snap walpb.Snapshot, opts ...Option) error {
+	dirpath = filepath.Clean(dirpath)
+	tmpdir := dirpath + ".compact"
+	olddir := dirpath + ".old"
+	if !Exist(dirpath) && Exist(tmpdir) {
+		// interrupted after the new WAL was complete, finish the swap
+		return swapDir(dirpath, tmpdir, olddir)
+	}
+	if err := os.RemoveAll(tmpdir); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(olddir); err != nil {
+		return err
+	}
+
+	o := newOptions(opts)
+	// the files are kept locked until the swap is done
+	w, err := openAtIndex(dirpath, snap, true, o)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	w.readOnly = true
+	metadata, state, ents, err := w.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	o.checksum = w.checksum
+	nw, err := create(tmpdir, metadata, snap, o)
+	if err != nil {
+		return err
+	}
+	if err = nw.Save(state, ents); err != nil {
+		nw.Close()
+		return err
+	}
+	if err = nw.Close(); err != nil {
+		return err
+	}
+	return swapDir(dirpath, tmpdir, olddir)
+}
+
+// swapDir replaces dirpath with tmpdir, moving dirpath to olddir and
+// removing it afterwards.
+func swapDir(dirpath, tmpdir, olddir string) error {
+	if err := syncDir(tmpdir); err != nil {
+		return err
+	}
+	if _, err := os.Stat(dirpath); err == nil {
+		if err := os.Rename(dirpath, olddir); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmpdir, dirpath); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(dirpath)); err != nil {
+		return err
+	}
+	return os.RemoveAll(olddir)
+}
+
+// Compact rewrites the WAL file that covers the given snapshot, which is
+// the oldest one needed to open w at it, dropping the entries up to the
+// snapshot. The rewritten file keeps its name, and starts with the
+// metadata, the snapshot, and the latest state in the file, followed by
+// the entries after the snapshot. Its crc chain is rewritten to still
+// continue into the next file. The files before it that w is holding
+// locks on are removed, since the chain no longer continues from them.
+// The snapshot must have been saved to the WAL. The file being appended
+// is not compacted, so Cut should be called before.
+func (w *WAL) Compact(snap walpb.Snapshot) error {
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	names := lockNames(w.locks)
+	i, ok := searchIndex(names, snap.Index)
+	if !ok {
+		return ErrFileNotFound
+	}
+	if i == len(names)-1 {
+		return nil
+	}
+	// the files may be in other directories than w.dir, if opened by
+	// OpenMulti
+	fpath := w.locks[i].Name()
+	b, err := w.compactFile(fpath, snap)
+	if err != nil {
+		return err
+	}
+
+	tmp := fpath + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, w.fileMode); err != nil {
+		return err
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, fpath); err != nil {
+		return err
+	}
+
+	// the lock is held on the replaced file, so lock the new one
+	l, err := fileutil.NewLock(fpath)
+	if err != nil {
+		return err
+	}
+	if err = l.Lock(); err != nil {
+		return err
+	}
+	old := w.locks[i]
+	w.locks[i] = l
+	if err = old.Unlock(); err == nil {
+		err = old.Destroy()
+	}
+	if err != nil {
+		return err
+	}
+	// the locks are trimmed as the files are removed, so w.locks never
+	// lists a destroyed lock if one of them fails
+	dirs := map[string]bool{filepath.Dir(fpath): true}
+	for j, l := range w.locks[:i] {
+		if err = l.Unlock(); err == nil {
+			err = l.Destroy()
+		}
+		if err == nil {
+			err = os.Remove(l.Name())
+		}
+		if err != nil {
+			w.locks = w.locks[j+1:]
+			return err
+		}
+		dirs[filepath.Dir(l.Name())] = true
+	}
+	w.locks = w.locks[i:]
+	for dir := range dirs {
+		if err = syncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactFile returns the content of the WAL file at the given path
+// compacted to the given snapshot.
+func (w *WAL) compactFile(fpath string, snap walpb.Snapshot) ([]byte, error) {
+	d, err := openDecoder(osStore{}, filepath.Dir(fpath), []string{filepath.Base(fpath)})
+	if err != nil {
+		return nil, err
+	}
+	defer d.close()
+	d.aead, d.maxBytes = w.aead, w.maxBytes
+	var (
+		metadata []byte
+		state    raftpb.HardState
+		ents     []raftpb.Entry
+	)
+	rec := &walpb.Record{}
+	for {
+		if err = d.decode(rec); err != nil {
+			break
+		}
+		switch rec.Type {
+		case metadataType:
+			metadata = rec.Data
+		case stateType:
+			state.Reset()
+			if err = unmarshal(&state, rec.Data); err != nil {
+				return nil, d.decodeError(rec.Type, err)
+			}
+		case entryType:
+			var e raftpb.Entry
+			if err = unmarshal(&e, rec.Data); err != nil {
+				return nil, d.decodeError(rec.Type, err)
+			}
+			// drop the entries overwritten by e
+			for len(ents) > 0 && ents[len(ents)-1].Index >= e.Index {
+				ents = ents[:len(ents)-1]
+			}
+			if e.Index > snap.Index {
+				ents = append(ents, e)
+			}
+		case crcType:
+			d.updateCRC(recordCrc(rec))
+		}
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+
+	recs := []*walpb.Record{
+		{Type: metadataType, Data: metadata},
+		{Type: snapshotType, Data: pbutil.MustMarshal(&snap)},
+	}
+	if !raft.IsEmptyHardState(state) {
+		recs = append(recs, &walpb.Record{Type: stateType, Data: pbutil.MustMarshal(&state)})
+	}
+	for i := range recs {
+		if recs[i], err = w.seal(recs[i]); err != nil {
+			return nil, err
+		}
+	}
+	for i := range ents {
+		rec, err := w.entryRecord(&ents[i])
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	// find the crc to start the chain with, so that it still ends with
+	// the crc that the next file continues from
+	c, end := d.checksum, d.lastCRC()
+	h := c.newHash(0)
+	var n int64
+	for _, r := range recs {
+		h.Write(r.Data)
+		n += int64(len(r.Data))
+	}
+	start, ok := c.unchain(end, h.Sum64(), n)
+	if !ok {
+		return nil, ErrCRCMismatch
+	}
+
+	buf := new(bytes.Buffer)
+	e := newEncoder(buf, start, c)
+	if err = e.encode(&walpb.Record{Type: crcType, Data: w.format(c)}); err != nil {
+		return nil, err
+	}
+	for _, r := range recs {
+		if err = e.encode(r); err != nil {
+			return nil, err
+		}
+	}
+	if err = e.flush(); err != nil {
+		return nil, err
+	}
+	if e.crc.Sum64() != end {
+		return nil, ErrCRCMismatch
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,282 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestCompact(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		es := []raftpb.Entry{{Index: uint64(i), Term: 1, Data: []byte{byte(i)}}}
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: uint64(i)}, es); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap := walpb.Snapshot{Index: 5, Term: 1}
+	if err = w.SaveSnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+
+	// the WAL is in use
+	if err = Compact(p, snap); !errors.Is(err, fileutil.ErrLocked) {
+		t.Errorf("err = %v, want %v", err, fileutil.ErrLocked)
+	}
+	w.Close()
+
+	if w, err = Open(p, snap); err != nil {
+		t.Fatal(err)
+	}
+	wmetadata, wstate, wents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if err = Compact(p, snap); err != nil {
+		t.Fatal(err)
+	}
+	names, err := fileutil.ReadDir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wnames := []string{walName(0, 5)}; !reflect.DeepEqual(names, wnames) {
+		t.Errorf("names = %v, want %v", names, wnames)
+	}
+	for _, dir := range []string{p + ".compact", p + ".old"} {
+		if _, err = os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%s is not removed", dir)
+		}
+	}
+
+	if w, err = Open(p, snap); err != nil {
+		t.Fatal(err)
+	}
+	metadata, state, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, wmetadata) {
+		t.Errorf("metadata = %s, want %s", metadata, wmetadata)
+	}
+	if !reflect.DeepEqual(state, wstate) {
+		t.Errorf("state = %+v, want %+v", state, wstate)
+	}
+	if !reflect.DeepEqual(ents, wents) {
+		t.Errorf("ents = %+v, want %+v", ents, wents)
+	}
+	// the compacted WAL is ready for appending
+	es := []raftpb.Entry{{Index: 11, Term: 1}}
+	if err = w.Save(raftpb.HardState{}, es); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+}
+
+func TestCompactInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "wal")
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}}
+	if err = w.Save(raftpb.HardState{}, ents); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// interrupted after moving the old WAL away
+	if err = Compact(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(p, p+".compact"); err != nil {
+		t.Fatal(err)
+	}
+	if err = Compact(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, ents) {
+		t.Errorf("ents = %+v, want %+v", entries, ents)
+	}
+}
+
+func TestCompactLocked(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "wal")
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 1, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = Compact(p, walpb.Snapshot{})
+	if _, ok := err.(*LockedError); !ok {
+		t.Fatalf("err = %v, want a *LockedError", err)
+	}
+	if Exist(p + ".compact") {
+		t.Errorf("temporary directory exists after a failed Compact")
+	}
+	names, err := fileutil.ReadDir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{walName(0, 0)}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names = %v, want %v", names, want)
+	}
+}
+
+func TestWALCompact(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ents []raftpb.Entry
+	for i := 1; i <= 15; i++ {
+		ents = append(ents, raftpb.Entry{Index: uint64(i), Term: 1, Data: []byte{byte(i)}})
+	}
+	st := raftpb.HardState{Term: 1, Vote: 1, Commit: 10}
+	if err = w.Save(st, ents[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveSnapshot(walpb.Snapshot{Index: 5, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(raftpb.HardState{}, ents[10:]); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveSnapshot(walpb.Snapshot{Index: 12, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	first := path.Join(p, walName(0, 0))
+	fi, err := os.Stat(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := fi.Size()
+
+	// the first file is rewritten without the entries up to 5
+	if err = w.Compact(walpb.Snapshot{Index: 5, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err = os.Stat(first); err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() >= size {
+		t.Errorf("size = %d, want less than %d", fi.Size(), size)
+	}
+	if g := len(w.LockedFiles()); g != 3 {
+		t.Errorf("locked files = %d, want 3", g)
+	}
+	r, err := OpenReadOnly(p, walpb.Snapshot{Index: 5, Term: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, state, entries, err := r.ReadAll()
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state, st) {
+		t.Errorf("state = %+v, want %+v", state, st)
+	}
+	if !reflect.DeepEqual(entries, ents[5:]) {
+		t.Errorf("ents = %+v, want %+v", entries, ents[5:])
+	}
+
+	// the file covering 12 is rewritten, and the first one is removed
+	if err = w.Compact(walpb.Snapshot{Index: 12, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(first); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+	if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 16, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{Index: 12, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	metadata, _, entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "metadata")
+	}
+	wents := append(ents[12:], raftpb.Entry{Index: 16, Term: 1})
+	if !reflect.DeepEqual(entries, wents) {
+		t.Errorf("ents = %+v, want %+v", entries, wents)
+	}
+}
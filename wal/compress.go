@@ -0,0 +1,212 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/github.com/klauspost/compress/snappy"
+	"github.com/coreos/etcd/Godeps/_workspace/src/github.com/klauspost/compress/zstd"
+)
+
+// Compression identifies the algorithm used to compress the entries
+// appended to a WAL.
+type Compression byte
+
+const (
+	// CompressionNone appends the entries uncompressed. It is the default.
+	CompressionNone Compression = iota
+	// CompressionFlate compresses the entries with DEFLATE at the fastest
+	// level, which trades some ratio for the throughput of Save.
+	CompressionFlate
+	// CompressionSnappy compresses the entries with snappy, which
+	// compresses less than flate, but costs Save the least.
+	CompressionSnappy
+	// CompressionZstd compresses the entries with zstd at its default
+	// level, which compresses better than flate at a similar speed, and
+	// decompresses faster than both.
+	CompressionZstd
+	// CompressionGzip compresses the entries with gzip at the default
+	// level, which trades the throughput of Save for a better ratio.
+	CompressionGzip
+)
+
+func (c Compression) valid() bool {
+	return c <= CompressionGzip
+}
+
+// resetWriter is a compressing writer that can be reused.
+type resetWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// compressor compresses the data of entry records. The compressed data
+// starts with the Compression used, so the decoder knows how to
+// decompress it. It is not safe for concurrent use.
+type compressor struct {
+	c   Compression
+	buf bytes.Buffer
+	cw  resetWriter
+	zw  *zstd.Encoder
+	zb  []byte
+}
+
+func newCompressor(c Compression) *compressor {
+	if c == CompressionNone {
+		return nil
+	}
+	return &compressor{c: c}
+}
+
+// compress returns the compressed data, or false if compressing does not
+// make the data smaller.
+func (cp *compressor) compress(data []byte) ([]byte, bool) {
+	var out []byte
+	switch cp.c {
+	case CompressionZstd:
+		if cp.zw == nil {
+			// the options are valid, so NewWriter never fails
+			cp.zw, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		}
+		cp.zb = cp.zw.EncodeAll(data, append(cp.zb[:0], byte(cp.c)))
+		out = cp.zb
+	case CompressionSnappy:
+		n := snappy.MaxEncodedLen(len(data))
+		if n < 0 {
+			return nil, false
+		}
+		cp.zb = resize(cp.zb, 1+n)
+		cp.zb[0] = byte(cp.c)
+		out = cp.zb[:1+len(snappy.Encode(cp.zb[1:], data))]
+	default:
+		cp.buf.Reset()
+		cp.buf.WriteByte(byte(cp.c))
+		if cp.cw == nil {
+			// the levels are valid, so NewWriter never fails
+			switch cp.c {
+			case CompressionFlate:
+				cp.cw, _ = flate.NewWriter(&cp.buf, flate.BestSpeed)
+			case CompressionGzip:
+				cp.cw = gzip.NewWriter(&cp.buf)
+			}
+		} else {
+			cp.cw.Reset(&cp.buf)
+		}
+		if _, err := cp.cw.Write(data); err != nil {
+			return nil, false
+		}
+		if err := cp.cw.Close(); err != nil {
+			return nil, false
+		}
+		out = cp.buf.Bytes()
+	}
+	if len(out) >= len(data) {
+		return nil, false
+	}
+	b := make([]byte, len(out))
+	copy(b, out)
+	return b, true
+}
+
+// decompress decompresses the data of a compressed entry record, which
+// fails with ErrRecordTooLarge if it decompresses to more than max bytes.
+func decompress(data []byte, max int64) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var r io.Reader
+	switch Compression(data[0]) {
+	case CompressionFlate:
+		fr := flate.NewReader(bytes.NewReader(data[1:]))
+		defer fr.Close()
+		r = fr
+	case CompressionGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	case CompressionSnappy:
+		// the size is known before decoding
+		n, err := snappy.DecodedLen(data[1:])
+		if err != nil {
+			return nil, err
+		}
+		if int64(n) > max {
+			return nil, ErrRecordTooLarge
+		}
+		return snappy.Decode(nil, data[1:])
+	case CompressionZstd:
+		b, err := zstdDecoder(max).DecodeAll(data[1:], nil)
+		if err == zstd.ErrDecoderSizeExceeded || err == zstd.ErrWindowSizeExceeded {
+			return nil, ErrRecordTooLarge
+		}
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+	// a corrupted record can decompress to an arbitrary size
+	b, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, ErrRecordTooLarge
+	}
+	return b, nil
+}
+
+var (
+	zstdMu       sync.Mutex
+	zstdDecoders = make(map[int64]*zstd.Decoder)
+)
+
+// zstdDecoder returns a zstd decoder, safe for concurrent use, that fails
+// to decode data larger than the given size, since a corrupted record can
+// decompress to an arbitrary size.
+func zstdDecoder(max int64) *zstd.Decoder {
+	if max < 1 {
+		max = 1
+	}
+	zstdMu.Lock()
+	defer zstdMu.Unlock()
+	d := zstdDecoders[max]
+	if d == nil {
+		// the options are valid, so NewReader never fails
+		d, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(max)))
+		zstdDecoders[max] = d
+	}
+	return d
+}
+
+// formatCompression returns the compression recorded in the data of the
+// crc record at the head of a WAL file, which is the one the entries
+// appended to the file are compressed with, if any.
+func formatCompression(d []byte) Compression {
+	if len(d) < 4 {
+		return CompressionNone
+	}
+	return Compression(d[3])
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/github.com/klauspost/compress/snappy"
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestCompressionFlate(t *testing.T)  { testCompression(t, CompressionFlate) }
+func TestCompressionSnappy(t *testing.T) { testCompression(t, CompressionSnappy) }
+func TestCompressionZstd(t *testing.T)   { testCompression(t, CompressionZstd) }
+func TestCompressionGzip(t *testing.T)   { testCompression(t, CompressionGzip) }
+
+func testCompression(t *testing.T, c Compression) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	data := bytes.Repeat([]byte("compressible"), 100)
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1, Data: data}}
+	if err = w.Save(raftpb.HardState{}, ents); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// the entries appended after reopening are compressed, and are read
+	// back together with the uncompressed ones
+	if w, err = Open(p, walpb.Snapshot{}, WithCompression(c)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	before := w.BytesWritten()
+	es := []raftpb.Entry{{Index: 2, Term: 1, Data: data}, {Index: 3, Term: 1, Data: []byte{3}}}
+	if err = w.Save(raftpb.HardState{}, es); err != nil {
+		t.Fatal(err)
+	}
+	if n := w.BytesWritten() - before; n > int64(len(data)) {
+		t.Errorf("bytes written = %d, want less than %d", n, len(data))
+	}
+	ents = append(ents, es...)
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	metadata, _, entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "metadata")
+	}
+	if !reflect.DeepEqual(entries, ents) {
+		t.Errorf("ents = %+v, want %+v", entries, ents)
+	}
+}
+
+func TestCompressionRecorded(t *testing.T) {
+	for _, c := range []Compression{CompressionNone, CompressionZstd} {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(p)
+
+		w, err := Create(p, []byte("metadata"), WithCompression(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+
+		names, err := fileutil.ReadDir(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			d, err := openDecoder(osStore{}, p, []string{name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rec walpb.Record
+			err = d.decode(&rec)
+			d.close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g := formatCompression(rec.Data); rec.Type != crcType || g != c {
+				t.Errorf("%s: compression = %d, want %d", name, g, c)
+			}
+		}
+	}
+}
+
+func TestCreateWithUnsupportedCompression(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	if _, err = Create(p, nil, WithCompression(Compression(100))); err != ErrUnsupportedFormat {
+		t.Errorf("err = %v, want %v", err, ErrUnsupportedFormat)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	data := bytes.Repeat([]byte("compressible"), 100)
+	cb, ok := newCompressor(CompressionFlate).compress(data)
+	if !ok {
+		t.Fatalf("compressed = false, want true")
+	}
+	if _, ok = newCompressor(CompressionFlate).compress([]byte{1}); ok {
+		t.Errorf("compressed = true, want false for incompressible data")
+	}
+	sb, ok := newCompressor(CompressionSnappy).compress(data)
+	if !ok {
+		t.Fatalf("compressed = false, want true")
+	}
+	zb, ok := newCompressor(CompressionZstd).compress(data)
+	if !ok {
+		t.Fatalf("compressed = false, want true")
+	}
+	gb, ok := newCompressor(CompressionGzip).compress(data)
+	if !ok {
+		t.Fatalf("compressed = false, want true")
+	}
+
+	tests := []struct {
+		data  []byte
+		wdata []byte
+		werr  error
+	}{
+		{cb, data, nil},
+		{sb, data, nil},
+		{zb, data, nil},
+		{gb, data, nil},
+		{append([]byte{byte(CompressionSnappy)}, cb[1:]...), nil, snappy.ErrCorrupt},
+		{append([]byte{byte(CompressionGzip)}, cb[1:]...), nil, gzip.ErrHeader},
+		{append([]byte{100}, cb[1:]...), nil, ErrUnsupportedFormat},
+		{append([]byte{byte(CompressionNone)}, cb[1:]...), nil, ErrUnsupportedFormat},
+	}
+	for i, tt := range tests {
+		b, err := decompress(tt.data, MaxRecordBytes)
+		if !reflect.DeepEqual(b, tt.wdata) {
+			t.Errorf("#%d: data = %v, want %v", i, b, tt.wdata)
+		}
+		if err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+	}
+
+	for _, b := range [][]byte{cb, sb, zb, gb} {
+		if _, err := decompress(b, 100); err != ErrRecordTooLarge {
+			t.Errorf("err = %v, want %v", err, ErrRecordTooLarge)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/pkg/pbutil"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// documentedErrors are the errors, possibly wrapped, that opening and
+// reading a corrupted WAL may return.
+var documentedErrors = []error{
+	ErrDecode,
+	ErrCRCMismatch,
+	ErrRecordTooLarge,
+	ErrUnsupportedFormat,
+	ErrChecksumConflict,
+	ErrSnapshotNotFound,
+	ErrSnapshotMismatch,
+	ErrMetadataConflict,
+	ErrEntryGap,
+	ErrUnknownRecordType,
+	ErrKeyRequired,
+	ErrFileNotFound,
+	io.ErrUnexpectedEOF,
+}
+
+func isDocumentedError(err error) bool {
+	for _, derr := range documentedErrors {
+		if errors.Is(err, derr) {
+			return true
+		}
+	}
+	return false
+}
+
+// corruption is a corrupted copy of a WAL directory.
+type corruption struct {
+	desc string
+	// files are the contents of the WAL files by name
+	files map[string][]byte
+}
+
+// corruptions returns corrupted copies of the WAL files in the given
+// directory: every bit flip of every byte, the truncations of the last
+// record at every offset, every record duplicated, and the files swapped.
+func corruptions(t *testing.T, dir string) []corruption {
+	names := readNames(t, dir)
+	files := make(map[string][]byte)
+	for _, name := range names {
+		b, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[name] = b
+	}
+	with := func(name string, b []byte) map[string][]byte {
+		m := make(map[string][]byte)
+		for n, fb := range files {
+			m[n] = fb
+		}
+		m[name] = b
+		return m
+	}
+
+	var cs []corruption
+	for _, name := range names {
+		for off := range files[name] {
+			b := append([]byte{}, files[name]...)
+			b[off] ^= 1 << uint(off%8)
+			cs = append(cs, corruption{fmt.Sprintf("flip %s at %d", name, off), with(name, b)})
+		}
+		offs := recordOffsets(t, files[name])
+		for i, off := range offs {
+			end := int64(len(files[name]))
+			if i+1 < len(offs) {
+				end = offs[i+1]
+			}
+			b := append([]byte{}, files[name][:end]...)
+			b = append(b, files[name][off:]...)
+			cs = append(cs, corruption{fmt.Sprintf("duplicate %s at %d", name, off), with(name, b)})
+		}
+	}
+	last := names[len(names)-1]
+	offs := recordOffsets(t, files[last])
+	for off := offs[len(offs)-1]; off < int64(len(files[last])); off++ {
+		cs = append(cs, corruption{fmt.Sprintf("truncate %s at %d", last, off), with(last, files[last][:off])})
+	}
+	if len(names) > 1 {
+		m := with(names[0], files[names[1]])
+		m[names[1]] = files[names[0]]
+		cs = append(cs, corruption{"swap the first two files", m})
+	}
+	return cs
+}
+
+// recordOffsets returns the offsets of the records in the given content of
+// a WAL file.
+func recordOffsets(t *testing.T, b []byte) []int64 {
+	d := newDecoder(ioutil.NopCloser(bytes.NewReader(b)))
+	var offs []int64
+	rec := &walpb.Record{}
+	for {
+		err := d.decode(rec)
+		if err == io.EOF {
+			return offs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Type == crcType {
+			d.updateCRC(recordCrc(rec))
+		}
+		_, off := d.lastPosition()
+		offs = append(offs, off)
+	}
+}
+
+func readNames(t *testing.T, dir string) []string {
+	names, err := fileutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return checkWalNames(names)
+}
+
+// readCorrupted opens and reads the WAL in the given directory, and fails
+// the test if it panics or returns an undocumented error.
+func readCorrupted(t *testing.T, desc, dir string) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("%s: panic: %v", desc, r)
+		}
+	}()
+	w, err := Open(dir, walpb.Snapshot{})
+	if err == nil {
+		_, _, _, err = w.ReadAll()
+		w.Close()
+	}
+	if err != nil && !isDocumentedError(err) {
+		t.Errorf("%s: err = %v, want a documented error", desc, err)
+	}
+}
+
+// TestUnmarshalMalformed tests that the lengths which make the generated
+// code slice out of range are rejected.
+func TestUnmarshalMalformed(t *testing.T) {
+	// a length of 2^63, which overflows to a negative int
+	overflow := []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}
+	tests := []struct {
+		data []byte
+		werr error
+	}{
+		// the data of a record
+		{append([]byte{0x1a}, overflow...), io.ErrUnexpectedEOF},
+		// an unknown field skipped by the generated code
+		{append([]byte{0x7a}, overflow...), io.ErrUnexpectedEOF},
+		// a tag encoded in two bytes, which is skipped as one
+		{[]byte{0xfa, 0x00, 0x0a}, errMalformedProto},
+		// a group
+		{[]byte{0x7b, 0x7c}, errMalformedProto},
+		// a varint longer than 64 bits
+		{append([]byte{0x20, 0x80}, overflow...), errMalformedProto},
+		{[]byte{0x1a, 0x05, 0x00}, io.ErrUnexpectedEOF},
+		{[]byte{0x1a}, io.ErrUnexpectedEOF},
+		{[]byte{0x20, 0x80}, io.ErrUnexpectedEOF},
+		{[]byte{0x08, 0x02, 0x1a, 0x01, 0x00}, nil},
+	}
+	for i, tt := range tests {
+		var rec walpb.Record
+		if err := unmarshal(&rec, tt.data); err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+	}
+}
+
+func TestReadAllCorrupted(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+	src := path.Join(p, "src")
+	w, err := Create(src, []byte("metadata"), WithPreallocateBytes(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 6; i++ {
+		if i == 4 {
+			if err = w.Cut(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		es := []raftpb.Entry{{Index: uint64(i), Term: 1, Data: []byte("data")}}
+		if err = w.Save(raftpb.HardState{Term: 1, Vote: 1, Commit: uint64(i)}, es); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.SaveSnapshot(walpb.Snapshot{Index: 2, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	dir := path.Join(p, "dir")
+	for _, c := range corruptions(t, src) {
+		if err = os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Mkdir(dir, privateDirMode); err != nil {
+			t.Fatal(err)
+		}
+		for name, b := range c.files {
+			if err = ioutil.WriteFile(path.Join(dir, name), b, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		readCorrupted(t, c.desc, dir)
+	}
+}
+
+// FuzzReadAll reads arbitrary bytes as the content of a WAL file. Reading
+// must never panic, and must fail with a documented error. The seeds are a
+// valid WAL file and the inputs that have crashed the decoder before.
+func FuzzReadAll(f *testing.F) {
+	var buf bytes.Buffer
+	e := newEncoder(&buf, 0, ChecksumCRC32C)
+	recs := []*walpb.Record{
+		{Type: crcType, Data: formatData(ChecksumCRC32C, false)},
+		{Type: metadataType, Data: []byte("metadata")},
+		{Type: snapshotType, Data: pbutil.MustMarshal(&walpb.Snapshot{})},
+		{Type: stateType, Data: pbutil.MustMarshal(&raftpb.HardState{Term: 1, Vote: 1, Commit: 1})},
+		{Type: entryType, Data: pbutil.MustMarshal(&raftpb.Entry{Index: 1, Term: 1, Data: []byte("data")})},
+	}
+	for _, rec := range recs {
+		if err := e.encode(rec); err != nil {
+			f.Fatal(err)
+		}
+	}
+	e.flush()
+	f.Add(buf.Bytes())
+	for _, b := range crashers {
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		w, err := OpenReader(bytes.NewReader(data), walpb.Snapshot{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err = w.ReadAll(); err != nil && !isDocumentedError(err) {
+			t.Errorf("err = %v, want a documented error", err)
+		}
+	})
+}
+
+// crashers are inputs that have crashed the decoder.
+var crashers = [][]byte{
+	// a varint length that overflows in walpb.Record
+	[]byte("\x12\x00\x00\x00\x00\x00\x00\x822\xb0\x8c\x86\x86\x86\x86\x86\xe1\xe11000000000"),
+}
@@ -16,73 +16,488 @@ package wal
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
-	"hash"
+	"errors"
 	"io"
+	"io/ioutil"
 
-	"github.com/coreos/etcd/pkg/crc"
-	"github.com/coreos/etcd/pkg/pbutil"
-	"github.com/coreos/etcd/raft/raftpb"
 	"github.com/coreos/etcd/wal/walpb"
 )
 
 type decoder struct {
-	br  *bufio.Reader
-	c   io.Closer
-	crc hash.Hash32
+	brs []*bufio.Reader
+	cs  []io.Closer
+	crc Hash
+	// checksum is the checksum of the readers being decoded
+	checksum Checksum
+	// formatKnown is set once a crc record describing the format is decoded
+	formatKnown bool
+	// padded tells that the records of the last reader decoded are padded
+	padded bool
+	// names are the names of the WAL files that the readers read, if known
+	names []string
+	// aead decrypts the encrypted records. Without it, they are returned
+	// encrypted after their crc is validated.
+	aead cipher.AEAD
+	// maxBytes is the maximum size of a record
+	maxBytes int64
+
+	// i is the index of the reader being decoded
+	i int
+	// off is the offset of the next record in the reader being decoded
+	off int64
+	// lastOff is the offset of the last decoded record
+	lastOff int64
+	// records is the number of records decoded from the reader
+	records int64
+	// fsum is the checksum of the frames decoded from the last reader,
+	// from which appending to it continues
+	fsum Hash
+
+	// bufs are the contents of the readers when corrupted records are
+	// skipped, and bases are the offsets where the contents start
+	bufs  [][]byte
+	bases []int64
+	// skipped are the corrupted ranges skipped so far
+	skipped []CorruptRange
+	// resynced is set after skipping a corrupted range, until the crc
+	// is chained again
+	resynced bool
 }
 
-func newDecoder(rc io.ReadCloser) *decoder {
+// newDecoder returns a decoder that decodes the records in the given
+// readers one after another. Each reader is the content of a WAL file,
+// and a record never spans two readers.
+func newDecoder(rcs ...io.ReadCloser) *decoder {
+	brs := make([]*bufio.Reader, len(rcs))
+	cs := make([]io.Closer, len(rcs))
+	for i := range rcs {
+		brs[i] = bufio.NewReader(rcs[i])
+		cs[i] = rcs[i]
+	}
 	return &decoder{
-		br:  bufio.NewReader(rc),
-		c:   rc,
-		crc: crc.New(0, crcTable),
+		brs:      brs,
+		cs:       cs,
+		crc:      ChecksumCRC32C.newHash(0),
+		maxBytes: MaxRecordBytes,
 	}
 }
 
 func (d *decoder) decode(rec *walpb.Record) error {
+	for {
+		start := d.off
+		err := d.decodeRecord(rec)
+		if d.bufs != nil && isCorrupt(err) {
+			d.resync(start, err)
+			continue
+		}
+		// move on to the next reader when the current one is exhausted
+		if err == io.EOF && d.i+1 < len(d.brs) {
+			d.i++
+			d.off, d.records = 0, 0
+			continue
+		}
+		// the footer is checked by decodeRecord, and is not returned
+		if err == nil && rec.Type == footerType {
+			continue
+		}
+		return err
+	}
+}
+
+func (d *decoder) decodeRecord(rec *walpb.Record) error {
 	rec.Reset()
-	l, err := readInt64(d.br)
+	if len(d.brs) == 0 {
+		return io.EOF
+	}
+	br := d.brs[d.i]
+	var lb [8]byte
+	n, err := io.ReadFull(br, lb[:])
 	if err != nil {
+		// the file ends in the middle of a zero padding
+		if err == io.ErrUnexpectedEOF && isZero(lb[:n]) {
+			return d.zeros()
+		}
+		// the length itself is cut short by a torn write
+		if err == io.ErrUnexpectedEOF && d.i == len(d.brs)-1 {
+			return &TornTailError{File: d.name(d.i), Offset: d.off}
+		}
 		return err
 	}
-	data := make([]byte, l)
-	if _, err = io.ReadFull(d.br, data); err != nil {
-		return err
+	lenField := int64(binary.LittleEndian.Uint64(lb[:]))
+	l, pad, ok := decodeFrameSize(lenField)
+	if !ok && hasLengthCrc(lenField) {
+		return &DecodeError{File: d.name(d.i), Index: d.i, Offset: d.off, Err: ErrCorruptLength}
+	}
+	// check the length before allocating, since a corrupted length can
+	// be arbitrarily large.
+	if !ok || l > d.maxBytes {
+		return &RecordTooLargeError{File: d.name(d.i), Offset: d.off, Size: lenField, Max: d.maxBytes}
+	}
+	// a record is never empty, so zero length means the rest of the
+	// file is zero padding, which is left by preallocation or by the
+	// filesystem extending the file after a crash.
+	if l == 0 {
+		return d.zeros()
 	}
-	if err := rec.Unmarshal(data); err != nil {
+	data := make([]byte, l+pad)
+	if n, err = io.ReadFull(br, data); err != nil {
+		// the record is incomplete
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		// the zero padding starts in the middle of the length
+		if isZero(data[:n]) {
+			return d.zeros()
+		}
+		// the length is intact, so the last record was cut short by a
+		// torn write rather than corrupted
+		if hasLengthCrc(lenField) && d.i == len(d.brs)-1 {
+			return &TornTailError{File: d.name(d.i), Offset: d.off}
+		}
 		return err
 	}
+	if isZero(data) {
+		return d.zeros()
+	}
+	d.lastOff = d.off
+	d.off += 8 + l + pad
+	d.records++
+	if err := unmarshal(rec, data[:l]); err != nil {
+		return d.decodeError(0, err)
+	}
 	// skip crc checking if the record type is crcType
 	if rec.Type == crcType {
+		c, err := parseFormat(rec.Data)
+		if err != nil {
+			return err
+		}
+		// all the WAL files must be checksummed alike, since the crc is
+		// chained across them.
+		if d.formatKnown && c != d.checksum {
+			return ErrChecksumConflict
+		}
+		d.checksum, d.formatKnown = c, true
+		d.padded = isPaddedFormat(rec.Data)
+		d.resynced = false
+		d.sumFrame(lb[:], data)
 		return nil
 	}
+	d.sumFrame(lb[:], data)
+	if d.resynced {
+		// the crc chain is broken by the skipped range, so it restarts
+		// at the first record after it
+		d.resynced = false
+		d.crc = d.checksum.newHash(recordCrc(rec))
+		return nil
+	}
+	typ, want := rec.Type, recordCrc(rec)
 	d.crc.Write(rec.Data)
-	return rec.Validate(d.crc.Sum32())
+	if got := d.crc.Sum64(); d.checksum.validate(rec, got) != nil {
+		return d.crcError(typ, want, got)
+	}
+	if rec.Type == footerType {
+		return d.checkFooter(rec)
+	}
+	// the crc covers the encrypted and compressed data, so it is
+	// decrypted and decompressed only after being validated
+	if rec.Type == encryptedType && d.aead != nil {
+		if err := openRecord(d.aead, rec); err != nil {
+			return d.decodeError(typ, err)
+		}
+	}
+	if rec.Type == compressedEntryType {
+		data, err := decompress(rec.Data, d.maxBytes)
+		if err != nil {
+			return d.decodeError(typ, err)
+		}
+		rec.Type, rec.Data = entryType, data
+	}
+	return nil
 }
 
-func (d *decoder) updateCRC(prevCrc uint32) {
-	d.crc = crc.New(prevCrc, crcTable)
+// sumFrame adds the frame decoded from the last reader, made of the given
+// length field and data, to the checksum of its frames. The first frame of
+// a file is its crc record, which tells the checksum of the file.
+func (d *decoder) sumFrame(lb, data []byte) {
+	if d.i != len(d.brs)-1 {
+		return
+	}
+	if d.records == 1 {
+		d.fsum = d.checksum.newHash(0)
+	}
+	d.fsum.Write(lb)
+	d.fsum.Write(data)
 }
 
-func (d *decoder) lastCRC() uint32 {
-	return d.crc.Sum32()
+// frameSum returns the number and the checksum of the frames decoded from
+// the last reader.
+func (d *decoder) frameSum() frameSum {
+	if d.fsum == nil {
+		return frameSum{}
+	}
+	return frameSum{n: d.records, sum: d.fsum.Sum64()}
 }
 
-func (d *decoder) close() error {
-	return d.c.Close()
+// zeros returns the error for zeros read where a record is expected. They
+// are the padding left by preallocation or by the filesystem extending the
+// file after a crash at the tail of the last file, which ends the WAL. The
+// files before are truncated when cut, so zeros in them are a corruption,
+// and the records after them would be lost.
+func (d *decoder) zeros() error {
+	if d.i == len(d.brs)-1 {
+		return io.EOF
+	}
+	return &DecodeError{File: d.name(d.i), Index: d.i, Offset: d.off, Err: ErrZeroRecord}
+}
+
+// skipCorrupt makes the decoder skip corrupted records instead of
+// returning an error. The rest of the readers is read into memory, so
+// decoding can resume at the next valid record after a corrupted one.
+func (d *decoder) skipCorrupt() error {
+	d.bufs = make([][]byte, len(d.brs))
+	d.bases = make([]int64, len(d.brs))
+	for i := d.i; i < len(d.brs); i++ {
+		b, err := ioutil.ReadAll(d.brs[i])
+		if err != nil {
+			return err
+		}
+		d.bufs[i] = b
+		d.brs[i] = bufio.NewReader(bytes.NewReader(b))
+	}
+	d.bases[d.i] = d.off
+	return nil
+}
+
+// resync skips the corrupted bytes of the reader being decoded from the
+// given offset up to the next valid record, or to the end of the reader
+// if there is none.
+func (d *decoder) resync(start int64, cause error) {
+	buf, base := d.bufs[d.i], d.bases[d.i]
+	end := base + int64(len(buf))
+	next := end
+	for o := start + 1; o < end; o++ {
+		if isValidRecord(buf[o-base:], d.maxBytes) {
+			next = o
+			break
+		}
+	}
+	d.skipped = append(d.skipped, CorruptRange{File: d.name(d.i), Start: start, End: next, Err: cause})
+	d.brs[d.i] = bufio.NewReader(bytes.NewReader(buf[next-base:]))
+	if next == end {
+		// leave the offset at the start of the range, so the corrupted
+		// tail is truncated before appending
+		d.off = start
+		return
+	}
+	d.off = next
+	d.resynced = true
 }
 
-func mustUnmarshalEntry(d []byte) raftpb.Entry {
-	var e raftpb.Entry
-	pbutil.MustUnmarshal(&e, d)
-	return e
+// isValidRecord reports whether b starts with a record that can be
+// decoded, regardless of its crc, and is not larger than max.
+func isValidRecord(b []byte, max int64) bool {
+	if len(b) < 8 {
+		return false
+	}
+	l, pad, ok := decodeFrameSize(int64(binary.LittleEndian.Uint64(b)))
+	if !ok || l == 0 || l > max || l+pad > int64(len(b)-8) {
+		return false
+	}
+	var rec walpb.Record
+	if err := unmarshal(&rec, b[8:8+l]); err != nil {
+		return false
+	}
+	return rec.Type >= metadataType && rec.Type <= appDataType
+}
+
+// checkFooter checks the footer record, whose crc is validated, against
+// the records decoded from the reader before it.
+func (d *decoder) checkFooter(rec *walpb.Record) error {
+	ft, err := parseFooter(rec.Data)
+	if err != nil {
+		return d.decodeError(footerType, err)
+	}
+	// the records skipped are not counted
+	if d.bufs == nil && ft.records != d.records-1 {
+		return d.decodeError(footerType, ErrFooterMismatch)
+	}
+	return nil
 }
 
-func mustUnmarshalState(d []byte) raftpb.HardState {
-	var s raftpb.HardState
-	pbutil.MustUnmarshal(&s, d)
-	return s
+// isCorrupt reports whether err is caused by corrupted data that can be
+// skipped, rather than by the end of the data or an unsupported format.
+func isCorrupt(err error) bool {
+	switch err {
+	case nil, io.EOF, ErrUnsupportedFormat, ErrChecksumConflict:
+		return false
+	}
+	return true
+}
+
+// skipTo decodes the records of the first reader up to the given offset,
+// so that decoding continues from the record at the offset with the crc
+// chained correctly. The offset must be right after a record.
+func (d *decoder) skipTo(off int64) error {
+	rec := &walpb.Record{}
+	for d.off < off {
+		if err := d.decodeRecord(rec); err != nil {
+			if err == io.EOF {
+				return ErrInvalidPosition
+			}
+			return err
+		}
+		if rec.Type == crcType {
+			d.updateCRC(recordCrc(rec))
+		}
+	}
+	if d.off != off {
+		return ErrInvalidPosition
+	}
+	return nil
+}
+
+// endOffset returns the offset in the reader being decoded right after
+// the last decoded record, which is where the valid data of the reader
+// ends once the decoder returns io.EOF.
+func (d *decoder) endOffset() int64 {
+	return d.off
+}
+
+// name returns the name of the i-th WAL file being decoded, or an empty
+// string if it is unknown.
+func (d *decoder) name(i int) string {
+	if i < len(d.names) {
+		return d.names[i]
+	}
+	return ""
+}
+
+// seq returns the sequence of the i-th WAL file being decoded, or 0 if it
+// is unknown.
+func (d *decoder) seq(i int) uint64 {
+	seq, _, err := parseWalName(d.name(i))
+	if err != nil {
+		return 0
+	}
+	return seq
+}
+
+// lastPosition returns the index of the reader and the offset in it
+// where the last decoded record starts.
+func (d *decoder) lastPosition() (int, int64) {
+	return d.i, d.lastOff
+}
+
+func (d *decoder) updateCRC(prevCrc uint64) {
+	d.crc = d.checksum.newHash(prevCrc)
+}
+
+func (d *decoder) lastCRC() uint64 {
+	return d.crc.Sum64()
+}
+
+// decodeError returns err annotated with the location of the last decoded
+// record, which is of the given type.
+func (d *decoder) decodeError(typ int64, err error) error {
+	return &DecodeError{File: d.name(d.i), Index: d.i, Offset: d.lastOff, Type: typ, Err: err}
+}
+
+// crcError returns a DecodeError for the last decoded record, whose stored
+// checksum want does not match the computed one got.
+func (d *decoder) crcError(typ int64, want, got uint64) error {
+	return d.decodeError(typ, &CRCError{Seq: d.seq(d.i), Offset: d.lastOff, Expected: want, Actual: got})
+}
+
+// errMalformedProto is returned for the data of a record that is not a
+// well-formed protobuf message.
+var errMalformedProto = errors.New("wal: malformed protobuf")
+
+// unmarshal unmarshals data into m, which is one of the messages stored in
+// the WAL. The generated code does not check the lengths it reads against
+// overflows, so they are checked before. None of the messages stored in
+// the WAL nests another message, so only the top level is checked.
+func unmarshal(m interface {
+	Unmarshal(data []byte) error
+}, data []byte) error {
+	if err := checkFields(data); err != nil {
+		return err
+	}
+	return m.Unmarshal(data)
+}
+
+// checkFields checks that data is a sequence of protobuf fields that all
+// end within it, or returns io.ErrUnexpectedEOF like the generated code.
+// The tags must be encoded in as few bytes as possible, since the generated
+// code relies on it to skip the unknown fields. Groups are never written to
+// the WAL, so they are rejected.
+func checkFields(data []byte) error {
+	for i := 0; i < len(data); {
+		tag, n := binary.Uvarint(data[i:])
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		if n < 0 || n != uvarintSize(tag) {
+			return errMalformedProto
+		}
+		i += n
+		switch tag & 0x7 {
+		case 0:
+			_, n = binary.Uvarint(data[i:])
+			i += n
+		case 1:
+			i += 8
+		case 2:
+			var l uint64
+			if l, n = binary.Uvarint(data[i:]); n > 0 && l > uint64(len(data)-i-n) {
+				return io.ErrUnexpectedEOF
+			}
+			i += n + int(l)
+		case 5:
+			i += 4
+		default:
+			return errMalformedProto
+		}
+		switch {
+		case n == 0 || i > len(data):
+			return io.ErrUnexpectedEOF
+		case n < 0:
+			return errMalformedProto
+		}
+	}
+	return nil
+}
+
+// uvarintSize returns the number of bytes of the shortest encoding of v as
+// a varint.
+func uvarintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+func (d *decoder) close() error {
+	var err error
+	for _, c := range d.cs {
+		if cerr := c.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
 }
 
 func readInt64(r io.Reader) (int64, error) {
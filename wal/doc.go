@@ -25,6 +25,29 @@ to it with the Save method:
 	...
 	err := w.Save(s, ents)
 
+The records are checksummed with CRC-32C by default. Another checksum, such as
+the 64-bit ChecksumCRC64ISO, can be chosen at creation time, and it is recorded
+in each WAL file. All the files of a WAL must use the same checksum:
+
+	w, err := wal.Create("/var/lib/etcd", metadata, wal.WithChecksum(wal.ChecksumCRC64ISO))
+
+With WithPadding, each record is padded to an 8-byte boundary and the length
+written before it carries a checksum of its own, so a last record cut short by
+a crash is told apart from a corrupted one: ReadAll returns a *TornTailError for
+the former, which is repaired by truncating the file at its offset. The option
+is recorded in each WAL file. Without it, the records are written as by the
+previous releases, which can read the WAL.
+
+The entries can be compressed with WithCompression, with snappy, flate, gzip
+or zstd. The checksums cover the compressed data, and compressed and
+uncompressed entries can be mixed. The compression is recorded at the head of
+each WAL file written with it, and compressed entries have their own record
+type, so older versions fail to read them instead of misreading them.
+
+The records can be encrypted with AES-GCM under a key given by
+WithEncryptionKey. The key must be given again to read the WAL, while the
+checksums cover the encrypted data and can be checked without it.
+
 After saving an raft snapshot to disk, SaveSnapshot method should be called to
 record it. So WAL can match with the saved snapshot when restarting.
 
@@ -49,13 +72,24 @@ Cut has been called on this WAL then the sequence will increment from 0x0 to
 Cut issues 0x10 entries with incremental index later then the file will be called:
 0000000000000002-0000000000000031.wal.
 
+Cut ends the file it finalizes with a footer, which records the number of
+records in the file and a checksum of its bytes. Verify checks such files
+against their footer without decoding their records. Create and Cut fsync
+the directory after creating a file, so the file is not lost on a power
+failure once they return.
+
+The metadata record starts with a header giving the version of the WAL format.
+Open and ReadAll fail with ErrUnsupportedVersion on a WAL of a newer version,
+and a WAL written before the header was added is of version 0.
+
 At a later time a WAL can be opened at a particular snapshot. If there is no
 snapshot, an empty snapshot should be passed in.
 
 	w, err := wal.Open("/var/lib/etcd", walpb.Snapshot{Index: 10, Term: 2})
 	...
 
-The snapshot must have been written to the WAL.
+The snapshot must have been written to the WAL. ValidSnapshotEntries lists
+the snapshots written to the WAL that are covered by the saved commit index.
 
 Additional items cannot be Saved to this WAL until all of the items from the given
 snapshot to the end of the WAL are read first:
@@ -0,0 +1,140 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// DumpRecord describes a record of the WAL, as written by Dump.
+type DumpRecord struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	Type   string `json:"type"`
+	// PrevCrc is the crc chained up to the record, and Crc the crc
+	// chained up to and including it.
+	PrevCrc uint64 `json:"prevCrc"`
+	Crc     uint64 `json:"crc"`
+	// Timestamp is the time the record is written at, if recorded with
+	// WithTimestamps. It follows the clock of the writer, so it may be
+	// skewed.
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+
+	Metadata []byte            `json:"metadata,omitempty"`
+	Entry    *DumpEntry        `json:"entry,omitempty"`
+	State    *raftpb.HardState `json:"state,omitempty"`
+	Snapshot *walpb.Snapshot   `json:"snapshot,omitempty"`
+	AppData  []byte            `json:"appData,omitempty"`
+}
+
+// DumpEntry describes the entry of an entry record.
+type DumpEntry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Type  string `json:"type"`
+	// Data is the data of the entry, encoded in base64, or decoded by the
+	// function given by WithEntryDecoder.
+	Data interface{} `json:"data"`
+}
+
+var recordTypeNames = map[int64]string{
+	metadataType:  "metadata",
+	entryType:     "entry",
+	stateType:     "state",
+	crcType:       "crc",
+	snapshotType:  "snapshot",
+	encryptedType: "encrypted",
+	appDataType:   "appdata",
+}
+
+// Dump writes a JSON object describing each record of the WAL in the
+// given directory from the file that covers the given snapshot on, as
+// a DumpRecord per line. It neither locks nor writes the WAL files, so it
+// works on a WAL in use or on a read-only copy. Only the encryption key,
+// the entry decoder and the store are used among the options.
+func Dump(dirpath string, snap walpb.Snapshot, w io.Writer, opts ...Option) error {
+	decodeData := newOptions(opts).entryDecoder
+	r, err := OpenReadOnly(dirpath, snap, opts...)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	d := r.decoder
+	enc := json.NewEncoder(w)
+	rec := &walpb.Record{}
+	for {
+		prevCrc := d.lastCRC()
+		if err = d.decode(rec); err != nil {
+			break
+		}
+		i, off := d.lastPosition()
+		dr := DumpRecord{File: d.name(i), Offset: off, Type: recordTypeNames[rec.Type], PrevCrc: prevCrc}
+		// a zero timestamp is not recorded
+		if rec.Timestamp != nil && *rec.Timestamp != 0 {
+			ts := time.Unix(0, *rec.Timestamp).UTC()
+			dr.Timestamp = &ts
+		}
+		switch rec.Type {
+		case metadataType:
+			if dr.Metadata, _, err = decodeMetadata(rec.Data); err != nil {
+				return d.decodeError(rec.Type, err)
+			}
+		case entryType:
+			var e raftpb.Entry
+			if err = unmarshal(&e, rec.Data); err != nil {
+				return d.decodeError(rec.Type, err)
+			}
+			de := &DumpEntry{Index: e.Index, Term: e.Term, Type: e.Type.String(), Data: e.Data}
+			if decodeData != nil {
+				// fall back to base64 if the data cannot be decoded
+				if v, err := decodeData(e); err == nil {
+					de.Data = v
+				}
+			}
+			dr.Entry = de
+		case stateType:
+			dr.State = &raftpb.HardState{}
+			if err = unmarshal(dr.State, rec.Data); err != nil {
+				return d.decodeError(rec.Type, err)
+			}
+		case crcType:
+			d.updateCRC(recordCrc(rec))
+		case snapshotType:
+			dr.Snapshot = &walpb.Snapshot{}
+			if err = unmarshal(dr.Snapshot, rec.Data); err != nil {
+				return d.decodeError(rec.Type, err)
+			}
+		case appDataType:
+			dr.AppData = rec.Data
+		case encryptedType:
+			return ErrKeyRequired
+		default:
+			return d.decodeError(rec.Type, ErrUnknownRecordType)
+		}
+		dr.Crc = d.lastCRC()
+		if err = enc.Encode(&dr); err != nil {
+			return err
+		}
+	}
+	if err != io.EOF {
+		return err
+	}
+	return nil
+}
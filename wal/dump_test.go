@@ -0,0 +1,183 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/pkg/pbutil"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestDump(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 2}
+	ents := []raftpb.Entry{
+		{Index: 1, Term: 1, Data: []byte("data")},
+		{Index: 2, Term: 1, Type: raftpb.EntryConfChange, Data: pbutil.MustMarshal(&cc)},
+	}
+	st := raftpb.HardState{Term: 1, Vote: 1, Commit: 2}
+	if err = w.Save(st, ents); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	dump := func(opts ...Option) []DumpRecord {
+		var buf bytes.Buffer
+		if err := Dump(p, walpb.Snapshot{}, &buf, opts...); err != nil {
+			t.Fatal(err)
+		}
+		var drs []DumpRecord
+		s := bufio.NewScanner(&buf)
+		for s.Scan() {
+			var dr DumpRecord
+			if err := json.Unmarshal(s.Bytes(), &dr); err != nil {
+				t.Fatal(err)
+			}
+			drs = append(drs, dr)
+		}
+		return drs
+	}
+
+	drs := dump()
+	wtypes := []string{"crc", "metadata", "snapshot", "state", "entry", "entry"}
+	if len(drs) != len(wtypes) {
+		t.Fatalf("len(records) = %d, want %d", len(drs), len(wtypes))
+	}
+	for i, dr := range drs {
+		if dr.Type != wtypes[i] {
+			t.Errorf("#%d: type = %s, want %s", i, dr.Type, wtypes[i])
+		}
+		if dr.File != walName(0, 0) {
+			t.Errorf("#%d: file = %s, want %s", i, dr.File, walName(0, 0))
+		}
+		if i > 0 && (dr.PrevCrc != drs[i-1].Crc || dr.Offset <= drs[i-1].Offset) {
+			t.Errorf("#%d: record does not follow the previous one", i)
+		}
+		if dr.Timestamp != nil {
+			t.Errorf("#%d: timestamp = %v, want nil", i, dr.Timestamp)
+		}
+	}
+	if !reflect.DeepEqual(drs[1].Metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", drs[1].Metadata, "metadata")
+	}
+	if !reflect.DeepEqual(*drs[3].State, st) {
+		t.Errorf("state = %+v, want %+v", *drs[3].State, st)
+	}
+	we := DumpEntry{Index: 1, Term: 1, Type: "EntryNormal", Data: "ZGF0YQ=="}
+	if !reflect.DeepEqual(*drs[4].Entry, we) {
+		t.Errorf("entry = %+v, want %+v", *drs[4].Entry, we)
+	}
+
+	// the conf changes are decoded, and the other entries stay in base64
+	drs = dump(WithEntryDecoder(func(e raftpb.Entry) (interface{}, error) {
+		if e.Type != raftpb.EntryConfChange {
+			return nil, errors.New("not a conf change")
+		}
+		var cc raftpb.ConfChange
+		err := cc.Unmarshal(e.Data)
+		return cc, err
+	}))
+	if g := drs[4].Entry.Data; g != "ZGF0YQ==" {
+		t.Errorf("data = %v, want %v", g, "ZGF0YQ==")
+	}
+	data, ok := drs[5].Entry.Data.(map[string]interface{})
+	if !ok || data["NodeID"] != float64(2) {
+		t.Errorf("data = %v, want the conf change adding node 2", drs[5].Entry.Data)
+	}
+}
+
+func TestDumpTimestamps(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	start := time.Now()
+	w, err := Create(p, []byte("metadata"), WithTimestamps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1, Data: []byte("data")}}
+	if err = w.Save(raftpb.HardState{Term: 1, Commit: 1}, ents); err != nil {
+		t.Fatal(err)
+	}
+	end := time.Now()
+	// a clock reset to the epoch records a zero timestamp
+	w.encoder.now = func() time.Time { return time.Unix(0, 0) }
+	es := []raftpb.Entry{{Index: 2, Term: 1, Data: []byte("data")}}
+	if err = w.Save(raftpb.HardState{}, es); err != nil {
+		t.Fatal(err)
+	}
+	ents = append(ents, es...)
+	w.Close()
+
+	var buf bytes.Buffer
+	if err = Dump(p, walpb.Snapshot{}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var drs []DumpRecord
+	s := bufio.NewScanner(&buf)
+	for s.Scan() {
+		var dr DumpRecord
+		if err = json.Unmarshal(s.Bytes(), &dr); err != nil {
+			t.Fatal(err)
+		}
+		drs = append(drs, dr)
+	}
+	if len(drs) != 6 {
+		t.Fatalf("len(records) = %d, want 6", len(drs))
+	}
+	for i, dr := range drs[:5] {
+		if dr.Timestamp == nil || dr.Timestamp.Before(start) || dr.Timestamp.After(end) {
+			t.Errorf("#%d: timestamp = %v, want between %v and %v", i, dr.Timestamp, start, end)
+		}
+	}
+	if ts := drs[5].Timestamp; ts != nil {
+		t.Errorf("timestamp = %v, want nil", ts)
+	}
+
+	// ReadAll ignores the timestamps
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, ents) {
+		t.Errorf("ents = %+v, want %+v", entries, ents)
+	}
+}
@@ -17,39 +17,214 @@ package wal
 import (
 	"bufio"
 	"encoding/binary"
-	"hash"
+	"hash/crc32"
 	"io"
+	"time"
 
-	"github.com/coreos/etcd/pkg/crc"
 	"github.com/coreos/etcd/wal/walpb"
 )
 
+// maxRetainedBufBytes is the largest buffer kept by an encoder for framing
+// the next records, so a single large record does not pin its memory.
+const maxRetainedBufBytes = 1024 * 1024
+
 type encoder struct {
-	bw  *bufio.Writer
-	crc hash.Hash32
+	bw       *bufio.Writer
+	crc      Hash
+	checksum Checksum
+	// buf is reused to frame the records, so encoding does not allocate.
+	buf []byte
+	// now returns the time recorded in each record, if set. ts holds the
+	// timestamp of the record being written.
+	now func() time.Time
+	ts  int64
+	// frames and fsum are the number and the checksum of the frames
+	// written to the file, which the footer records when it is cut
+	frames int64
+	fsum   Hash
+	// padded tells to pad the records and checksum their lengths
+	padded bool
+	// maxBytes is the maximum size of a record
+	maxBytes int64
+}
+
+// frameSum is the number and the checksum of the frames of a WAL file up
+// to some offset, from which the footer of the file is computed.
+type frameSum struct {
+	n   int64
+	sum uint64
 }
 
-func newEncoder(w io.Writer, prevCrc uint32) *encoder {
+func newEncoder(w io.Writer, prevCrc uint64, c Checksum) *encoder {
+	return newEncoderSize(w, prevCrc, c, 0)
+}
+
+// newEncoderSize returns an encoder that buffers up to size bytes before
+// writing to w, or the default of bufio if size is not positive.
+func newEncoderSize(w io.Writer, prevCrc uint64, c Checksum, size int) *encoder {
 	return &encoder{
-		bw:  bufio.NewWriter(w),
-		crc: crc.New(prevCrc, crcTable),
+		bw:       bufio.NewWriterSize(w, size),
+		crc:      c.newHash(prevCrc),
+		checksum: c,
+		fsum:     c.newHash(0),
+		maxBytes: MaxRecordBytes,
 	}
 }
 
+// frameSum returns the number and the checksum of the frames written.
+func (e *encoder) frameSum() frameSum {
+	return frameSum{n: e.frames, sum: e.fsum.Sum64()}
+}
+
+// resumeFrames makes the frames written continue the given ones, when
+// appending to a file that already holds them.
+func (e *encoder) resumeFrames(fs frameSum) {
+	e.frames, e.fsum = fs.n, e.checksum.newHash(fs.sum)
+}
+
 func (e *encoder) encode(rec *walpb.Record) error {
-	e.crc.Write(rec.Data)
-	rec.Crc = e.crc.Sum32()
-	data, err := rec.Marshal()
-	if err != nil {
-		return err
+	// the data of crc record describes the format, and is not chained
+	// into the crc.
+	if rec.Type != crcType {
+		e.crc.Write(rec.Data)
 	}
-	if err := writeInt64(e.bw, int64(len(data))); err != nil {
+	return e.write(rec, e.crc.Sum64())
+}
+
+// encodeChained encodes the record, whose crc chained to the previous
+// records is already computed.
+func (e *encoder) encodeChained(rec *walpb.Record, sum uint64) error {
+	e.crc = e.checksum.newHash(sum)
+	return e.write(rec, sum)
+}
+
+func (e *encoder) write(rec *walpb.Record, sum uint64) error {
+	e.checksum.setCrc(rec, sum)
+	if e.now != nil {
+		e.ts = e.now().UnixNano()
+		rec.Timestamp = &e.ts
+	}
+	n := rec.Size()
+	if int64(n) > e.maxBytes {
+		return ErrRecordTooLarge
+	}
+	lenField, pad := int64(n), 0
+	if e.padded {
+		lenField, pad = encodeFrameSize(n)
+	}
+	e.buf = resize(e.buf, 8+n+pad)
+	binary.LittleEndian.PutUint64(e.buf, uint64(lenField))
+	if _, err := rec.MarshalTo(e.buf[8:]); err != nil {
 		return err
 	}
-	_, err = e.bw.Write(data)
+	for i := 8 + n; i < len(e.buf); i++ {
+		e.buf[i] = 0
+	}
+	_, err := e.bw.Write(e.buf)
+	if err == nil {
+		e.fsum.Write(e.buf)
+		e.frames++
+	}
+	if cap(e.buf) > maxRetainedBufBytes {
+		e.buf = nil
+	}
 	return err
 }
 
+// resize returns b resized to n bytes, reusing its array if it is large
+// enough.
+func resize(b []byte, n int) []byte {
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
+
+// encodeFrameSize returns the length field written before a record of the
+// given size in a padded WAL file, and the number of zero bytes padding the record to a multiple
+// of 8 bytes. Padding keeps every length field 8-byte aligned, so it never
+// straddles two sectors and is never torn by a partial write. The padding
+// is stored in the top byte of the length field, whose highest bit marks a
+// padded record, so unpadded records of older WAL files read alike.
+// The length field also carries a checksum of itself, marked by the second
+// highest bit, so a corrupted length is told apart from a record cut short
+// by a torn write at the tail of the WAL.
+func encodeFrameSize(dataBytes int) (lenField int64, pad int) {
+	top := uint64(lenCrcFlag)
+	pad = (8 - dataBytes%8) % 8
+	if pad > 0 {
+		top |= uint64(0x80 | pad)
+	}
+	lf := top<<56 | uint64(dataBytes)
+	return int64(lf | lengthCrc(lf)<<lenCrcShift), pad
+}
+
+const (
+	// lenCrcFlag marks a length field that carries its checksum.
+	lenCrcFlag = 0x40
+	// the checksum of a length field is stored in its bits 40 to 55,
+	// and the size of the record in its lower bits.
+	lenCrcShift = 40
+	lenCrcMask  = 0xffff << lenCrcShift
+	lenSizeMask = 1<<lenCrcShift - 1
+)
+
+// lengthCrc returns the checksum of the given length field, computed over
+// the field without its checksum bits.
+func lengthCrc(lenField uint64) uint64 {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], lenField&^lenCrcMask)
+	return uint64(crc32.Checksum(b[:], crcTable) & 0xffff)
+}
+
+// hasLengthCrc reports whether the length field carries its checksum.
+func hasLengthCrc(lenField int64) bool {
+	return uint64(lenField)>>56&lenCrcFlag != 0
+}
+
+// decodeFrameSize returns the size of the record and of its padding given
+// by the length field, or false if the top byte is not a valid padding or
+// the checksum of the field does not match.
+func decodeFrameSize(lenField int64) (dataBytes, pad int64, ok bool) {
+	lf := uint64(lenField)
+	top := lf >> 56
+	dataBytes = int64(lf &^ (0xff << 56))
+	if top&lenCrcFlag != 0 {
+		if lf&lenCrcMask>>lenCrcShift != lengthCrc(lf) {
+			return 0, 0, false
+		}
+		top &^= lenCrcFlag
+		dataBytes = int64(lf & lenSizeMask)
+	}
+	switch {
+	case top == 0:
+		return dataBytes, 0, true
+	case top&^0x7 == 0x80 && top&0x7 != 0:
+		return dataBytes, int64(top & 0x7), true
+	}
+	return 0, 0, false
+}
+
+// frameSize returns the number of bytes a record of the given size takes
+// in a WAL file, including its length field and padding if padded.
+func frameSize(dataBytes int, padded bool) int64 {
+	if !padded {
+		return 8 + int64(dataBytes)
+	}
+	_, pad := encodeFrameSize(dataBytes)
+	return 8 + int64(dataBytes) + int64(pad)
+}
+
+// formatPadded is the flag of the format of a WAL file telling that its
+// records are padded and their lengths checksummed.
+const formatPadded byte = 1 << 1
+
+// isPaddedFormat reports whether the data of the crc record at the head of
+// a WAL file tells that its records are padded.
+func isPaddedFormat(d []byte) bool {
+	return len(d) > 2 && d[2]&formatPadded != 0
+}
+
 func (e *encoder) flush() error {
 	return e.bw.Flush()
 }
@@ -0,0 +1,105 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+
+	"github.com/coreos/etcd/pkg/pbutil"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// EncryptionKeySize is the size in bytes of the key given to
+// WithEncryptionKey, which selects AES-256.
+const EncryptionKeySize = 32
+
+// formatEncrypted is the flag of the format of a WAL file telling that its
+// records are encrypted.
+const formatEncrypted byte = 1 << 0
+
+// newAEAD returns the AES-GCM cipher for the key, or nil if there is none.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if key == nil {
+		return nil, nil
+	}
+	if len(key) != EncryptionKeySize {
+		return nil, ErrInvalidKey
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// indirection for testing
+var randRead = rand.Read
+
+// seal returns the record encrypted into an encryptedType record, whose
+// data is a random nonce followed by the sealed type and data of the
+// record. The record is returned as is if the WAL is not encrypted.
+func (w *WAL) seal(rec *walpb.Record) (*walpb.Record, error) {
+	if w.aead == nil {
+		return rec, nil
+	}
+	return sealRecord(w.aead, rec)
+}
+
+// sealRecord encrypts the record with aead, or returns the error of
+// generating its nonce.
+func sealRecord(aead cipher.AEAD, rec *walpb.Record) (*walpb.Record, error) {
+	b := pbutil.MustMarshal(&walpb.Record{Type: rec.Type, Data: rec.Data})
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(b)+aead.Overhead())
+	if _, err := randRead(nonce); err != nil {
+		return nil, err
+	}
+	return &walpb.Record{Type: encryptedType, Data: aead.Seal(nonce, nonce, b, nil)}, nil
+}
+
+// encodeSealed appends the record, encrypted if the WAL is encrypted.
+func (w *WAL) encodeSealed(rec *walpb.Record) error {
+	rec, err := w.seal(rec)
+	if err != nil {
+		return err
+	}
+	return w.encode(rec)
+}
+
+// openRecord replaces the type and data of the encryptedType record with
+// the decrypted ones.
+func openRecord(aead cipher.AEAD, rec *walpb.Record) error {
+	n := aead.NonceSize()
+	if len(rec.Data) < n {
+		return ErrDecrypt
+	}
+	b, err := aead.Open(nil, rec.Data[:n], rec.Data[n:], nil)
+	if err != nil {
+		return ErrDecrypt
+	}
+	var inner walpb.Record
+	if err = unmarshal(&inner, b); err != nil {
+		return err
+	}
+	rec.Type, rec.Data = inner.Type, inner.Data
+	return nil
+}
+
+// isEncryptedFormat reports whether the data of the crc record at the head
+// of a WAL file tells that the records of the file are encrypted.
+func isEncryptedFormat(d []byte) bool {
+	return len(d) > 2 && d[2]&formatEncrypted != 0
+}
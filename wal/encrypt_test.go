@@ -0,0 +1,198 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestEncryption(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	key := bytes.Repeat([]byte{1}, EncryptionKeySize)
+	secret := bytes.Repeat([]byte("secret"), 100)
+	w, err := Create(p, []byte("metadata"), WithEncryptionKey(key), WithCompression(CompressionFlate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := raftpb.HardState{Term: 1, Vote: 1, Commit: 2}
+	ents := []raftpb.Entry{{Index: 1, Term: 1, Data: secret}, {Index: 2, Term: 1, Data: []byte("secret")}}
+	if err = w.Save(st, ents[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(st, ents[1:]); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	names, err := fileutil.ReadDir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		b, err := ioutil.ReadFile(path.Join(p, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(b, []byte("secret")) || bytes.Contains(b, []byte("metadata")) {
+			t.Errorf("%s contains plaintext", name)
+		}
+	}
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); err != ErrKeyRequired {
+		t.Errorf("err = %v, want %v", err, ErrKeyRequired)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}, WithEncryptionKey(bytes.Repeat([]byte{2}, EncryptionKeySize))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("err = %v, want %v", err, ErrDecrypt)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}, WithEncryptionKey(key)); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	metadata, state, entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "metadata")
+	}
+	if !reflect.DeepEqual(state, st) {
+		t.Errorf("state = %+v, want %+v", state, st)
+	}
+	if !reflect.DeepEqual(entries, ents) {
+		t.Errorf("ents = %+v, want %+v", entries, ents)
+	}
+	if li, err := LastIndex(p, WithEncryptionKey(key)); li != 2 || err != nil {
+		t.Errorf("last index = %d, %v, want %d, nil", li, err, 2)
+	}
+}
+
+func TestEncryptionCRCWithoutKey(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithEncryptionKey(make([]byte, EncryptionKeySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := w.off
+	if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 1, Term: 1, Data: []byte("data")}}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// the records are checked without being decrypted
+	d, err := openDecoder(osStore{}, p, []string{walName(0, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &walpb.Record{}
+	n := 0
+	for err = d.decode(rec); err == nil; err = d.decode(rec) {
+		if rec.Type == encryptedType {
+			n++
+		}
+	}
+	d.close()
+	if err != io.EOF {
+		t.Fatalf("err = %v, want %v", err, io.EOF)
+	}
+	// metadata, snapshot and entry
+	if n != 3 {
+		t.Errorf("encrypted records = %d, want 3", n)
+	}
+
+	corruptLastByte(t, path.Join(p, walName(0, 0)), off)
+	if d, err = openDecoder(osStore{}, p, []string{walName(0, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	defer d.close()
+	for err = d.decode(rec); err == nil; err = d.decode(rec) {
+	}
+	if !errors.Is(err, ErrCRCMismatch) {
+		t.Errorf("err = %v, want %v", err, ErrCRCMismatch)
+	}
+}
+
+func TestCreateWithInvalidKey(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	if _, err = Create(p, nil, WithEncryptionKey(make([]byte, 16))); err != ErrInvalidKey {
+		t.Errorf("err = %v, want %v", err, ErrInvalidKey)
+	}
+}
+
+func TestSaveNonceError(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	key := bytes.Repeat([]byte{1}, EncryptionKeySize)
+	w, err := Create(p, []byte("metadata"), WithEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the failure to generate a nonce is returned instead of panicking
+	errRand := errors.New("rand error")
+	randRead = func(b []byte) (int, error) { return 0, errRand }
+	defer func() { randRead = rand.Read }()
+	ents := []raftpb.Entry{{Index: 1, Term: 1, Data: []byte("secret")}}
+	if err = w.Save(raftpb.HardState{}, ents); err != errRand {
+		t.Errorf("err = %v, want %v", err, errRand)
+	}
+	if err = w.SaveSnapshot(walpb.Snapshot{Index: 1, Term: 1}); err != errRand {
+		t.Errorf("err = %v, want %v", err, errRand)
+	}
+}
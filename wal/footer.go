@@ -0,0 +1,252 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// footerBytes is the size of the data of a footer record.
+const footerBytes = 24
+
+var errBadFooter = errors.New("wal: malformed footer")
+
+// footer is the data of the footer record that Cut appends to the file it
+// finalizes. A file can be checked against its footer by a streaming
+// checksum of its bytes, without decoding its records.
+type footer struct {
+	records int64  // number of records before the footer
+	sum     uint64 // checksum of the bytes of the records before the footer
+	crc     uint64 // crc of the records before the footer
+}
+
+func (ft footer) marshal() []byte {
+	b := make([]byte, footerBytes)
+	binary.LittleEndian.PutUint64(b, uint64(ft.records))
+	binary.LittleEndian.PutUint64(b[8:], ft.sum)
+	binary.LittleEndian.PutUint64(b[16:], ft.crc)
+	return b
+}
+
+func parseFooter(b []byte) (footer, error) {
+	if len(b) != footerBytes {
+		return footer{}, errBadFooter
+	}
+	return footer{
+		records: int64(binary.LittleEndian.Uint64(b)),
+		sum:     binary.LittleEndian.Uint64(b[8:]),
+		crc:     binary.LittleEndian.Uint64(b[16:]),
+	}, nil
+}
+
+// saveFooter appends the footer to the file being appended, which is
+// finalized by Cut. The frames are counted and checksummed by the encoder
+// as they are written.
+func (w *WAL) saveFooter() error {
+	fs := w.encoder.frameSum()
+	ft := footer{records: fs.n, sum: fs.sum, crc: w.encoder.crc.Sum64()}
+	return w.encode(&walpb.Record{Type: footerType, Data: ft.marshal()})
+}
+
+// sumFrames returns the number and the checksum of the frames of the WAL
+// file at the given path, which is checksummed with c and holds records
+// of up to max bytes.
+func sumFrames(fpath string, c Checksum, max int64) (frameSum, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return frameSum{}, err
+	}
+	defer f.Close()
+	h := c.newHash(0)
+	var n int64
+	err = readFrames(f, max, func(frame []byte) error {
+		h.Write(frame)
+		n++
+		return nil
+	})
+	return frameSum{n: n, sum: h.Sum64()}, err
+}
+
+// readFrames calls fn with each frame read from r, which is a record with
+// its length field and padding, until the end of r or the zero padding
+// at its tail. The records are not decoded, and a record larger than max
+// fails the reading. The frame is only valid until fn returns.
+func readFrames(r io.Reader, max int64, fn func(frame []byte) error) error {
+	var buf []byte
+	for {
+		var lb [8]byte
+		n, err := io.ReadFull(r, lb[:])
+		if err == io.EOF || (err == io.ErrUnexpectedEOF && isZero(lb[:n])) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		l, pad, ok := decodeFrameSize(int64(binary.LittleEndian.Uint64(lb[:])))
+		if !ok || l > max {
+			return ErrRecordTooLarge
+		}
+		if l == 0 {
+			return nil
+		}
+		buf = resize(buf, int(8+l+pad))
+		copy(buf, lb[:])
+		if _, err = io.ReadFull(r, buf[8:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if err = fn(buf); err != nil {
+			return err
+		}
+	}
+}
+
+// Verify checks the integrity of the WAL files in the given directory, and
+// that their crc chain continues from each file to the next. A file
+// finalized by Cut is checked against its footer by a streaming checksum
+// of its bytes, without decoding its records. The other files, such as
+// the file being appended and the files written before footers were
+// added, and the files that do not match their footer, are checked by
+// decoding their records. It neither locks nor writes the files, and the
+// encrypted records are checked without decrypting them. Only the maximum
+// size of a record is used among the options.
+func Verify(dirpath string, opts ...Option) error {
+	max := newOptions(opts).maxRecordBytes
+	names, err := fileutil.ReadDir(dirpath)
+	if err != nil {
+		return err
+	}
+	names = checkWalNames(names)
+	if len(names) == 0 {
+		return ErrFileNotFound
+	}
+	if err = checkSeq(names); err != nil {
+		return err
+	}
+	var prev uint64
+	for i, name := range names {
+		first, last, ok, err := verifyFooter(filepath.Join(dirpath, name), max)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if first, last, err = verifyRecords(dirpath, name, max); err != nil {
+				return err
+			}
+		}
+		if i > 0 && first != prev {
+			seq, _, _ := parseWalName(name)
+			return &DecodeError{File: name, Index: i, Type: crcType,
+				Err: &CRCError{Seq: seq, Expected: first, Actual: prev}}
+		}
+		prev = last
+	}
+	return nil
+}
+
+// verifyFooter checks the WAL file at the given path against its footer.
+// It returns the crc that the chain of the file starts from and the crc
+// of its last record, or false if the file has no footer or does not
+// match it. The records of the file are up to max bytes.
+func verifyFooter(fpath string, max int64) (first, last uint64, ok bool, err error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer f.Close()
+	var (
+		checksum Checksum
+		h        Hash
+		n        int64
+		frame    []byte
+	)
+	err = readFrames(f, max, func(b []byte) error {
+		if frame == nil {
+			// the first record is the crc record, which gives the
+			// checksum of the file and the crc its chain starts from
+			var rec walpb.Record
+			if err := unmarshal(&rec, b[8:]); err != nil || rec.Type != crcType {
+				return ErrDecode
+			}
+			c, err := parseFormat(rec.Data)
+			if err != nil {
+				return err
+			}
+			checksum, h, first = c, c.newHash(0), recordCrc(&rec)
+		} else {
+			h.Write(frame)
+			n++
+		}
+		frame = append(frame[:0], b...)
+		return nil
+	})
+	if err != nil || frame == nil {
+		// the slow path reports what is wrong with the file
+		return 0, 0, false, nil
+	}
+	l, _, _ := decodeFrameSize(int64(binary.LittleEndian.Uint64(frame)))
+	var rec walpb.Record
+	if unmarshal(&rec, frame[8:8+l]) != nil || rec.Type != footerType {
+		return 0, 0, false, nil
+	}
+	ft, err := parseFooter(rec.Data)
+	if err != nil || ft.records != n || ft.sum != h.Sum64() {
+		return 0, 0, false, nil
+	}
+	// the footer is chained to the crc of the records before it, which
+	// it records, so it is checked without them
+	fh := checksum.newHash(ft.crc)
+	fh.Write(rec.Data)
+	if checksum.validate(&rec, fh.Sum64()) != nil {
+		return 0, 0, false, nil
+	}
+	return first, recordCrc(&rec), true, nil
+}
+
+// verifyRecords checks the given WAL file by decoding its records. It
+// returns the crc that the chain of the file starts from and the crc of
+// its last record.
+func verifyRecords(dirpath, name string, max int64) (first, last uint64, err error) {
+	d, err := openDecoder(osStore{}, dirpath, []string{name})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer d.close()
+	d.maxBytes = max
+	rec := &walpb.Record{}
+	for {
+		if err = d.decode(rec); err != nil {
+			break
+		}
+		if rec.Type == crcType {
+			// the crc chain of the file starts at its crc record
+			first = recordCrc(rec)
+			d.updateCRC(first)
+		}
+	}
+	if err != io.EOF {
+		return 0, 0, err
+	}
+	return first, d.lastCRC(), nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestCutWritesFooter(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ents []raftpb.Entry
+	for i := 1; i <= 3; i++ {
+		es := []raftpb.Entry{{Index: uint64(i), Term: 1, Data: []byte("data")}}
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: uint64(i)}, es); err != nil {
+			t.Fatal(err)
+		}
+		ents = append(ents, es...)
+		if i < 3 {
+			if err = w.Cut(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	w.Close()
+
+	// the files finalized by Cut are checked against their footer, but
+	// not the file being appended
+	for i, name := range []string{walName(0, 0), walName(1, 2), walName(2, 3)} {
+		_, _, ok, err := verifyFooter(filepath.Join(p, name), MaxRecordBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i < 2; ok != want {
+			t.Errorf("#%d: footer ok = %v, want %v", i, ok, want)
+		}
+	}
+	if err = Verify(p); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+
+	// the footers are skipped by ReadAll
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, ents) {
+		t.Errorf("ents = %+v, want %+v", entries, ents)
+	}
+}
+
+func TestVerifyCorrupted(t *testing.T) {
+	tests := []struct {
+		name string
+		// corrupt returns the offset of the byte to corrupt in the data
+		// of the first file
+		corrupt func(b []byte) int
+	}{
+		{"entry", func(b []byte) int { return bytes.Index(b, []byte("payload")) }},
+		{"footer", func(b []byte) int {
+			// the footer is the last record, followed by the zero padding
+			return len(bytes.TrimRight(b, "\x00")) - 1
+		}},
+	}
+	for i, tt := range tests {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := Create(p, []byte("metadata"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		es := []raftpb.Entry{{Index: 1, Term: 1, Data: []byte("payload")}}
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: 1}, es); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+
+		fpath := filepath.Join(p, walName(0, 0))
+		b, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[tt.corrupt(b)] ^= 0x1
+		if err = ioutil.WriteFile(fpath, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, ok, _ := verifyFooter(fpath, MaxRecordBytes); ok {
+			t.Errorf("#%d (%s): footer ok = %v, want false", i, tt.name, ok)
+		}
+		if err = Verify(p); !errors.Is(err, ErrCRCMismatch) {
+			t.Errorf("#%d (%s): err = %v, want %v", i, tt.name, err, ErrCRCMismatch)
+		}
+		os.RemoveAll(p)
+	}
+}
+
+// TestCutFooterAfterReopen tests that the footer of a file appended after
+// reopening the WAL covers the frames written before it was reopened.
+func TestCutFooterAfterReopen(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		if i == 3 {
+			w.Close()
+			if w, err = Open(p, walpb.Snapshot{}); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, _, err = w.ReadAll(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		es := []raftpb.Entry{{Index: uint64(i), Term: 1, Data: []byte("data")}}
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: uint64(i)}, es); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	_, _, ok, err := verifyFooter(filepath.Join(p, walName(0, 0)), MaxRecordBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Errorf("footer ok = %v, want true", ok)
+	}
+	if err = Verify(p); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
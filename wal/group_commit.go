@@ -0,0 +1,156 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// groupCommit lets concurrent Save calls share fsyncs. The records of each
+// Save are appended in call order, and a single fsync covers all the Saves
+// appended while the previous fsync was in flight.
+type groupCommit struct {
+	// appendMu serializes appending records and switching the file.
+	appendMu sync.Mutex
+	// appended is the number of Saves appended, guarded by appendMu.
+	appended uint64
+
+	// window is how long an fsync is delayed to let more Saves join it.
+	window time.Duration
+
+	// syncMu is held while syncing the file, so Cut does not close the
+	// file in the meantime.
+	syncMu sync.Mutex
+
+	mu      sync.Mutex // guards the fields below
+	cond    *sync.Cond // signaled when an fsync finishes
+	syncing bool       // an fsync is in flight
+	synced  uint64     // number of Saves synced
+}
+
+func newGroupCommit(window time.Duration) *groupCommit {
+	g := &groupCommit{window: window}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// groupSave appends the records of a Save, and waits for an fsync that
+// covers them.
+func (w *WAL) groupSave(st raftpb.HardState, ents []raftpb.Entry) error {
+	seq, sync, err := w.groupAppend(st, ents)
+	if err != nil || !sync {
+		return err
+	}
+	return w.groupSync(seq)
+}
+
+// groupAppend appends the records of a Save without syncing them, and
+// returns the sequence number of the Save, and whether it must be synced.
+func (w *WAL) groupAppend(st raftpb.HardState, ents []raftpb.Entry) (uint64, bool, error) {
+	g := w.gc
+	g.appendMu.Lock()
+	defer g.appendMu.Unlock()
+	sync := mustSync(st, w.state, len(ents))
+	if err := w.saveNoSync(st, ents); err != nil {
+		return 0, false, err
+	}
+	g.appended++
+	return g.appended, sync, nil
+}
+
+// groupSync waits until the Save with the given sequence number is synced.
+// If no fsync is in flight, it issues one that covers all the Saves
+// appended so far, and releases all the Saves it covers once it returns.
+func (w *WAL) groupSync(seq uint64) error {
+	g := w.gc
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.synced < seq {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		g.mu.Unlock()
+		if g.window > 0 {
+			time.Sleep(g.window)
+		}
+		n, err := w.syncAppended()
+		g.mu.Lock()
+		g.syncing = false
+		if err == nil && n > g.synced {
+			g.synced = n
+		}
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncAppended flushes and syncs the records appended so far, and returns
+// the number of Saves synced.
+func (w *WAL) syncAppended() (uint64, error) {
+	g := w.gc
+	g.appendMu.Lock()
+	n := g.appended
+	if err := w.encoder.flush(); err != nil {
+		g.appendMu.Unlock()
+		return 0, err
+	}
+	f, seq, off := w.f, w.seq, w.off
+	// take syncMu before letting others append, so the file cannot be
+	// closed by Cut before it is synced.
+	g.syncMu.Lock()
+	g.appendMu.Unlock()
+	defer g.syncMu.Unlock()
+	if err := w.syncFile(f); err != nil {
+		return 0, err
+	}
+	w.setSynced(seq, off)
+	return n, nil
+}
+
+// lockAppend serializes the operations that append records or switch the
+// file, with the Saves in group commit mode.
+func (w *WAL) lockAppend() {
+	if w.gc != nil {
+		w.gc.appendMu.Lock()
+		return
+	}
+	w.appendMu.Lock()
+}
+
+func (w *WAL) unlockAppend() {
+	if w.gc != nil {
+		w.gc.appendMu.Unlock()
+		return
+	}
+	w.appendMu.Unlock()
+}
+
+// closeFile closes the file being appended, after the fsync in flight in
+// group commit mode is done.
+func (w *WAL) closeFile() error {
+	if w.gc != nil {
+		w.gc.syncMu.Lock()
+		defer w.gc.syncMu.Unlock()
+	}
+	return w.f.Close()
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// WALStats are the tallies of the records of a WAL, as returned by Inspect.
+type WALStats struct {
+	Segments int // number of WAL files
+	// Records and Bytes are the number of records of each type and the
+	// bytes they take in the WAL files, keyed by the type names of Dump
+	Records map[string]int64
+	Bytes   map[string]int64
+	// MinIndex and MaxIndex are the smallest and largest indexes of the
+	// entries, or 0 if there are none
+	MinIndex, MaxIndex uint64
+	// Corrupt is the error that stopped the reading at a corrupted record,
+	// if any. The tallies cover the records before it.
+	Corrupt error
+	// Ignored are the names of the files in the directory that are not
+	// WAL files, and are ignored by Open.
+	Ignored []string
+}
+
+// Inspect reads all the records of the WAL in the given directory, and
+// returns their tallies. It neither locks nor writes the WAL files. The
+// records of an encrypted WAL are tallied as encrypted without the key.
+// Only the encryption key, the store and the maximum size of a record are
+// used among the options.
+func Inspect(dirpath string, opts ...Option) (*WALStats, error) {
+	o := newOptions(opts)
+	aead, err := newAEAD(o.key)
+	if err != nil {
+		return nil, err
+	}
+	names, err := readDir(o.store, dirpath)
+	if err != nil {
+		return nil, err
+	}
+	names, ignored := splitWalNames(names)
+	if len(names) == 0 {
+		return nil, ErrFileNotFound
+	}
+	d, err := openDecoder(o.store, dirpath, names)
+	if err != nil {
+		return nil, err
+	}
+	defer d.close()
+	d.aead, d.maxBytes = aead, o.maxRecordBytes
+
+	st := &WALStats{
+		Segments: len(names),
+		Records:  make(map[string]int64),
+		Bytes:    make(map[string]int64),
+		Ignored:  ignored,
+	}
+	rec := &walpb.Record{}
+	for {
+		if err = d.decode(rec); err != nil {
+			break
+		}
+		typ := recordTypeNames[rec.Type]
+		if typ == "" {
+			typ = fmt.Sprintf("type %d", rec.Type)
+		}
+		st.Records[typ]++
+		st.Bytes[typ] += d.off - d.lastOff
+		switch rec.Type {
+		case entryType:
+			var e raftpb.Entry
+			if err = unmarshal(&e, rec.Data); err != nil {
+				err = d.decodeError(rec.Type, err)
+				break
+			}
+			if st.MinIndex == 0 || e.Index < st.MinIndex {
+				st.MinIndex = e.Index
+			}
+			if e.Index > st.MaxIndex {
+				st.MaxIndex = e.Index
+			}
+		case crcType:
+			d.updateCRC(recordCrc(rec))
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != io.EOF {
+		if !isCorrupt(err) {
+			return nil, err
+		}
+		st.Corrupt = err
+	}
+	return st, nil
+}
+
+// CountEntries returns the number of entry records after the given snapshot
+// in the WAL in the given directory, which is how many entries accumulated
+// since the snapshot, counting the entries overwritten by later ones. The
+// records are decoded and their crcs checked as by ReadAll, but the entries
+// are not retained. It neither locks nor writes the WAL files. Only the
+// encryption key, the store and the maximum size of a record are used
+// among the options.
+func CountEntries(dirpath string, snap walpb.Snapshot, opts ...Option) (uint64, error) {
+	w, err := OpenReadOnly(dirpath, snap, opts...)
+	if err != nil {
+		return 0, err
+	}
+	defer w.Close()
+	var n uint64
+	_, _, err = w.ReadRecords(func(*walpb.Record) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
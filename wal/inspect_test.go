@@ -0,0 +1,173 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestInspect(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithPadding())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		es := []raftpb.Entry{{Index: uint64(i + 1), Term: 1, Data: []byte("data")}}
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: uint64(i)}, es); err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 {
+			if err = w.SaveSnapshot(walpb.Snapshot{Index: 2, Term: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if err = w.Cut(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	off := w.off
+	w.Close()
+
+	st, err := Inspect(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Create writes an empty snapshot, and Cut the state at the head of
+	// the new file
+	wrecords := map[string]int64{"crc": 2, "metadata": 2, "snapshot": 2, "state": 5, "entry": 4}
+	if st.Segments != 2 {
+		t.Errorf("segments = %d, want 2", st.Segments)
+	}
+	if !reflect.DeepEqual(st.Records, wrecords) {
+		t.Errorf("records = %v, want %v", st.Records, wrecords)
+	}
+	for typ := range wrecords {
+		if n := st.Bytes[typ]; n < 8*wrecords[typ] || n%8 != 0 {
+			t.Errorf("bytes of %s = %d, want a multiple of 8 frames", typ, n)
+		}
+	}
+	if st.MinIndex != 2 || st.MaxIndex != 5 {
+		t.Errorf("index range = [%d, %d], want [2, 5]", st.MinIndex, st.MaxIndex)
+	}
+	if st.Corrupt != nil {
+		t.Errorf("corrupt = %v, want nil", st.Corrupt)
+	}
+	if st.Ignored != nil {
+		t.Errorf("ignored = %v, want nil", st.Ignored)
+	}
+
+	// a file that is not a WAL file is listed
+	if err = ioutil.WriteFile(filepath.Join(p, "README"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if st, err = Inspect(p); err != nil {
+		t.Fatal(err)
+	}
+	if w := []string{"README"}; !reflect.DeepEqual(st.Ignored, w) {
+		t.Errorf("ignored = %v, want %v", st.Ignored, w)
+	}
+
+	// the last entry is torn
+	if err = os.Truncate(filepath.Join(p, walName(1, 4)), off-1); err != nil {
+		t.Fatal(err)
+	}
+	if st, err = Inspect(p); err != nil {
+		t.Fatal(err)
+	}
+	if st.Corrupt == nil {
+		t.Errorf("corrupt = nil, want an error")
+	}
+	if st.Records["entry"] != 3 || st.MaxIndex != 4 {
+		t.Errorf("entries = %d up to %d, want 3 up to 4", st.Records["entry"], st.MaxIndex)
+	}
+}
+
+func TestCountEntries(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		es := []raftpb.Entry{{Index: uint64(i), Term: 1, Data: []byte("data")}}
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: uint64(i)}, es); err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 {
+			if err = w.SaveSnapshot(walpb.Snapshot{Index: 2, Term: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if err = w.Cut(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the entry overwritten is counted
+	if err = w.Save(raftpb.HardState{Term: 2, Commit: 3}, []raftpb.Entry{{Index: 4, Term: 2, Data: []byte("data")}}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	tests := []struct {
+		snap walpb.Snapshot
+		wn   uint64
+	}{
+		{walpb.Snapshot{}, 5},
+		{walpb.Snapshot{Index: 2, Term: 1}, 3},
+	}
+	for i, tt := range tests {
+		n, err := CountEntries(p, tt.snap)
+		if err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		if n != tt.wn {
+			t.Errorf("#%d: n = %d, want %d", i, n, tt.wn)
+		}
+	}
+
+	// corrupt the data of the last entry
+	fpath := filepath.Join(p, walName(1, 3))
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[bytes.LastIndex(b, []byte("data"))] ^= 0xff
+	if err = ioutil.WriteFile(fpath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = CountEntries(p, walpb.Snapshot{}); !errors.Is(err, ErrDecode) {
+		t.Errorf("err = %v, want %v", err, ErrDecode)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import "log"
+
+// Logger is the logger the wal package writes its messages to.
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Warningf(format string, v ...interface{})
+}
+
+var logger Logger = defaultLogger{}
+
+// SetLogger sets the logger of the wal package, which logs with the
+// standard log package by default. It is not safe to call it while WALs
+// are in use.
+func SetLogger(l Logger) {
+	logger = l
+}
+
+type defaultLogger struct{}
+
+func (defaultLogger) Printf(format string, v ...interface{})   { log.Printf(format, v...) }
+func (defaultLogger) Warningf(format string, v ...interface{}) { log.Printf(format, v...) }
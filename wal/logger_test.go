@@ -0,0 +1,65 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+type recordLogger struct {
+	msgs []string
+}
+
+func (l *recordLogger) Printf(format string, v ...interface{}) {
+	l.msgs = append(l.msgs, fmt.Sprintf(format, v...))
+}
+
+func (l *recordLogger) Warningf(format string, v ...interface{}) {
+	l.msgs = append(l.msgs, "warning: "+fmt.Sprintf(format, v...))
+}
+
+func TestSetLogger(t *testing.T) {
+	l := &recordLogger{}
+	SetLogger(l)
+	defer SetLogger(defaultLogger{})
+
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the file locked by w is not opened, and it is logged
+	r, err := OpenNotInUse(p, walpb.Snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if len(l.msgs) != 1 || !strings.HasPrefix(l.msgs[0], "wal: opened all the files until") {
+		t.Errorf("messages = %q, want the opened files", l.msgs)
+	}
+}
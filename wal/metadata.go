@@ -0,0 +1,61 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// metadataVersion is the version of the WAL format written by this
+// version. It is bumped whenever the format changes so that a reader of
+// an older version would misread it.
+const metadataVersion uint32 = 1
+
+// metadataMagic starts the header prepended to the metadata by Create.
+// The metadata written before the header was added has no header, and is
+// of version 0.
+var metadataMagic = []byte{0xff, 'W', 'A', 'L'}
+
+// encodeMetadata prepends the header of the current version to metadata.
+func encodeMetadata(metadata []byte) []byte {
+	b := make([]byte, len(metadataMagic)+4+len(metadata))
+	n := copy(b, metadataMagic)
+	binary.LittleEndian.PutUint32(b[n:], metadataVersion)
+	copy(b[n+4:], metadata)
+	return b
+}
+
+// decodeMetadata returns the metadata in the data of a metadata record
+// without its header, and the version of the header. It returns an error
+// matching ErrUnsupportedVersion if the version is newer than the current
+// one.
+func decodeMetadata(data []byte) (metadata []byte, version uint32, err error) {
+	n := len(metadataMagic)
+	if len(data) < n+4 || !bytes.Equal(data[:n], metadataMagic) {
+		return data, 0, nil
+	}
+	version = binary.LittleEndian.Uint32(data[n:])
+	if version > metadataVersion {
+		return nil, version, fmt.Errorf("%w: found version %d, want at most %d", ErrUnsupportedVersion, version, metadataVersion)
+	}
+	metadata = data[n+4:]
+	if len(metadata) == 0 {
+		// as returned for empty metadata without a header
+		metadata = nil
+	}
+	return metadata, version, nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/pkg/pbutil"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestOpenUnsupportedVersion(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the files from now on look like the ones of a newer version
+	binary.LittleEndian.PutUint32(w.metadata[len(metadataMagic):], metadataVersion+1)
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if _, err = Open(p, walpb.Snapshot{}); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("err = %v, want %v", err, ErrUnsupportedVersion)
+	}
+	// OpenReadOnly does not check the metadata before ReadAll
+	r, err := OpenReadOnly(p, walpb.Snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, _, _, err = r.ReadAll(); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("err = %v, want %v", err, ErrUnsupportedVersion)
+	}
+}
+
+func TestOpenVersion0(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	// a WAL written before the metadata had a header
+	var buf bytes.Buffer
+	e := newEncoder(&buf, 0, ChecksumCRC32C)
+	recs := []*walpb.Record{
+		{Type: crcType, Data: formatData(ChecksumCRC32C, false)},
+		{Type: metadataType, Data: []byte("metadata")},
+		{Type: snapshotType, Data: pbutil.MustMarshal(&walpb.Snapshot{})},
+	}
+	for _, r := range recs {
+		if err = e.encode(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = e.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(p, walName(0, 0)), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := Open(p, walpb.Snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, _, _, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "metadata")
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1}}
+	if err = w.Save(raftpb.HardState{}, ents); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// the file cut keeps the version of the WAL
+	md, _, _, err := headMetadata(filepath.Join(p, walName(1, 2)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(md, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", md, "metadata")
+	}
+	f, err := ioutil.ReadFile(filepath.Join(p, walName(1, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(f, metadataMagic) {
+		t.Errorf("metadata header found in %s, want version 0", walName(1, 2))
+	}
+
+	w, err = Open(p, walpb.Snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if metadata, _, _, err = w.ReadAll(); err != nil || !reflect.DeepEqual(metadata, []byte("metadata")) {
+		t.Errorf("metadata, err = %s, %v, want %s, nil", metadata, err, "metadata")
+	}
+}
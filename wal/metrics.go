@@ -0,0 +1,162 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+)
+
+// Metrics are the counters of the writes to a WAL since it was created or
+// opened.
+type Metrics struct {
+	Saves          int64 // number of Save and SaveNoSync calls
+	EntriesWritten int64 // number of entries saved
+	BytesWritten   int64 // number of bytes appended
+	Cuts           int64 // number of new WAL files cut
+
+	Syncs           int64         // number of fsyncs
+	SyncDuration    time.Duration // total time spent in fsync
+	MaxSyncDuration time.Duration // duration of the longest fsync
+}
+
+// An Observer is notified of the writes to a WAL as they happen, so they can
+// be exported to a monitoring system. It is set with WithObserver. Its
+// methods are called synchronously on the write path, so they must be fast.
+type Observer interface {
+	// ObserveSave is called after a Save or SaveNoSync with the number of
+	// bytes it appended.
+	ObserveSave(bytes int64)
+	// ObserveSync is called after each fsync with its duration.
+	ObserveSync(d time.Duration)
+	// ObserveCut is called when a new WAL file is cut.
+	ObserveCut()
+}
+
+// Metrics returns the current counters of w.
+func (w *WAL) Metrics() Metrics {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return Metrics{
+		Saves:           w.saves,
+		EntriesWritten:  w.entries,
+		BytesWritten:    w.bytesWritten,
+		Cuts:            w.cuts,
+		Syncs:           w.syncs,
+		SyncDuration:    w.syncDuration,
+		MaxSyncDuration: w.maxSync,
+	}
+}
+
+// DiskSize returns the total size in bytes of the WAL files that w is
+// holding locks on.
+func (w *WAL) DiskSize() (int64, error) {
+	w.mu.Lock()
+	names := make([]string, len(w.locks))
+	for i, l := range w.locks {
+		names[i] = l.Name()
+	}
+	w.mu.Unlock()
+
+	var size int64
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+	return size, nil
+}
+
+// EntriesWritten returns the number of entries saved to w since it was
+// created or opened.
+func (w *WAL) EntriesWritten() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.entries
+}
+
+// BytesWritten returns the number of bytes appended to w since it was
+// created or opened, including the records of the WAL itself, such as the
+// metadata at the head of each WAL file.
+func (w *WAL) BytesWritten() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.bytesWritten
+}
+
+// SegmentInfo describes a WAL file.
+type SegmentInfo struct {
+	Name  string // base name of the WAL file
+	Seq   uint64 // sequence of the WAL file
+	Index uint64 // raft index of the first entry the file may contain
+	Size  int64  // size of the file in bytes
+	// Locked is set if the file is locked by a WAL, of this process or
+	// another one. It is only found on Linux, and is false elsewhere.
+	Locked bool
+}
+
+// SegmentStats returns the description of each WAL file in the given
+// directory, in increasing order. It neither locks nor writes the files.
+func SegmentStats(dirpath string) ([]SegmentInfo, error) {
+	names, err := fileutil.ReadDir(dirpath)
+	if err != nil {
+		return nil, err
+	}
+	names = checkWalNames(names)
+	infos := make([]SegmentInfo, 0, len(names))
+	for _, name := range names {
+		seq, index, err := parseWalName(name)
+		if err != nil {
+			return nil, err
+		}
+		fpath := filepath.Join(dirpath, name)
+		fi, err := os.Stat(fpath)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, SegmentInfo{
+			Name:   name,
+			Seq:    seq,
+			Index:  index,
+			Size:   fi.Size(),
+			Locked: fileutil.LockOwner(fpath) != 0,
+		})
+	}
+	return infos, nil
+}
+
+// DiskUsage returns the total size in bytes of the WAL files in the given
+// directory, unlike DiskSize which only counts the files that a WAL is
+// holding locks on.
+func DiskUsage(dirpath string) (int64, error) {
+	names, err := fileutil.ReadDir(dirpath)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, name := range checkWalNames(names) {
+		fi, err := os.Stat(filepath.Join(dirpath, name))
+		if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+	return size, nil
+}
@@ -0,0 +1,291 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestWrittenCounters(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if g := w.EntriesWritten(); g != 0 {
+		t.Errorf("entries = %d, want 0", g)
+	}
+	created := w.BytesWritten()
+	size, err := w.DiskSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != created {
+		t.Errorf("disk size = %d, want %d", size, created)
+	}
+
+	ents := []raftpb.Entry{{Index: 1, Term: 1, Data: make([]byte, 100)}, {Index: 2, Term: 1, Data: make([]byte, 100)}}
+	if err = w.Save(raftpb.HardState{Term: 1, Commit: 2}, ents); err != nil {
+		t.Fatal(err)
+	}
+	if g := w.EntriesWritten(); g != 2 {
+		t.Errorf("entries = %d, want 2", g)
+	}
+	// two entries and a state are appended
+	if g := w.BytesWritten() - created; g < 200 {
+		t.Errorf("bytes written = %d, want at least %d", g, 200)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	size, err = w.DiskSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := w.BytesWritten(); size != g {
+		t.Errorf("disk size = %d, want %d", size, g)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	m := w.Metrics()
+	if m.Saves != 0 || m.Cuts != 0 {
+		t.Errorf("saves, cuts = %d, %d, want 0, 0", m.Saves, m.Cuts)
+	}
+	syncs := m.Syncs
+
+	ents := []raftpb.Entry{{Index: 1, Term: 1}}
+	if err = w.Save(raftpb.HardState{}, ents); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveNoSync(raftpb.HardState{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	m = w.Metrics()
+	if m.Saves != 2 {
+		t.Errorf("saves = %d, want 2", m.Saves)
+	}
+	if m.Cuts != 1 {
+		t.Errorf("cuts = %d, want 1", m.Cuts)
+	}
+	// one sync for Save, and two for Cut
+	if g := m.Syncs - syncs; g != 3 {
+		t.Errorf("syncs = %d, want 3", g)
+	}
+	if m.EntriesWritten != 1 {
+		t.Errorf("entries = %d, want 1", m.EntriesWritten)
+	}
+	if m.BytesWritten != w.BytesWritten() {
+		t.Errorf("bytes written = %d, want %d", m.BytesWritten, w.BytesWritten())
+	}
+	if m.MaxSyncDuration > m.SyncDuration {
+		t.Errorf("max sync duration = %v, want at most %v", m.MaxSyncDuration, m.SyncDuration)
+	}
+}
+
+type recorder struct {
+	saves []int64
+	syncs []time.Duration
+	cuts  int
+}
+
+func (r *recorder) ObserveSave(bytes int64)     { r.saves = append(r.saves, bytes) }
+func (r *recorder) ObserveSync(d time.Duration) { r.syncs = append(r.syncs, d) }
+func (r *recorder) ObserveCut()                 { r.cuts++ }
+
+func TestObserver(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	r := &recorder{}
+	w, err := Create(p, []byte("metadata"), WithObserver(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	before := w.BytesWritten()
+	ents := []raftpb.Entry{{Index: 1, Term: 1, Data: []byte("data")}}
+	if err = w.Save(raftpb.HardState{}, ents); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.saves) != 1 {
+		t.Fatalf("len(saves) = %d, want 1", len(r.saves))
+	}
+	if g, wb := r.saves[0], w.BytesWritten()-before; g != wb {
+		t.Errorf("saved bytes = %d, want %d", g, wb)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	if r.cuts != 1 {
+		t.Errorf("cuts = %d, want 1", r.cuts)
+	}
+	// one sync for Save, and two for Cut
+	if len(r.syncs) != 3 {
+		t.Errorf("syncs = %d, want 3", len(r.syncs))
+	}
+}
+
+func TestSaveSkipsSync(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithGroupCommit()}} {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(p)
+
+		w, err := Create(p, []byte("metadata"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ents := []raftpb.Entry{{Index: 1, Term: 1}}
+		tests := []struct {
+			st    raftpb.HardState
+			ents  []raftpb.Entry
+			wsync bool
+		}{
+			{raftpb.HardState{}, nil, false},
+			{raftpb.HardState{Term: 1, Vote: 1}, nil, true},
+			// message-only Readys after a state is saved
+			{raftpb.HardState{}, nil, false},
+			{raftpb.HardState{}, nil, false},
+			{raftpb.HardState{Term: 1, Vote: 1, Commit: 1}, nil, false},
+			{raftpb.HardState{Term: 1, Vote: 1, Commit: 1}, ents, true},
+			{raftpb.HardState{Term: 2, Vote: 1, Commit: 1}, nil, true},
+			{raftpb.HardState{Term: 2, Vote: 2, Commit: 1}, nil, true},
+			{raftpb.HardState{Term: 2, Vote: 2, Commit: 2}, nil, false},
+			{raftpb.HardState{}, []raftpb.Entry{{Index: 2, Term: 2}}, true},
+			{raftpb.HardState{}, nil, false},
+		}
+		for i, tt := range tests {
+			syncs := w.Metrics().Syncs
+			if err = w.Save(tt.st, tt.ents); err != nil {
+				t.Fatal(err)
+			}
+			if g := w.Metrics().Syncs - syncs; (g != 0) != tt.wsync {
+				t.Errorf("#%d: syncs = %d, want synced %v", i, g, tt.wsync)
+			}
+		}
+		w.Close()
+
+		// the HardState with only a new commit index is still saved
+		if w, err = Open(p, walpb.Snapshot{}); err != nil {
+			t.Fatal(err)
+		}
+		_, state, _, err := w.ReadAll()
+		w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wstate := (raftpb.HardState{Term: 2, Vote: 2, Commit: 2}); !reflect.DeepEqual(state, wstate) {
+			t.Errorf("state = %+v, want %+v", state, wstate)
+		}
+	}
+}
+
+func TestSegmentStats(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i := 1; i <= 2; i++ {
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: uint64(i)}, []raftpb.Entry{{Index: uint64(i), Term: 1}}); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.ReleaseLockTo(2); err != nil {
+		t.Fatal(err)
+	}
+	// not a WAL file
+	if err = ioutil.WriteFile(path.Join(p, "README"), []byte("readme"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := SegmentStats(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wnames := []string{walName(0, 0), walName(1, 2), walName(2, 3)}
+	if len(infos) != len(wnames) {
+		t.Fatalf("len(infos) = %d, want %d", len(infos), len(wnames))
+	}
+	var total int64
+	for i, info := range infos {
+		fi, err := os.Stat(path.Join(p, wnames[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq, index, _ := parseWalName(wnames[i])
+		winfo := SegmentInfo{Name: wnames[i], Seq: seq, Index: index, Size: fi.Size()}
+		// the first file is released, and the others are still locked
+		if runtime.GOOS == "linux" && i > 0 {
+			winfo.Locked = true
+		}
+		if info != winfo {
+			t.Errorf("#%d: info = %+v, want %+v", i, info, winfo)
+		}
+		total += fi.Size()
+	}
+
+	size, err := DiskUsage(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != total {
+		t.Errorf("disk usage = %d, want %d", size, total)
+	}
+}
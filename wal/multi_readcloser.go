@@ -16,30 +16,129 @@ package wal
 
 import "io"
 
+// multiReader is a ReadCloser that reads from several readers one after
+// another, and keeps track of where it is in them.
+type multiReader interface {
+	io.ReadCloser
+	// Position returns the index of the reader being read, and the number
+	// of bytes read from it so far.
+	Position() (index int, offset int64)
+}
+
 type multiReadCloser struct {
-	closers []io.Closer
-	reader  io.Reader
+	readClosers []io.ReadCloser
+	i           int
+	n           int64
 }
 
 func (mc *multiReadCloser) Close() error {
 	var err error
-	for i := range mc.closers {
-		err = mc.closers[i].Close()
+	for i := range mc.readClosers {
+		err = mc.readClosers[i].Close()
 	}
 	return err
 }
 
 func (mc *multiReadCloser) Read(p []byte) (int, error) {
-	return mc.reader.Read(p)
+	for mc.i < len(mc.readClosers) {
+		n, err := mc.readClosers[mc.i].Read(p)
+		mc.n += int64(n)
+		if err == io.EOF {
+			// stay at the end of the last reader
+			if mc.i+1 == len(mc.readClosers) {
+				return n, io.EOF
+			}
+			mc.i++
+			mc.n = 0
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+	return 0, io.EOF
+}
+
+func (mc *multiReadCloser) Position() (int, int64) {
+	return mc.i, mc.n
 }
 
+// multiReadSeekCloser is a multiReadCloser whose readers are all seekable.
+type multiReadSeekCloser struct {
+	multiReadCloser
+}
+
+// Seek sets the offset of the next Read in the readers taken as one, and
+// returns the new offset. The readers are seeked to their ends to find
+// their sizes. An offset at the end of a reader is at the start of the
+// next one, as after reading it.
+func (mc *multiReadSeekCloser) Seek(offset int64, whence int) (int64, error) {
+	sizes := make([]int64, len(mc.readClosers))
+	var cur, total int64
+	for i, rc := range mc.readClosers {
+		n, err := rc.(io.Seeker).Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		sizes[i] = n
+		if i < mc.i {
+			cur += n
+		}
+		total += n
+	}
+	cur += mc.n
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cur
+	case io.SeekEnd:
+		offset += total
+	default:
+		return 0, ErrInvalidPosition
+	}
+	if offset < 0 {
+		return 0, ErrInvalidPosition
+	}
+	if len(mc.readClosers) == 0 {
+		return offset, nil
+	}
+
+	i, off := 0, offset
+	for i+1 < len(sizes) && off >= sizes[i] {
+		off -= sizes[i]
+		i++
+	}
+	// the readers after the new one are read from their start
+	for j := i; j < len(mc.readClosers); j++ {
+		pos := int64(0)
+		if j == i {
+			pos = off
+		}
+		if _, err := mc.readClosers[j].(io.Seeker).Seek(pos, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+	mc.i, mc.n = i, off
+	return offset, nil
+}
+
+// MultiReadCloser returns a ReadCloser that reads the given readers one
+// after another. If they all implement io.Seeker, so does the ReadCloser,
+// which seeks in the readers taken as one.
 func MultiReadCloser(readClosers ...io.ReadCloser) io.ReadCloser {
-	cs := make([]io.Closer, len(readClosers))
-	rs := make([]io.Reader, len(readClosers))
-	for i := range readClosers {
-		cs[i] = readClosers[i]
-		rs[i] = readClosers[i]
-	}
-	r := io.MultiReader(rs...)
-	return &multiReadCloser{cs, r}
+	return newMultiReader(readClosers...)
+}
+
+// newMultiReader returns the reader of MultiReadCloser, which tells the
+// position of the next Read in the given readers.
+func newMultiReader(readClosers ...io.ReadCloser) multiReader {
+	rcs := make([]io.ReadCloser, len(readClosers))
+	copy(rcs, readClosers)
+	for _, rc := range rcs {
+		if _, ok := rc.(io.Seeker); !ok {
+			return &multiReadCloser{readClosers: rcs}
+		}
+	}
+	return &multiReadSeekCloser{multiReadCloser{readClosers: rcs}}
 }
@@ -0,0 +1,122 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestMultiReadCloserPosition(t *testing.T) {
+	mr := newMultiReader(
+		ioutil.NopCloser(bytes.NewBufferString("abc")),
+		ioutil.NopCloser(bytes.NewBufferString("")),
+		ioutil.NopCloser(bytes.NewBufferString("defgh")),
+	)
+	tests := []struct {
+		n      int
+		windex int
+		woff   int64
+	}{
+		{2, 0, 2},
+		{1, 0, 3},
+		// the empty reader is skipped
+		{3, 2, 3},
+		{2, 2, 5},
+	}
+	for i, tt := range tests {
+		if _, err := io.ReadFull(mr, make([]byte, tt.n)); err != nil {
+			t.Fatalf("#%d: unexpected error %v", i, err)
+		}
+		index, off := mr.Position()
+		if index != tt.windex || off != tt.woff {
+			t.Errorf("#%d: position = (%d, %d), want (%d, %d)", i, index, off, tt.windex, tt.woff)
+		}
+	}
+	if _, err := mr.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("err = %v, want %v", err, io.EOF)
+	}
+	if err := mr.Close(); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
+
+// nopSeekCloser is a ReadSeeker with a no-op Close.
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+func TestMultiReadCloserSeek(t *testing.T) {
+	mr := newMultiReader(
+		nopSeekCloser{strings.NewReader("abc")},
+		nopSeekCloser{strings.NewReader("")},
+		nopSeekCloser{strings.NewReader("defgh")},
+	)
+	s, ok := mr.(io.Seeker)
+	if !ok {
+		t.Fatalf("MultiReadCloser of seekers is not an io.Seeker")
+	}
+	tests := []struct {
+		offset int64
+		whence int
+
+		woff   int64
+		windex int
+		wpos   int64
+		wdata  string
+	}{
+		{1, io.SeekStart, 1, 0, 1, "bc"},
+		// the end of a reader is the start of the next non-empty one
+		{3, io.SeekStart, 3, 2, 0, "de"},
+		{-3, io.SeekCurrent, 2, 0, 2, "cd"},
+		{1, io.SeekCurrent, 5, 2, 2, "fg"},
+		{-1, io.SeekEnd, 7, 2, 4, "h"},
+		{0, io.SeekEnd, 8, 2, 5, ""},
+	}
+	for i, tt := range tests {
+		off, err := s.Seek(tt.offset, tt.whence)
+		if err != nil {
+			t.Fatalf("#%d: unexpected error %v", i, err)
+		}
+		if off != tt.woff {
+			t.Errorf("#%d: offset = %d, want %d", i, off, tt.woff)
+		}
+		index, pos := mr.Position()
+		if index != tt.windex || pos != tt.wpos {
+			t.Errorf("#%d: position = (%d, %d), want (%d, %d)", i, index, pos, tt.windex, tt.wpos)
+		}
+		b := make([]byte, len(tt.wdata))
+		if _, err = io.ReadFull(mr, b); err != nil {
+			t.Fatalf("#%d: unexpected error %v", i, err)
+		}
+		if string(b) != tt.wdata {
+			t.Errorf("#%d: data = %q, want %q", i, b, tt.wdata)
+		}
+	}
+	if _, err := s.Seek(-1, io.SeekStart); err != ErrInvalidPosition {
+		t.Errorf("err = %v, want %v", err, ErrInvalidPosition)
+	}
+
+	// readers that cannot seek make a MultiReadCloser that cannot either
+	mr = newMultiReader(nopSeekCloser{strings.NewReader("abc")}, ioutil.NopCloser(bytes.NewBufferString("def")))
+	if _, ok := mr.(io.Seeker); ok {
+		t.Errorf("MultiReadCloser of a non-seeker is an io.Seeker")
+	}
+}
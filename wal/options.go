@@ -0,0 +1,223 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"os"
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// An Option configures a WAL created by Create or opened by Open.
+type Option func(*options)
+
+type options struct {
+	checksum          Checksum
+	groupCommit       bool
+	groupCommitWindow time.Duration
+	observer          Observer
+	compression       Compression
+	crcWorkers        int
+	fileMode          os.FileMode
+	dirMode           os.FileMode
+	key               []byte
+	entryDecoder      func(e raftpb.Entry) (interface{}, error)
+	store             WALStore
+	writeBufferSize   int
+	timestamps        bool
+	appData           func(data []byte) error
+	strictNames       bool
+	padding           bool
+	maxRecordBytes    int64
+	preallocateBytes  int64
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		checksum:         ChecksumCRC32C,
+		fileMode:         0600,
+		dirMode:          privateDirMode,
+		store:            osStore{},
+		preallocateBytes: PreallocateBytes,
+		maxRecordBytes:   MaxRecordBytes,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithChecksum sets the algorithm used to checksum the records of the WAL.
+// The checksum is recorded in each WAL file, so the WAL can be opened
+// without specifying it, and the option is ignored by Open.
+func WithChecksum(c Checksum) Option {
+	return func(o *options) { o.checksum = c }
+}
+
+// WithGroupCommit makes concurrent Save calls share fsyncs. Each Save still
+// returns only after its records are synced, but a single fsync covers all
+// the Saves that are appended while the previous fsync is in flight, which
+// amortizes its cost under concurrent load. The records are appended in
+// the order of the Save calls. Save, SaveNoSync, Sync, SaveSnapshot and Cut
+// are safe for concurrent use in this mode.
+func WithGroupCommit() Option {
+	return func(o *options) { o.groupCommit = true }
+}
+
+// WithGroupCommitWindow enables group commit like WithGroupCommit, and
+// delays each fsync by the given window, so the Saves arriving in the
+// window share it too. It trades the latency of a single Save for fewer
+// fsyncs under concurrent load.
+func WithGroupCommitWindow(d time.Duration) Option {
+	return func(o *options) {
+		o.groupCommit = true
+		o.groupCommitWindow = d
+	}
+}
+
+// WithObserver sets the Observer notified of the writes to the WAL.
+func WithObserver(ob Observer) Option {
+	return func(o *options) { o.observer = ob }
+}
+
+// WithCompression sets the algorithm used to compress the entries appended
+// to the WAL. Entries that do not shrink are appended uncompressed. Each
+// record tells how it is compressed, so a WAL can be opened with another
+// compression, or none, and records compressed differently are read alike.
+func WithCompression(c Compression) Option {
+	return func(o *options) { o.compression = c }
+}
+
+// WithParallelCRC makes Save checksum the records of its entries on the
+// given number of goroutines, while the records checksummed are appended
+// in order. It speeds up saving batches of large entries on multi-core
+// machines. The records appended are the same as without it.
+func WithParallelCRC(workers int) Option {
+	return func(o *options) { o.crcWorkers = workers }
+}
+
+// WithFileMode sets the permission mode of the WAL files created, which is
+// 0600 by default, including the ones created by Cut after Open. The locks
+// are held on the WAL files themselves, so no lock files are created with
+// another mode. Create and Open fail with ErrWorldWritable if the mode
+// is world-writable.
+func WithFileMode(m os.FileMode) Option {
+	return func(o *options) { o.fileMode = m }
+}
+
+// WithDirMode sets the permission mode of the WAL directory created by
+// Create, which is 0700 by default. Create fails with ErrWorldWritable if
+// the mode is world-writable.
+func WithDirMode(m os.FileMode) Option {
+	return func(o *options) { o.dirMode = m }
+}
+
+// WithEncryptionKey encrypts the records appended to the WAL with AES-GCM
+// under the given key of EncryptionKeySize bytes. The checksums cover the
+// encrypted data, so they can be verified without the key. The key is not
+// recorded, and must be given to open an encrypted WAL: ReadAll fails with
+// ErrKeyRequired without it, and with ErrDecrypt if it is wrong.
+func WithEncryptionKey(key []byte) Option {
+	return func(o *options) { o.key = key }
+}
+
+// WithEntryDecoder makes Dump write the data of each entry as decoded by
+// fn, such as the protobuf message that the application stores in it,
+// instead of base64. The data that fn fails to decode is still written
+// in base64. The option is ignored by the other functions.
+func WithEntryDecoder(fn func(e raftpb.Entry) (interface{}, error)) Option {
+	return func(o *options) { o.entryDecoder = fn }
+}
+
+// WithStore makes the functions that only read the WAL files, such as
+// OpenReadOnly, OpenAtPosition, LastIndex, ValidSnapshotEntries and Dump,
+// read them from the given store instead of the local filesystem. The
+// option is ignored by the others.
+func WithStore(s WALStore) Option {
+	return func(o *options) { o.store = s }
+}
+
+// WithWriteBufferSize sets the size in bytes of the buffer that the records
+// appended are written through, which is 4096 bytes by default. A larger
+// buffer writes the records of large or batched entries to the file with
+// fewer write calls. The buffer is flushed whenever the WAL is synced, so
+// it does not weaken durability: Save still returns only after its records
+// are synced, while the records appended by SaveNoSync may stay in the
+// buffer until the next sync.
+func WithWriteBufferSize(n int) Option {
+	return func(o *options) { o.writeBufferSize = n }
+}
+
+// WithTimestamps records in each record appended the wall-clock time it is
+// written at, in nanoseconds since the Unix epoch, to tell when the entries
+// are persisted when debugging. Dump reports the timestamps, and ReadAll
+// ignores them. They are not covered by the checksums, and they follow the
+// system clock, so they may be zero, skewed or go backwards. WAL files are
+// unchanged without the option.
+func WithTimestamps() Option {
+	return func(o *options) { o.timestamps = true }
+}
+
+// WithAppData makes ReadAll and the other functions reading the records of
+// the WAL call fn with the data of each record saved by SaveAppData, in the
+// order they are read, from the WAL file that the reading starts with. If
+// fn returns an error, the reading stops and returns it. The application
+// data is skipped without the option.
+func WithAppData(fn func(data []byte) error) Option {
+	return func(o *options) { o.appData = fn }
+}
+
+// WithStrictNames makes Open fail with an *UnexpectedFilesError if the WAL
+// directory holds files that are not WAL files, once the files left by an
+// interrupted write are removed. Such files are otherwise ignored, and
+// listed by Inspect.
+func WithStrictNames() Option {
+	return func(o *options) { o.strictNames = true }
+}
+
+// WithPadding makes the WAL pad each record to an 8-byte boundary, and
+// checksum the length written before it. A length aligned this way is never
+// torn by a partial write, and its checksum tells a record cut short by a
+// crash apart from a corrupted one, so ReadAll returns a *TornTailError for
+// the former. Both are stored in the top byte of the length, which the
+// releases before them read as part of it, so they cannot read the WAL
+// files written with the option. The framing is recorded in each WAL file,
+// so the WAL can be opened without specifying it, and the option is ignored
+// by Open.
+func WithPadding() Option {
+	return func(o *options) { o.padding = true }
+}
+
+// WithMaxRecordBytes sets the maximum size of a record in bytes, which is
+// MaxRecordBytes by default, for a WAL whose entries may be larger or that
+// should bound the memory read records take to less. Saving a larger record
+// fails with ErrRecordTooLarge, and reading one is treated as corruption,
+// so a WAL must be opened with a limit at least as large as the one it is
+// written with. The option is ignored if n is not positive.
+func WithMaxRecordBytes(n int64) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.maxRecordBytes = n
+		}
+	}
+}
+
+// WithPreallocateBytes sets the number of bytes allocated on disk for each
+// WAL file created, which is PreallocateBytes by default. Set it to 0 to
+// disable preallocation.
+func WithPreallocateBytes(n int64) Option {
+	return func(o *options) { o.preallocateBytes = n }
+}
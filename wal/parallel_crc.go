@@ -0,0 +1,200 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"hash/crc32"
+	"hash/crc64"
+	"math/bits"
+	"sync"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// crcPolys are the reversed polynomials of the checksums.
+var crcPolys = map[Checksum]uint64{
+	ChecksumCRC32C:       crc32.Castagnoli,
+	ChecksumCRC32IEEE:    crc32.IEEE,
+	ChecksumCRC32Koopman: crc32.Koopman,
+	ChecksumCRC64ISO:     crc64.ISO,
+	ChecksumCRC64ECMA:    crc64.ECMA,
+}
+
+// sum returns the checksum of the data alone, not chained to any record.
+func (c Checksum) sum(data []byte) uint64 {
+	if c.wide() {
+		return crc64.Checksum(data, crc64Tables[c])
+	}
+	return uint64(crc32.Checksum(data, crcTables[c]))
+}
+
+// combiner combines the checksums of two consecutive pieces of data into
+// the checksum of their concatenation, as zlib's crc32_combine does.
+type combiner struct {
+	once sync.Once
+	// ops[k] is the operator in GF(2) that appends 2^k zero bytes to the
+	// data of a checksum.
+	ops [64][]uint64
+}
+
+var combiners = map[Checksum]*combiner{
+	ChecksumCRC32C:       {},
+	ChecksumCRC32IEEE:    {},
+	ChecksumCRC32Koopman: {},
+	ChecksumCRC64ISO:     {},
+	ChecksumCRC64ECMA:    {},
+}
+
+// combine returns the checksum of a and b concatenated, given the checksum
+// crc1 of a, and the checksum crc2 of b, which is n bytes long.
+func (c Checksum) combine(crc1, crc2 uint64, n int64) uint64 {
+	cb := combiners[c]
+	cb.once.Do(func() { cb.init(c) })
+	for k := 0; n > 0; k, n = k+1, n>>1 {
+		if n&1 != 0 {
+			crc1 = gf2MatrixTimes(cb.ops[k], crc1)
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func (cb *combiner) init(c Checksum) {
+	width := 32
+	if c.wide() {
+		width = 64
+	}
+	// the operator for one zero bit
+	op := make([]uint64, width)
+	op[0] = crcPolys[c]
+	for i := 1; i < width; i++ {
+		op[i] = 1 << uint(i-1)
+	}
+	// square it three times to get the operator for one zero byte
+	for i := 0; i < 3; i++ {
+		op = gf2MatrixSquare(op)
+	}
+	cb.ops[0] = op
+	for k := 1; k < len(cb.ops); k++ {
+		cb.ops[k] = gf2MatrixSquare(cb.ops[k-1])
+	}
+}
+
+// unchain returns the checksum that, chained with data of n bytes whose
+// own checksum is sum, gives end. It is the inverse of combine for crc1.
+func (c Checksum) unchain(end, sum uint64, n int64) (uint64, bool) {
+	width := 32
+	if c.wide() {
+		width = 64
+	}
+	// combine is linear in crc1, so solve the linear system in GF(2),
+	// whose columns are the combined unit vectors, by gaussian elimination.
+	// basis[p] is a reduced column with the highest bit p, together with
+	// the unit vectors it is combined from.
+	var basis [64]struct{ v, comb uint64 }
+	for i := 0; i < width; i++ {
+		v, comb := c.combine(1<<uint(i), 0, n), uint64(1)<<uint(i)
+		for v != 0 {
+			p := bits.Len64(v) - 1
+			if basis[p].v == 0 {
+				basis[p].v, basis[p].comb = v, comb
+				break
+			}
+			v, comb = v^basis[p].v, comb^basis[p].comb
+		}
+	}
+	var x uint64
+	for b := end ^ sum; b != 0; {
+		p := bits.Len64(b) - 1
+		if basis[p].v == 0 {
+			return 0, false
+		}
+		b, x = b^basis[p].v, x^basis[p].comb
+	}
+	return x, true
+}
+
+func gf2MatrixTimes(mat []uint64, vec uint64) uint64 {
+	var sum uint64
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+func gf2MatrixSquare(mat []uint64) []uint64 {
+	sq := make([]uint64, len(mat))
+	for i := range mat {
+		sq[i] = gf2MatrixTimes(mat, mat[i])
+	}
+	return sq
+}
+
+// saveEntriesParallel saves the entries like saveEntry does, but checksums
+// their records on w.crcWorkers goroutines. The records are appended in
+// order as soon as their checksums are ready, so checksumming the later
+// records overlaps with appending the earlier ones. The checksums are
+// chained exactly as if they were computed one after another.
+func (w *WAL) saveEntriesParallel(ents []raftpb.Entry) error {
+	recs := make([]*walpb.Record, len(ents))
+	for i := range ents {
+		rec, err := w.entryRecord(&ents[i])
+		if err != nil {
+			return err
+		}
+		recs[i] = rec
+	}
+	sums := make([]uint64, len(recs))
+	done := make([]chan struct{}, len(recs))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	next := make(chan int, len(recs))
+	for i := range recs {
+		next <- i
+	}
+	close(next)
+	workers := w.crcWorkers
+	if workers > len(recs) {
+		workers = len(recs)
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for i := range next {
+				sums[i] = w.checksum.sum(recs[i].Data)
+				close(done[i])
+			}
+		}()
+	}
+
+	for i, rec := range recs {
+		<-done[i]
+		prev := w.encoder.crc.Sum64()
+		sum := w.checksum.combine(prev, sums[i], int64(len(rec.Data)))
+		eo := entryOffset{index: ents[i].Index, off: w.off, crc: prev, state: w.state, frames: w.encoder.frameSum()}
+		if err := w.encoder.encodeChained(rec, sum); err != nil {
+			// let the workers finish before returning
+			for _, d := range done[i+1:] {
+				<-d
+			}
+			return err
+		}
+		w.appended(rec)
+		w.entrySaved(ents[i].Index, eo)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestChecksumCombine(t *testing.T) {
+	cs := []Checksum{ChecksumCRC32C, ChecksumCRC32IEEE, ChecksumCRC32Koopman, ChecksumCRC64ISO, ChecksumCRC64ECMA}
+	r := rand.New(rand.NewSource(1))
+	for _, c := range cs {
+		for _, n := range []int{0, 1, 7, 100, 4096, 100000} {
+			data := make([]byte, n)
+			r.Read(data)
+			prev := c.sum([]byte("previous records"))
+			h := c.newHash(prev)
+			h.Write(data)
+			if g, w := c.combine(prev, c.sum(data), int64(n)), h.Sum64(); g != w {
+				t.Errorf("checksum %d, len %d: combined = %#x, want %#x", c, n, g, w)
+			}
+		}
+	}
+}
+
+func TestSaveParallelCRC(t *testing.T) {
+	cs := []Checksum{ChecksumCRC32C, ChecksumCRC64ISO}
+	r := rand.New(rand.NewSource(1))
+	var ents []raftpb.Entry
+	for i := 1; i <= 20; i++ {
+		data := make([]byte, r.Intn(10000))
+		r.Read(data)
+		ents = append(ents, raftpb.Entry{Index: uint64(i), Term: 1, Data: data})
+	}
+
+	for _, c := range cs {
+		var files [2][]byte
+		for i, workers := range []int{0, 4} {
+			p, err := ioutil.TempDir(os.TempDir(), "waltest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(p)
+			w, err := Create(p, []byte("metadata"), WithChecksum(c), WithParallelCRC(workers))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = w.Save(raftpb.HardState{Term: 1, Commit: 1}, ents[:10]); err != nil {
+				t.Fatal(err)
+			}
+			if err = w.Save(raftpb.HardState{Term: 1, Commit: 10}, ents[10:]); err != nil {
+				t.Fatal(err)
+			}
+			w.Close()
+			if files[i], err = ioutil.ReadFile(path.Join(p, walName(0, 0))); err != nil {
+				t.Fatal(err)
+			}
+
+			if w, err = Open(p, walpb.Snapshot{}); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, _, err = w.ReadAll(); err != nil {
+				t.Errorf("checksum %d, workers %d: err = %v, want nil", c, workers, err)
+			}
+			w.Close()
+		}
+		if !bytes.Equal(files[0], files[1]) {
+			t.Errorf("checksum %d: the files written in parallel differ", c)
+		}
+	}
+}
+
+func TestChecksumUnchain(t *testing.T) {
+	cs := []Checksum{ChecksumCRC32C, ChecksumCRC32IEEE, ChecksumCRC32Koopman, ChecksumCRC64ISO, ChecksumCRC64ECMA}
+	r := rand.New(rand.NewSource(1))
+	for _, c := range cs {
+		for _, n := range []int{0, 1, 100, 4096} {
+			data := make([]byte, n)
+			r.Read(data)
+			prev := c.sum([]byte("previous records"))
+			h := c.newHash(prev)
+			h.Write(data)
+			g, ok := c.unchain(h.Sum64(), c.sum(data), int64(n))
+			if !ok || g != prev {
+				t.Errorf("checksum %d, len %d: unchained = %#x, %v, want %#x, true", c, n, g, ok, prev)
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+)
+
+// Purge removes the oldest WAL files in the given directory until at most
+// keep files remain, and returns the names of the removed files.
+// A file locked by a WAL is never removed, and Purge stops at the first
+// locked file. A WAL keeps the file that covers its last released index
+// and all the files after it locked, so the files needed to open the WAL
+// at its last saved snapshot are always retained.
+func Purge(dirpath string, keep int) ([]string, error) {
+	names, err := fileutil.ReadDir(dirpath)
+	if err != nil {
+		return nil, err
+	}
+	names = checkWalNames(names)
+
+	var purged []string
+	for len(names) > keep {
+		err := purgeFile(filepath.Join(dirpath, names[0]))
+		if err == fileutil.ErrLocked {
+			break
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged = append(purged, names[0])
+		names = names[1:]
+	}
+	return purged, nil
+}
+
+// PurgeTo is similar to ReleaseLockTo, but also removes the WAL files whose
+// locks are released, so the disk space is reclaimed once their entries
+// are covered by a snapshot. The file being appended and the file that
+// covers the given index are kept. A file still locked by another WAL is
+// not removed, and PurgeTo returns a *LockedError for it. It returns the
+// base names of the removed files.
+func (w *WAL) PurgeTo(index uint64) ([]string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.releaseCount(index)
+	if err != nil {
+		return nil, err
+	}
+	var purged []string
+	dirs := make(map[string]bool)
+	for i, l := range w.locks[:n] {
+		f := l.Name()
+		if err = l.Unlock(); err == nil {
+			err = l.Destroy()
+		}
+		if err == nil {
+			err = purgeFile(f)
+		}
+		if err == fileutil.ErrLocked {
+			err = &LockedError{File: filepath.Base(f), PID: fileutil.LockOwner(f)}
+		}
+		if err != nil {
+			w.locks = w.locks[i+1:]
+			return purged, err
+		}
+		purged = append(purged, filepath.Base(f))
+		dirs[filepath.Dir(f)] = true
+	}
+	w.locks = w.locks[n:]
+	for dir := range dirs {
+		if err = syncDir(dir); err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// purgeFile removes the WAL file at the given path. It returns
+// fileutil.ErrLocked without removing it if the file is locked.
+func purgeFile(f string) error {
+	l, err := fileutil.NewLock(f)
+	if err != nil {
+		return err
+	}
+	if err = l.TryLock(); err != nil {
+		l.Destroy()
+		return err
+	}
+	if err = os.Remove(f); err != nil {
+		l.Unlock()
+		l.Destroy()
+		return err
+	}
+	if err = l.Unlock(); err != nil {
+		logger.Warningf("wal: unlock %s error: %v", f, err)
+	}
+	if err = l.Destroy(); err != nil {
+		logger.Warningf("wal: destroy lock %s error: %v", f, err)
+	}
+	logger.Printf("wal: purged file %s", f)
+	return nil
+}
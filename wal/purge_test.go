@@ -0,0 +1,177 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestPurge(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i := 1; i <= 5; i++ {
+		es := []raftpb.Entry{{Index: uint64(i)}}
+		if err = w.Save(raftpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.SaveSnapshot(walpb.Snapshot{Index: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.ReleaseLockTo(3); err != nil {
+		t.Fatal(err)
+	}
+
+	// no file is purged if the files to keep are more than the existing ones
+	purged, err := Purge(p, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 0 {
+		t.Errorf("purged = %v, want []", purged)
+	}
+
+	// the file covering index 3 and the files after it are still locked
+	purged, err = Purge(p, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wpurged := []string{walName(0, 0), walName(1, 2)}
+	if !reflect.DeepEqual(purged, wpurged) {
+		t.Errorf("purged = %v, want %v", purged, wpurged)
+	}
+	names, err := fileutil.ReadDir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wnames := []string{walName(2, 3), walName(3, 4), walName(4, 5), walName(5, 6)}
+	if !reflect.DeepEqual(names, wnames) {
+		t.Errorf("names = %v, want %v", names, wnames)
+	}
+	w.Close()
+
+	w, err = Open(p, walpb.Snapshot{Index: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 2 {
+		t.Errorf("len(ents) = %d, want 2", len(ents))
+	}
+	w.Close()
+}
+
+func TestPurgeTo(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i := 1; i <= 5; i++ {
+		es := []raftpb.Entry{{Index: uint64(i)}}
+		if err = w.Save(raftpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.SaveSnapshot(walpb.Snapshot{Index: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file covering index 3 and the files after it are kept
+	purged, err := w.PurgeTo(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wpurged := []string{walName(0, 0), walName(1, 2)}
+	if !reflect.DeepEqual(purged, wpurged) {
+		t.Errorf("purged = %v, want %v", purged, wpurged)
+	}
+	names, err := fileutil.ReadDir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wnames := []string{walName(2, 3), walName(3, 4), walName(4, 5), walName(5, 6)}
+	if !reflect.DeepEqual(names, wnames) {
+		t.Errorf("names = %v, want %v", names, wnames)
+	}
+	if g := w.LockedFiles(); !reflect.DeepEqual(g, wnames) {
+		t.Errorf("locked files = %v, want %v", g, wnames)
+	}
+
+	// a file locked by another WAL once released is not removed
+	w.locks[1].Unlock()
+	l, err := fileutil.NewLock(filepath.Join(p, walName(3, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Destroy()
+	if err = l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	purged, err = w.PurgeTo(100)
+	if _, ok := err.(*LockedError); !ok {
+		t.Fatalf("err = %v, want a *LockedError", err)
+	}
+	if wpurged = []string{walName(2, 3)}; !reflect.DeepEqual(purged, wpurged) {
+		t.Errorf("purged = %v, want %v", purged, wpurged)
+	}
+	if _, err = os.Stat(filepath.Join(p, walName(3, 4))); err != nil {
+		t.Errorf("err = %v, want the locked file kept", err)
+	}
+	l.Unlock()
+
+	// the file being appended is never removed
+	if purged, err = w.PurgeTo(100); err != nil {
+		t.Fatal(err)
+	}
+	if wpurged = []string{walName(4, 5)}; !reflect.DeepEqual(purged, wpurged) {
+		t.Errorf("purged = %v, want %v", purged, wpurged)
+	}
+	if g, wlocked := w.LockedFiles(), []string{walName(5, 6)}; !reflect.DeepEqual(g, wlocked) {
+		t.Errorf("locked files = %v, want %v", g, wlocked)
+	}
+}
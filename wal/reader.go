@@ -0,0 +1,88 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// Reader returns a read-only WAL reading the records of w from the given
+// snapshot on, which can be read while w is appended to. It is opened like
+// OpenReadOnly, but only reads the records that w has synced so far, so it
+// never observes a record that may be lost on a crash. It does not take
+// the locks of w, and is closed independently of w. Only the WAL files in
+// the directory of w are read. A Truncate of w that discards records the
+// reader has not read yet may make its reading fail. w must be in append
+// mode, or Reader returns ErrNotAppending.
+func (w *WAL) Reader(from walpb.Snapshot) (*WAL, error) {
+	// the decoder is set until all the records are read
+	if w.readOnly || w.decoder != nil {
+		return nil, ErrNotAppending
+	}
+	w.mu.Lock()
+	s := syncedStore{seq: w.syncedSeq, off: w.syncedOff}
+	w.mu.Unlock()
+	r, err := OpenReadOnly(w.dir, from, WithStore(s), WithMaxRecordBytes(w.maxBytes))
+	if err != nil {
+		return nil, err
+	}
+	r.decoder.aead = w.aead
+	return r, nil
+}
+
+// syncedStore is the WALStore of a Reader, which reads the WAL files of the
+// local filesystem up to the offset their WAL is synced up to.
+type syncedStore struct {
+	seq uint64 // sequence of the last file synced
+	off int64  // offset the last file synced is synced up to
+}
+
+func (s syncedStore) ReadDir(dirpath string) ([]string, error) {
+	names, err := fileutil.ReadDir(dirpath)
+	if err != nil {
+		return nil, err
+	}
+	synced := names[:0]
+	for _, name := range names {
+		// the files cut after the last sync are not synced
+		if seq, _, err := parseWalName(name); err == nil && seq > s.seq {
+			continue
+		}
+		synced = append(synced, name)
+	}
+	return synced, nil
+}
+
+func (s syncedStore) Open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if seq, _, err := parseWalName(filepath.Base(path)); err == nil && seq == s.seq {
+		return limitedFile{io.LimitReader(f, s.off), f}, nil
+	}
+	return f, nil
+}
+
+// limitedFile reads a file up to a limit.
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
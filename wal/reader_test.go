@@ -0,0 +1,155 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestReaderWhileAppending(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	const n = 200
+	errc := make(chan error, 1)
+	go func() {
+		for i := 1; i <= n; i++ {
+			es := []raftpb.Entry{{Index: uint64(i), Term: 1, Data: []byte("data")}}
+			if err := w.Save(raftpb.HardState{Term: 1, Commit: uint64(i)}, es); err != nil {
+				errc <- err
+				return
+			}
+			if i%20 == 0 {
+				if err := w.Cut(); err != nil {
+					errc <- err
+					return
+				}
+			}
+		}
+		errc <- nil
+	}()
+
+	// each reader sees a prefix of the entries, at least as long as the
+	// one seen before
+	var last int
+	for done := false; !done || last < n; {
+		select {
+		case err = <-errc:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		default:
+		}
+		r, err := w.Reader(walpb.Snapshot{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata, _, ents, err := r.ReadAll()
+		r.Close()
+		if err != nil {
+			t.Fatalf("after %d entries: err = %v", last, err)
+		}
+		if !reflect.DeepEqual(metadata, []byte("metadata")) {
+			t.Fatalf("metadata = %s, want %s", metadata, "metadata")
+		}
+		if len(ents) < last {
+			t.Fatalf("len(ents) = %d, want at least %d", len(ents), last)
+		}
+		for i, e := range ents {
+			if e.Index != uint64(i+1) {
+				t.Fatalf("index = %d, want %d", e.Index, i+1)
+			}
+		}
+		last = len(ents)
+		if done && last < n {
+			t.Fatalf("len(ents) = %d, want %d", last, n)
+		}
+	}
+}
+
+func TestReaderUnsynced(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}}
+	if err = w.Save(raftpb.HardState{Term: 1, Commit: 1}, ents[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveNoSync(raftpb.HardState{Term: 1, Commit: 2}, ents[1:]); err != nil {
+		t.Fatal(err)
+	}
+	for i, wents := range [][]raftpb.Entry{ents[:1], ents} {
+		if i == 1 {
+			if err = w.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r, err := w.Reader(walpb.Snapshot{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, got, err := r.ReadAll()
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, wents) {
+			t.Errorf("#%d: ents = %+v, want %+v", i, got, wents)
+		}
+	}
+	w.Close()
+
+	// the WAL is in read mode before ReadAll
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err = w.Reader(walpb.Snapshot{}); err != ErrNotAppending {
+		t.Errorf("err = %v, want %v", err, ErrNotAppending)
+	}
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := w.Reader(walpb.Snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, _, got, err := r.ReadAll(); err != nil || !reflect.DeepEqual(got, ents) {
+		t.Errorf("ents, err = %+v, %v, want %+v, nil", got, err, ents)
+	}
+}
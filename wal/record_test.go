@@ -16,10 +16,12 @@ package wal
 
 import (
 	"bytes"
+	"errors"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"reflect"
+	"runtime"
 	"testing"
 
 	"github.com/coreos/etcd/wal/walpb"
@@ -42,6 +44,7 @@ func TestReadRecord(t *testing.T) {
 	}{
 		{infoRecord, &walpb.Record{Type: 1, Crc: crc32.Checksum(infoData, crcTable), Data: infoData}, nil},
 		{[]byte(""), &walpb.Record{}, io.EOF},
+		{make([]byte, 16), &walpb.Record{}, io.EOF},
 		{infoRecord[:len(infoRecord)-len(infoData)-8], &walpb.Record{}, io.ErrUnexpectedEOF},
 		{infoRecord[:len(infoRecord)-len(infoData)], &walpb.Record{}, io.ErrUnexpectedEOF},
 		{infoRecord[:len(infoRecord)-8], &walpb.Record{}, io.ErrUnexpectedEOF},
@@ -56,7 +59,9 @@ func TestReadRecord(t *testing.T) {
 		if !reflect.DeepEqual(rec, tt.wr) {
 			t.Errorf("#%d: block = %v, want %v", i, rec, tt.wr)
 		}
-		if !reflect.DeepEqual(e, tt.we) {
+		// the errors of corrupted records are annotated with their
+		// location
+		if !errors.Is(e, tt.we) {
 			t.Errorf("#%d: err = %v, want %v", i, e, tt.we)
 		}
 		rec = &walpb.Record{}
@@ -68,7 +73,7 @@ func TestWriteRecord(t *testing.T) {
 	typ := int64(0xABCD)
 	d := []byte("Hello world!")
 	buf := new(bytes.Buffer)
-	e := newEncoder(buf, 0)
+	e := newEncoder(buf, 0, ChecksumCRC32C)
 	e.encode(&walpb.Record{Type: typ, Data: d})
 	e.flush()
 	decoder := newDecoder(ioutil.NopCloser(buf))
@@ -83,3 +88,126 @@ func TestWriteRecord(t *testing.T) {
 		t.Errorf("data = %v, want %v", b.Data, d)
 	}
 }
+
+func TestReadRecordTooLarge(t *testing.T) {
+	// a record that claims to be 2GB long
+	buf := new(bytes.Buffer)
+	writeInt64(buf, 2<<30)
+	buf.Write(make([]byte, 100))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	decoder := newDecoder(ioutil.NopCloser(buf))
+	err := decoder.decode(&walpb.Record{})
+	runtime.ReadMemStats(&after)
+
+	werr := &RecordTooLargeError{Offset: 0, Size: 2 << 30, Max: MaxRecordBytes}
+	if !reflect.DeepEqual(err, werr) {
+		t.Errorf("err = %v, want %v", err, werr)
+	}
+	if !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("errors.Is(%v, ErrRecordTooLarge) = false, want true", err)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("allocated %d bytes, want less than %d", n, 1<<20)
+	}
+}
+
+func TestWriteRecordTooLarge(t *testing.T) {
+	e := newEncoder(new(bytes.Buffer), 0, ChecksumCRC32C)
+	e.maxBytes = 1024
+	if err := e.encode(&walpb.Record{Type: entryType, Data: make([]byte, 1024)}); err != ErrRecordTooLarge {
+		t.Errorf("err = %v, want %v", err, ErrRecordTooLarge)
+	}
+}
+
+func TestFrameSize(t *testing.T) {
+	frame := func(top, n uint64) int64 { return int64(top<<56 | n) }
+	// crcFrame is a length field that carries its checksum
+	crcFrame := func(top, n uint64) int64 {
+		lf := uint64(frame(top, n))
+		return int64(lf | lengthCrc(lf)<<lenCrcShift)
+	}
+	tests := []struct {
+		dataBytes int
+
+		wlenField int64
+		wpad      int
+	}{
+		{8, crcFrame(0x40, 8), 0},
+		{16, crcFrame(0x40, 16), 0},
+		{1, crcFrame(0xc7, 1), 7},
+		{7, crcFrame(0xc1, 7), 1},
+		{14, crcFrame(0xc2, 14), 2},
+	}
+	for i, tt := range tests {
+		lenField, pad := encodeFrameSize(tt.dataBytes)
+		if lenField != tt.wlenField || pad != tt.wpad {
+			t.Errorf("#%d: frame = %#x, %d, want %#x, %d", i, lenField, pad, tt.wlenField, tt.wpad)
+		}
+		l, p, ok := decodeFrameSize(lenField)
+		if !ok || l != int64(tt.dataBytes) || p != int64(tt.wpad) {
+			t.Errorf("#%d: size = %d, %d, %v, want %d, %d, true", i, l, p, ok, tt.dataBytes, tt.wpad)
+		}
+		if n := frameSize(tt.dataBytes, true); n%8 != 0 {
+			t.Errorf("#%d: frame size = %d, want a multiple of 8", i, n)
+		}
+		// a flipped bit is detected, or gives a length too large
+		for bit := uint(0); bit < 64; bit++ {
+			l, _, ok := decodeFrameSize(lenField ^ 1<<bit)
+			if ok && l <= MaxRecordBytes {
+				t.Errorf("#%d: flipped bit %d decodes to size %d", i, bit, l)
+			}
+		}
+	}
+
+	// the length fields of older WAL files have no checksum
+	oldTests := []struct {
+		lenField int64
+
+		wsize, wpad int64
+	}{
+		{frame(0, 8), 8, 0},
+		{frame(0x87, 1), 1, 7},
+		{frame(0x82, 14), 14, 2},
+	}
+	for i, tt := range oldTests {
+		l, p, ok := decodeFrameSize(tt.lenField)
+		if !ok || l != tt.wsize || p != tt.wpad {
+			t.Errorf("#%d: size = %d, %d, %v, want %d, %d, true", i, l, p, ok, tt.wsize, tt.wpad)
+		}
+	}
+
+	// the top byte is not a valid padding
+	for i, top := range []uint64{0x80, 0x88, 0x01, 0xff} {
+		if _, _, ok := decodeFrameSize(frame(top, 8)); ok {
+			t.Errorf("#%d: ok = true for top byte %#x, want false", i, top)
+		}
+	}
+}
+
+func TestReadPaddedAfterUnpaddedRecord(t *testing.T) {
+	d := []byte("Hello world!")
+	buf := bytes.NewBuffer(append([]byte{}, infoRecord...))
+	e := newEncoder(buf, uint64(crc32.Checksum(infoData, crcTable)), ChecksumCRC32C)
+	e.padded = true
+	if err := e.encode(&walpb.Record{Type: entryType, Data: d}); err != nil {
+		t.Fatal(err)
+	}
+	e.flush()
+	if n := buf.Len() - len(infoRecord); n%8 != 0 {
+		t.Errorf("record size = %d, want a multiple of 8", n)
+	}
+
+	decoder := newDecoder(ioutil.NopCloser(buf))
+	rec := &walpb.Record{}
+	if err := decoder.decode(rec); err != nil || !reflect.DeepEqual(rec.Data, infoData) {
+		t.Fatalf("data = %v, %v, want %v, nil", rec.Data, err, infoData)
+	}
+	if err := decoder.decode(rec); err != nil || !reflect.DeepEqual(rec.Data, d) {
+		t.Fatalf("data = %v, %v, want %v, nil", rec.Data, err, d)
+	}
+	if err := decoder.decode(rec); err != io.EOF {
+		t.Errorf("err = %v, want %v", err, io.EOF)
+	}
+}
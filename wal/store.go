@@ -0,0 +1,54 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"io"
+	"os"
+	"sort"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+)
+
+// WALStore is the storage that the files of a WAL are read from by the
+// functions that only read them, such as OpenReadOnly, so a WAL can be
+// read from a remote storage, an archive or memory. The files are opened
+// at the paths made by joining the directory and the names returned by
+// ReadDir. The WAL files are still written and locked through the local
+// filesystem.
+type WALStore interface {
+	// ReadDir returns the names of the files in the given directory.
+	ReadDir(dirpath string) ([]string, error)
+	// Open opens the file at the given path for reading.
+	Open(path string) (io.ReadCloser, error)
+}
+
+// osStore is the default WALStore, which reads the local filesystem.
+type osStore struct{}
+
+func (osStore) ReadDir(dirpath string) ([]string, error) { return fileutil.ReadDir(dirpath) }
+
+func (osStore) Open(path string) (io.ReadCloser, error) { return os.Open(path) }
+
+// readDir returns the names of the files in the given directory of the
+// store, in sorted order.
+func readDir(s WALStore, dirpath string) ([]string, error) {
+	names, err := s.ReadDir(dirpath)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
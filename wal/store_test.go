@@ -0,0 +1,110 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/pkg/pbutil"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// memStore is a WALStore that holds the files in memory, keyed by path.
+type memStore map[string][]byte
+
+func (s memStore) ReadDir(dirpath string) ([]string, error) {
+	var names []string
+	for path := range s {
+		if filepath.Dir(path) == dirpath {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	return names, nil
+}
+
+func (s memStore) Open(path string) (io.ReadCloser, error) {
+	b, ok := s[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func TestOpenReadOnlyWithStore(t *testing.T) {
+	state := raftpb.HardState{Term: 1, Commit: 2}
+	ents := []raftpb.Entry{{Index: 1, Term: 1, Data: []byte("a")}, {Index: 2, Term: 1, Data: []byte("b")}}
+
+	// encode the records of a WAL file in memory
+	var buf bytes.Buffer
+	e := newEncoder(&buf, 0, ChecksumCRC32C)
+	recs := []*walpb.Record{
+		{Type: crcType, Data: formatData(ChecksumCRC32C, false)},
+		{Type: metadataType, Data: []byte("metadata")},
+		{Type: snapshotType, Data: pbutil.MustMarshal(&walpb.Snapshot{})},
+		{Type: stateType, Data: pbutil.MustMarshal(&state)},
+	}
+	for i := range ents {
+		recs = append(recs, &walpb.Record{Type: entryType, Data: pbutil.MustMarshal(&ents[i])})
+	}
+	for _, rec := range recs {
+		if err := e.encode(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+	s := memStore{
+		filepath.Join("remote", walName(0, 0)): buf.Bytes(),
+		filepath.Join("remote", "README"):      []byte("not a WAL file"),
+	}
+
+	w, err := OpenReadOnly("remote", walpb.Snapshot{}, WithStore(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	metadata, st, entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "metadata")
+	}
+	if !reflect.DeepEqual(st, state) {
+		t.Errorf("state = %+v, want %+v", st, state)
+	}
+	if !reflect.DeepEqual(entries, ents) {
+		t.Errorf("ents = %+v, want %+v", entries, ents)
+	}
+
+	index, err := LastIndex("remote", WithStore(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 2 {
+		t.Errorf("last index = %d, want 2", index)
+	}
+	if _, err = OpenReadOnly("missing", walpb.Snapshot{}, WithStore(s)); err != ErrFileNotFound {
+		t.Errorf("err = %v, want %v", err, ErrFileNotFound)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// TruncateAfter discards the entries after the given index, together with
+// all the records appended after the first of them, so that no entry after
+// the index remains on disk. Unlike Truncate, the index may be in a file
+// older than the one being appended: the files that start after the index
+// are removed and unlocked. A file finalized by Cut is never appended to
+// again, so the one that covers the index is truncated and finalized anew,
+// and a new file is created after it, with a fresh header of the crc, the
+// metadata and the state. The state is rolled back to the one saved before
+// the first discarded entry, with its commit index lowered to the index if
+// it is after it. It is meant for recovery, right after ReadAll
+// and before appending. It returns ErrTruncateSnapshot if the index is
+// before the last snapshot read or saved.
+func (w *WAL) TruncateAfter(index uint64) error {
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if w.encoder == nil {
+		return ErrNotAppending
+	}
+	if index < w.snapi {
+		return ErrTruncateSnapshot
+	}
+	w.lockAppend()
+	defer w.unlockAppend()
+	w.mu.Lock()
+	locks := append([]fileutil.Lock(nil), w.locks...)
+	w.mu.Unlock()
+	names := lockNames(locks)
+	i, ok := searchIndex(names, index+1)
+	if !ok {
+		return ErrFileNotFound
+	}
+	if i == len(names)-1 {
+		return w.truncate(index)
+	}
+
+	fpath := locks[i].Name()
+	offs, end, err := w.scanEntries(fpath)
+	if err != nil {
+		return err
+	}
+	// cut the file at the first entry after index, or at its footer
+	j := len(offs)
+	for j > 0 && offs[j-1].index > index {
+		j--
+	}
+	if j < len(offs) {
+		end = offs[j]
+	}
+	seq, _, err := parseWalName(names[i])
+	if err != nil {
+		return err
+	}
+
+	// remove the newer files first, so that a crash leaves the file
+	// covering the index whole, with the crc chain intact
+	if err = w.closeFile(); err != nil {
+		return err
+	}
+	w.f = nil
+	if err = w.removeFilesAfter(i); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(end.off); err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.seq = f, seq
+	w.encoder = w.newEncoder(w.f, end.crc)
+	w.encoder.resumeFrames(end.frames)
+	w.off, w.entryOffs = end.off, nil
+	w.enti, w.state = index, clampCommit(end.state, index)
+	if err = w.finalize(); err != nil {
+		return err
+	}
+	if f, err = w.createNext(); err != nil {
+		return err
+	}
+	return w.startFile(f)
+}
+
+// removeFilesAfter removes the files locked after the i-th one, from the
+// newest, and releases their locks.
+func (w *WAL) removeFilesAfter(i int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for n := len(w.locks) - 1; n > i; n-- {
+		l := w.locks[n]
+		if err := os.Remove(l.Name()); err != nil {
+			return err
+		}
+		if err := syncDir(filepath.Dir(l.Name())); err != nil {
+			return err
+		}
+		w.locks = w.locks[:n]
+		if err := l.Unlock(); err != nil {
+			return err
+		}
+		if err := l.Destroy(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanEntries decodes the WAL file at fpath, and returns the locations of
+// its entries, and the location where its records end, which is before its
+// footer if it is finalized.
+func (w *WAL) scanEntries(fpath string) ([]entryOffset, entryOffset, error) {
+	var (
+		offs []entryOffset
+		end  entryOffset
+	)
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, end, err
+	}
+	d := newDecoder(f)
+	defer d.close()
+	d.names = []string{filepath.Base(fpath)}
+	d.aead, d.maxBytes = w.aead, w.maxBytes
+	rec := &walpb.Record{}
+	for {
+		prevCrc, prevFrames := d.lastCRC(), d.frameSum()
+		if err = d.decode(rec); err != nil {
+			break
+		}
+		switch rec.Type {
+		case crcType:
+			d.updateCRC(recordCrc(rec))
+		case stateType:
+			end.state.Reset()
+			if err = unmarshal(&end.state, rec.Data); err != nil {
+				return nil, end, d.decodeError(rec.Type, err)
+			}
+		case entryType:
+			var e raftpb.Entry
+			if err = unmarshal(&e, rec.Data); err != nil {
+				return nil, end, d.decodeError(rec.Type, err)
+			}
+			offs = append(offs, entryOffset{index: e.Index, off: d.lastOff, crc: prevCrc, state: end.state, frames: prevFrames})
+		}
+		// the footer is consumed by the decode that returns io.EOF, so
+		// the end is left before it
+		end.off, end.crc, end.frames = d.off, d.lastCRC(), d.frameSum()
+	}
+	if err != io.EOF {
+		return nil, end, err
+	}
+	return offs, end, nil
+}
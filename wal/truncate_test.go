@@ -0,0 +1,196 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+func TestTruncateAfter(t *testing.T) {
+	tests := []struct {
+		index uint64
+
+		wnames []string
+	}{
+		// in the file being appended
+		{7, []string{walName(0, 0), walName(1, 4), walName(2, 7)}},
+		// at the boundary of the files
+		{6, []string{walName(0, 0), walName(1, 4), walName(2, 7)}},
+		// in an older file, which is finalized again and followed by
+		// a new file
+		{3, []string{walName(0, 0), walName(1, 4), walName(2, 4)}},
+		{5, []string{walName(0, 0), walName(1, 4), walName(2, 6)}},
+		{1, []string{walName(0, 0), walName(1, 2)}},
+	}
+	for i, tt := range tests {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := Create(p, []byte("metadata"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ents []raftpb.Entry
+		for idx := uint64(1); idx <= 8; idx++ {
+			e := raftpb.Entry{Index: idx, Term: 1}
+			if err = w.Save(raftpb.HardState{Term: 1, Commit: idx}, []raftpb.Entry{e}); err != nil {
+				t.Fatal(err)
+			}
+			ents = append(ents, e)
+			if idx%3 == 0 {
+				if err = w.Cut(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		w.Close()
+
+		if w, err = Open(p, walpb.Snapshot{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err = w.ReadAll(); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.TruncateAfter(tt.index); err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		if names := w.LockedFiles(); !reflect.DeepEqual(names, tt.wnames) {
+			t.Errorf("#%d: locked files = %v, want %v", i, names, tt.wnames)
+		}
+		// appending continues with the crc chained correctly
+		e := raftpb.Entry{Index: tt.index + 1, Term: 2}
+		if err = w.Save(raftpb.HardState{Term: 2, Commit: tt.index}, []raftpb.Entry{e}); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+
+		names, err := fileutil.ReadDir(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, tt.wnames) {
+			t.Errorf("#%d: names = %v, want %v", i, names, tt.wnames)
+		}
+		if w, err = Open(p, walpb.Snapshot{}); err != nil {
+			t.Fatal(err)
+		}
+		_, st, entries, err := w.ReadAll()
+		if err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		wents := append(append([]raftpb.Entry{}, ents[:tt.index]...), e)
+		if !reflect.DeepEqual(entries, wents) {
+			t.Errorf("#%d: ents = %+v, want %+v", i, entries, wents)
+		}
+		if wst := (raftpb.HardState{Term: 2, Commit: tt.index}); !reflect.DeepEqual(st, wst) {
+			t.Errorf("#%d: state = %+v, want %+v", i, st, wst)
+		}
+		w.Close()
+		// the footers of the files finalized again match their records
+		if err = Verify(p); err != nil {
+			t.Errorf("#%d: verify err = %v, want nil", i, err)
+		}
+		os.RemoveAll(p)
+	}
+}
+
+func TestTruncateAfterState(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx := uint64(1); idx <= 4; idx++ {
+		st := raftpb.HardState{Term: 1, Commit: idx}
+		if err = w.Save(st, []raftpb.Entry{{Index: idx, Term: 1}}); err != nil {
+			t.Fatal(err)
+		}
+		if idx == 2 {
+			if err = w.Cut(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	// the state is rolled back to the one saved right before entry 2,
+	// which Save appends ahead of it, with its commit index clamped to
+	// the index
+	if err = w.TruncateAfter(1); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, st, entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wents := []raftpb.Entry{{Index: 1, Term: 1}}; !reflect.DeepEqual(entries, wents) {
+		t.Errorf("ents = %+v, want %+v", entries, wents)
+	}
+	if wst := (raftpb.HardState{Term: 1, Commit: 1}); !reflect.DeepEqual(st, wst) {
+		t.Errorf("state = %+v, want %+v", st, wst)
+	}
+}
+
+func TestTruncateAfterSnapshot(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ents := []raftpb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}}
+	if err = w.Save(raftpb.HardState{}, ents); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveSnapshot(walpb.Snapshot{Index: 2, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.TruncateAfter(1); err != ErrTruncateSnapshot {
+		t.Errorf("err = %v, want %v", err, ErrTruncateSnapshot)
+	}
+	if err = w.TruncateAfter(2); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
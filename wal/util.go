@@ -15,15 +15,25 @@
 package wal
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/coreos/etcd/pkg/fileutil"
 	"github.com/coreos/etcd/pkg/types"
 )
 
+var (
+	// indirection for testing
+	syncDir         = fileutil.SyncDir
+	preallocateFile = fileutil.Preallocate
+)
+
 // WalVersion is an enum for versions of etcd logs.
 type WalVersion string
 
@@ -49,8 +59,9 @@ func DetectVersion(dirpath string) (WalVersion, error) {
 	}
 	nameSet := types.NewUnsafeSet(names...)
 	if nameSet.ContainsAll([]string{"snap", "wal"}) {
-		// .../wal cannot be empty to exist.
-		if Exist(path.Join(dirpath, "wal")) {
+		// .../wal cannot be empty to exist. Any file in it counts, unlike
+		// for Exist, so the version detected is unchanged.
+		if wnames, err := fileutil.ReadDir(filepath.Join(dirpath, "wal")); err == nil && len(wnames) != 0 {
 			return WALv0_5, nil
 		}
 	}
@@ -61,12 +72,15 @@ func DetectVersion(dirpath string) (WalVersion, error) {
 	return WALUnknown, nil
 }
 
+// Exist returns whether the given directory holds a WAL, that is whether
+// it contains at least one correctly named WAL file. An empty directory,
+// or one that only contains other files, does not hold a WAL.
 func Exist(dirpath string) bool {
 	names, err := fileutil.ReadDir(dirpath)
 	if err != nil {
 		return false
 	}
-	return len(names) != 0
+	return len(checkWalNames(names)) != 0
 }
 
 // searchIndex returns the last array index of names whose raft index section is
@@ -87,35 +101,213 @@ func searchIndex(names []string, index uint64) (int, bool) {
 }
 
 // names should have been sorted based on sequence number.
-// isValidSeq checks whether seq increases continuously.
-func isValidSeq(names []string) bool {
+// checkSeq checks whether seq increases continuously, and returns a
+// *SeqError for the first file that breaks the sequence. As before, the
+// file after one of sequence 0 is not checked.
+func checkSeq(names []string) error {
 	var lastSeq uint64
-	for _, name := range names {
+	for i, name := range names {
 		curSeq, _, err := parseWalName(name)
 		if err != nil {
 			log.Panicf("parse correct name should never fail: %v", err)
 		}
 		if lastSeq != 0 && lastSeq != curSeq-1 {
-			return false
+			return &SeqError{Expected: lastSeq + 1, Found: curSeq, Prev: names[i-1], File: name}
 		}
 		lastSeq = curSeq
 	}
-	return true
+	return nil
+}
+
+// recoverTmp handles the temporary WAL files of Reset and Compact left in
+// the given directories whose WAL file does not exist, and that are not
+// locked by a Reset in progress. Such a file is renamed into place if its
+// directory holds no WAL file, as left by a Reset that crashed after
+// removing the old files, and it is removed otherwise, since the WAL files
+// left are a valid prefix of the old WAL. The temporary files of existing
+// WAL files are left to removeTmp.
+func recoverTmp(dirs []string) error {
+	for _, dir := range dirs {
+		tmps, err := filepath.Glob(filepath.Join(dir, "*.wal.tmp"))
+		if err != nil {
+			return err
+		}
+		for _, tmp := range tmps {
+			fpath := strings.TrimSuffix(tmp, ".tmp")
+			if _, err = os.Stat(fpath); err == nil {
+				continue
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+			names, err := fileutil.ReadDir(dir)
+			if err != nil {
+				return err
+			}
+			err = withTryLock(tmp, func() error {
+				if len(checkWalNames(names)) != 0 {
+					return os.Remove(tmp)
+				}
+				if err := os.Rename(tmp, fpath); err != nil {
+					return err
+				}
+				return syncDir(dir)
+			})
+			if err == fileutil.ErrLocked {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			logger.Printf("wal: recovered stray file %s", tmp)
+		}
+	}
+	return nil
+}
+
+// withTryLock calls fn while holding the lock on the file at the given
+// path, and returns fileutil.ErrLocked without calling it if the file is
+// locked.
+func withTryLock(fpath string, fn func() error) error {
+	l, err := fileutil.NewLock(fpath)
+	if err != nil {
+		return err
+	}
+	defer l.Destroy()
+	if err = l.TryLock(); err != nil {
+		return err
+	}
+	defer l.Unlock()
+	return fn()
+}
+
+// removeTmp removes the temporary WAL files of Compact and Reset left in
+// the given directories whose WAL file is one of the given locked files,
+// so no Compact can be writing them.
+func removeTmp(dirs []string, locks []fileutil.Lock) error {
+	locked := make(map[string]bool)
+	for _, l := range locks {
+		locked[l.Name()] = true
+	}
+	for _, dir := range dirs {
+		tmps, err := filepath.Glob(filepath.Join(dir, "*.wal.tmp"))
+		if err != nil {
+			return err
+		}
+		for _, tmp := range tmps {
+			if !locked[strings.TrimSuffix(tmp, ".tmp")] {
+				continue
+			}
+			if err = os.Remove(tmp); err != nil {
+				return err
+			}
+			logger.Printf("wal: removed stray file %s", tmp)
+		}
+	}
+	return nil
+}
+
+// removeStray removes the newest WAL file in the given directories if it
+// is empty and follows the one before, as left by a Cut that crashed right
+// after creating it. It returns names without the removed WAL file.
+func removeStray(names []string, dirOf map[string]string) ([]string, error) {
+	if len(names) < 2 {
+		return names, nil
+	}
+	last := names[len(names)-1]
+	fpath := filepath.Join(dirOf[last], last)
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return nil, err
+	}
+	prevSeq, _, _ := parseWalName(names[len(names)-2])
+	lastSeq, _, _ := parseWalName(last)
+	if fi.Size() != 0 || lastSeq != prevSeq+1 {
+		return names, nil
+	}
+	// the file is kept if it is locked, so opening fails as it would
+	// have before
+	if err = purgeFile(fpath); err == fileutil.ErrLocked {
+		return names, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return names[:len(names)-1], nil
 }
 
 func checkWalNames(names []string) []string {
-	wnames := make([]string, 0)
+	wnames, _ := splitWalNames(names)
+	return wnames
+}
+
+// splitWalNames splits names into the names of WAL files and the others,
+// which are ignored.
+func splitWalNames(names []string) (wnames, ignored []string) {
+	wnames = make([]string, 0)
 	for _, name := range names {
 		if _, _, err := parseWalName(name); err != nil {
-			log.Printf("wal: parse %s error: %v", name, err)
+			logger.Warningf("wal: parse %s error: %v", name, err)
+			ignored = append(ignored, name)
 			continue
 		}
 		wnames = append(wnames, name)
 	}
-	return wnames
+	return wnames, ignored
+}
+
+// checkUnexpected returns an *UnexpectedFilesError for the first of the
+// given directories that holds files other than WAL files.
+func checkUnexpected(dirs []string) error {
+	for _, dir := range dirs {
+		names, err := fileutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		if _, ignored := splitWalNames(names); len(ignored) != 0 {
+			return &UnexpectedFilesError{Dir: dir, Names: ignored}
+		}
+	}
+	return nil
+}
+
+// readWalNames returns the names of the WAL files in the given directories,
+// sorted as if they were all in one directory, and the directory of each.
+func readWalNames(dirs []string) ([]string, map[string]string, error) {
+	var names []string
+	dirOf := make(map[string]string)
+	for _, dir := range dirs {
+		ns, err := fileutil.ReadDir(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, name := range checkWalNames(ns) {
+			if _, ok := dirOf[name]; ok {
+				return nil, nil, ErrDuplicateFile
+			}
+			dirOf[name] = dir
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, dirOf, nil
+}
+
+func lockNames(locks []fileutil.Lock) []string {
+	names := make([]string, len(locks))
+	for i, l := range locks {
+		names[i] = filepath.Base(l.Name())
+	}
+	return names
 }
 
+var errBadWalName = errors.New("bad wal name")
+
 func parseWalName(str string) (seq, index uint64, err error) {
+	// Sscanf ignores what follows the format, such as in the name of a
+	// renamed copy like "x.wal.broken"
+	if filepath.Ext(str) != ".wal" {
+		return 0, 0, errBadWalName
+	}
 	_, err = fmt.Sscanf(str, "%016x-%016x.wal", &seq, &index)
 	return
 }
@@ -123,3 +315,41 @@ func parseWalName(str string) (seq, index uint64, err error) {
 func walName(seq, index uint64) string {
 	return fmt.Sprintf("%016x-%016x.wal", seq, index)
 }
+
+// lazyFile is a ReadCloser of the file at path, which is opened on the first
+// read and closed once read to the end.
+type lazyFile struct {
+	path string
+	f    *os.File
+	eof  bool
+}
+
+func (l *lazyFile) Read(p []byte) (int, error) {
+	if l.eof {
+		return 0, io.EOF
+	}
+	if l.f == nil {
+		f, err := os.Open(l.path)
+		if err != nil {
+			return 0, err
+		}
+		l.f = f
+	}
+	n, err := l.f.Read(p)
+	if err == io.EOF {
+		l.eof = true
+		if cerr := l.Close(); cerr != nil {
+			return n, cerr
+		}
+	}
+	return n, err
+}
+
+func (l *lazyFile) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -28,6 +28,7 @@ func TestDetectVersion(t *testing.T) {
 		wver  WalVersion
 	}{
 		{[]string{}, WALNotExist},
+		{[]string{"snap/", "wal/", "wal/" + walName(0, 0)}, WALv0_5},
 		{[]string{"snap/", "wal/", "wal/1"}, WALv0_5},
 		{[]string{"snapshot/", "conf", "log"}, WALv0_4},
 		{[]string{"weird"}, WALUnknown},
@@ -55,6 +56,30 @@ func TestDetectVersion(t *testing.T) {
 	}
 }
 
+func TestExist(t *testing.T) {
+	tests := []struct {
+		names  []string
+		wexist bool
+	}{
+		{[]string{}, false},
+		{[]string{"1", "0000000000000000-0000000000000000.wal.broken", "0000000000000000-0000000000000000.tmp"}, false},
+		{[]string{"dir.wal/"}, false},
+		{[]string{walName(0, 0)}, true},
+		{[]string{"1", walName(0, 0), walName(1, 1)}, true},
+	}
+	for i, tt := range tests {
+		p := mustMakeDir(t, tt.names...)
+		if g := Exist(p); g != tt.wexist {
+			t.Errorf("#%d: exist = %v, want %v", i, g, tt.wexist)
+		}
+		os.RemoveAll(p)
+	}
+
+	if Exist(path.Join(os.TempDir(), "waltest", "not-exist")) {
+		t.Errorf("exist = true, want false for a non-existing directory")
+	}
+}
+
 // mustMakeDir builds the directory that contains files with the given
 // names. If the name ends with '/', it is created as a directory.
 func mustMakeDir(t *testing.T, names ...string) string {
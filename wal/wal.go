@@ -15,15 +15,23 @@
 package wal
 
 import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
-	"path"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/coreos/etcd/pkg/fileutil"
 	"github.com/coreos/etcd/pkg/pbutil"
 	"github.com/coreos/etcd/raft"
@@ -37,103 +45,604 @@ const (
 	stateType
 	crcType
 	snapshotType
+	// compressedEntryType is an entry whose data is compressed. It is a
+	// distinct type, so older versions fail to read it instead of
+	// misreading it.
+	compressedEntryType
+	// encryptedType is a record whose type and data are encrypted.
+	encryptedType
+	// footerType is the record that Cut appends to the file it finalizes,
+	// to check the file without decoding its records.
+	footerType
+	// appDataType is a record of application data saved by SaveAppData.
+	appDataType
 
 	// the owner can make/remove files inside the directory
 	privateDirMode = 0700
+
+	// ctxCheckRecords is the number of records read between the checks
+	// of the context passed to ReadAllContext.
+	ctxCheckRecords = 1024
+
+	// lockRetryInterval is how often OpenWithContext tries to lock the
+	// WAL files again.
+	lockRetryInterval = 100 * time.Millisecond
+
+	// PreallocateBytes is the default number of bytes allocated on disk
+	// for each newly created WAL file. Preallocating the file avoids
+	// growing it record by record, which fragments the file and slows
+	// down the fsync issued after appending. WithPreallocateBytes sets it
+	// for a single WAL.
+	PreallocateBytes int64 = 64 * 1024 * 1024
+
+	// MaxRecordBytes is the default maximum size of a record in bytes.
+	// Saving a larger record fails, and reading one is treated as
+	// corruption, so that a corrupted record length never makes the
+	// decoder allocate an arbitrary amount of memory. WithMaxRecordBytes
+	// sets it for a single WAL.
+	MaxRecordBytes int64 = 10 * 1024 * 1024
 )
 
 var (
-	ErrMetadataConflict = errors.New("wal: conflicting metadata found")
-	ErrFileNotFound     = errors.New("wal: file not found")
-	ErrCRCMismatch      = errors.New("wal: crc mismatch")
-	ErrSnapshotMismatch = errors.New("wal: snapshot mismatch")
-	ErrSnapshotNotFound = errors.New("wal: snapshot not found")
-	crcTable            = crc32.MakeTable(crc32.Castagnoli)
+	// WarnSyncDuration is the duration of a single fsync above which a
+	// warning is logged, since it usually means the disk is too slow.
+	WarnSyncDuration = time.Second
+
+	ErrMetadataConflict   = errors.New("wal: conflicting metadata found")
+	ErrFileNotFound       = errors.New("wal: file not found")
+	ErrCRCMismatch        = errors.New("wal: crc mismatch")
+	ErrSnapshotMismatch   = errors.New("wal: snapshot mismatch")
+	ErrSnapshotNotFound   = errors.New("wal: snapshot not found")
+	ErrReadOnly           = errors.New("wal: cannot append to a read-only WAL")
+	ErrUnsupportedFormat  = errors.New("wal: unsupported format")
+	ErrRecordTooLarge     = errors.New("wal: record too large")
+	ErrDecode             = errors.New("wal: cannot decode record")
+	ErrInvalidPosition    = errors.New("wal: invalid position")
+	ErrChecksumConflict   = errors.New("wal: WAL files use different checksums")
+	ErrTruncateIndex      = errors.New("wal: index to truncate to is before the file being appended")
+	ErrWorldWritable      = errors.New("wal: file mode must not be world-writable")
+	ErrEntryGap           = errors.New("wal: gap in entry indexes")
+	ErrUnknownRecordType  = errors.New("wal: unknown record type")
+	ErrInvalidKey         = errors.New("wal: encryption key must be 32 bytes")
+	ErrKeyRequired        = errors.New("wal: WAL is encrypted, the key is required")
+	ErrDecrypt            = errors.New("wal: cannot decrypt record, the key may be wrong")
+	ErrLastEntryMismatch  = errors.New("wal: last entry does not match the given index and term")
+	ErrDuplicateFile      = errors.New("wal: WAL file found in several directories")
+	ErrFooterMismatch     = errors.New("wal: footer does not match the records of the file")
+	ErrInvalidSeq         = errors.New("wal: WAL file names are out of sequence")
+	ErrUnsupportedVersion = errors.New("wal: WAL format version is newer than supported")
+	ErrNotAppending       = errors.New("wal: WAL is not in append mode")
+	ErrSnapshotOutOfOrder = errors.New("wal: snapshot index is not after the last saved snapshot")
+	ErrTornTail           = errors.New("wal: last record is incomplete")
+	ErrCorruptLength      = errors.New("wal: record length is corrupted")
+	ErrUnexpectedFile     = errors.New("wal: unexpected file in WAL directory")
+	ErrTruncateSnapshot   = errors.New("wal: index to truncate to is before the last snapshot")
+	ErrAlreadyRead        = errors.New("wal: the records of the WAL are already read")
+	ErrZeroRecord         = errors.New("wal: zeroed record before the end of the WAL")
+
+	// ErrSnapshotTooOld and ErrSnapshotTooNew are the ErrSnapshotNotFound
+	// returned when the snapshot is before all the records of the WAL,
+	// whose earlier records were compacted or purged, or after all of them.
+	ErrSnapshotTooOld = fmt.Errorf("%w: it is older than the records in the WAL", ErrSnapshotNotFound)
+	ErrSnapshotTooNew = fmt.Errorf("%w: it is newer than the records in the WAL", ErrSnapshotNotFound)
+	crcTable          = crc32.MakeTable(crc32.Castagnoli)
 )
 
+// RecordTooLargeError is returned when reading a record whose length is
+// larger than the maximum size of a record, which usually means the length
+// is corrupted.
+type RecordTooLargeError struct {
+	File   string // name of the WAL file that contains the record
+	Offset int64  // offset of the record in the WAL file
+	Size   int64  // the length of the record
+	Max    int64  // the maximum size of a record
+}
+
+func (e *RecordTooLargeError) Error() string {
+	return fmt.Sprintf("wal: record of %d bytes at offset %d in %q is larger than %d bytes",
+		e.Size, e.Offset, e.File, e.Max)
+}
+
+// Is reports whether the target is ErrRecordTooLarge.
+func (e *RecordTooLargeError) Is(target error) bool {
+	return target == ErrRecordTooLarge
+}
+
+// DecodeError is returned when a record read from a WAL file is corrupted
+// or cannot be decoded. It matches ErrDecode with errors.Is.
+type DecodeError struct {
+	File   string // name of the WAL file that contains the record, if known
+	Index  int    // index of the WAL file among the files being read
+	Offset int64  // offset of the record in the WAL file
+	Type   int64  // type of the record, if known
+	Err    error  // the underlying error
+}
+
+func (e *DecodeError) Error() string {
+	rec := "record"
+	if e.Type != 0 {
+		rec = fmt.Sprintf("record of type %d", e.Type)
+	}
+	if e.File == "" {
+		return fmt.Sprintf("wal: cannot decode %s at offset %d in segment %d: %v", rec, e.Offset, e.Index, e.Err)
+	}
+	return fmt.Sprintf("wal: cannot decode %s at offset %d in %q: %v", rec, e.Offset, e.File, e.Err)
+}
+
+// Is reports whether the target is ErrDecode.
+func (e *DecodeError) Is(target error) bool {
+	return target == ErrDecode
+}
+
+// Unwrap returns the underlying error.
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// TornTailError is returned when the last record of the WAL is cut short,
+// either within its length or after its intact length, which is left by a
+// write torn by a crash.
+// Unlike the errors of corrupted records, the WAL can be repaired by
+// truncating the file at the offset of the record, losing only the writes
+// that were never synced. It matches ErrTornTail and io.ErrUnexpectedEOF
+// with errors.Is.
+type TornTailError struct {
+	File   string // name of the WAL file that contains the record, if known
+	Offset int64  // offset of the record in the WAL file
+}
+
+func (e *TornTailError) Error() string {
+	return fmt.Sprintf("wal: last record at offset %d in %q is incomplete", e.Offset, e.File)
+}
+
+// Is reports whether the target is ErrTornTail or io.ErrUnexpectedEOF.
+func (e *TornTailError) Is(target error) bool {
+	return target == ErrTornTail || target == io.ErrUnexpectedEOF
+}
+
+// UnexpectedFilesError is returned by Open with WithStrictNames when the
+// WAL directory holds files that are not WAL files. It matches
+// ErrUnexpectedFile with errors.Is.
+type UnexpectedFilesError struct {
+	Dir   string   // the WAL directory
+	Names []string // names of the unexpected files
+}
+
+func (e *UnexpectedFilesError) Error() string {
+	return fmt.Sprintf("wal: unexpected files in %q: %s", e.Dir, strings.Join(e.Names, ", "))
+}
+
+// Is reports whether the target is ErrUnexpectedFile.
+func (e *UnexpectedFilesError) Is(target error) bool {
+	return target == ErrUnexpectedFile
+}
+
+// entryOffset is the location of an entry in the file being appended.
+type entryOffset struct {
+	index  uint64
+	off    int64            // offset of the record of the entry
+	crc    uint64           // the crc chained before the entry
+	state  raftpb.HardState // the state saved before the entry
+	frames frameSum         // the frames of the file before the entry
+}
+
+// CRCError is returned when the checksum of a record read from a WAL file
+// does not match. It matches ErrCRCMismatch with errors.Is.
+type CRCError struct {
+	Seq      uint64 // sequence of the WAL file that contains the record
+	Offset   int64  // offset of the record in the WAL file
+	Expected uint64 // checksum stored in the record
+	Actual   uint64 // checksum computed from the records read
+}
+
+func (e *CRCError) Error() string {
+	return fmt.Sprintf("wal: crc mismatch at offset %d in segment %d: expected %#x, got %#x", e.Offset, e.Seq, e.Expected, e.Actual)
+}
+
+// Is reports whether the target is ErrCRCMismatch or walpb.ErrCRCMismatch.
+func (e *CRCError) Is(target error) bool {
+	return target == ErrCRCMismatch || target == walpb.ErrCRCMismatch
+}
+
+// LockedError is returned when a WAL file is locked by another WAL, usually
+// in another etcd process. It matches fileutil.ErrLocked with errors.Is.
+type LockedError struct {
+	File string // name of the locked WAL file
+	PID  int    // pid of the process holding the lock, or 0 if unknown
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("wal: %q is locked by another process", e.File)
+	}
+	return fmt.Sprintf("wal: %q is locked by process %d", e.File, e.PID)
+}
+
+// Is reports whether the target is fileutil.ErrLocked.
+func (e *LockedError) Is(target error) bool {
+	return target == fileutil.ErrLocked
+}
+
+// MetadataConflictError is returned when a WAL file has metadata different
+// from the files before it, which usually means that files of another
+// member were copied into the WAL. It matches ErrMetadataConflict with
+// errors.Is.
+type MetadataConflictError struct {
+	File         string // name of the WAL file that contains the metadata
+	Offset       int64  // offset of the metadata record in the WAL file
+	Expected     []byte // metadata of the files before
+	Found        []byte // metadata in the WAL file
+	ExpectedFile string // name of the WAL file the expected metadata is read from
+}
+
+func (e *MetadataConflictError) Error() string {
+	return fmt.Sprintf("wal: conflicting metadata at offset %d in %q: found %s, want %s as in %q", e.Offset, e.File, digest(e.Found), digest(e.Expected), e.ExpectedFile)
+}
+
+// Is reports whether the target is ErrMetadataConflict.
+func (e *MetadataConflictError) Is(target error) bool {
+	return target == ErrMetadataConflict
+}
+
+// digest describes the metadata briefly, since it can be large.
+func digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return fmt.Sprintf("%d bytes with sha256 %x", len(b), sum[:8])
+}
+
+// EntryGapError is returned when reading an entry whose index skips
+// forward from the previous entry, which means some entries are missing.
+// It matches ErrEntryGap with errors.Is.
+type EntryGapError struct {
+	Expected uint64 // index of the entry expected next
+	Found    uint64 // index of the entry read
+}
+
+func (e *EntryGapError) Error() string {
+	return fmt.Sprintf("wal: gap in entry indexes: expected index %d, found %d", e.Expected, e.Found)
+}
+
+// Is reports whether the target is ErrEntryGap.
+func (e *EntryGapError) Is(target error) bool {
+	return target == ErrEntryGap
+}
+
+// SeqError is returned when the sequences of the WAL file names do not
+// increase by one from a file to the next. It matches ErrInvalidSeq and,
+// as returned before it was added, ErrFileNotFound with errors.Is.
+type SeqError struct {
+	Expected uint64 // sequence expected for File
+	Found    uint64 // sequence of File
+	Prev     string // name of the WAL file before File
+	File     string // name of the WAL file out of sequence
+}
+
+func (e *SeqError) Error() string {
+	if e.Found+1 == e.Expected {
+		return fmt.Sprintf("wal: duplicate sequence %d in %q and %q", e.Found, e.Prev, e.File)
+	}
+	return fmt.Sprintf("wal: sequence %d of %q does not follow %q, want %d", e.Found, e.File, e.Prev, e.Expected)
+}
+
+// Is reports whether the target is ErrInvalidSeq or ErrFileNotFound.
+func (e *SeqError) Is(target error) bool {
+	return target == ErrInvalidSeq || target == ErrFileNotFound
+}
+
 // WAL is a logical repersentation of the stable storage.
 // WAL is either in read mode or append mode but not both.
 // A newly created WAL is in append mode, and ready for appending records.
 // A just opened WAL is in read mode, and ready for reading records.
 // The WAL will be ready for appending after reading out all the previous records.
+// In append mode, the methods of the WAL are safe for concurrent use, and
+// the records of concurrent calls are appended one call after another.
+// Reading is not, and must be done by a single goroutine. The records synced
+// can be read while appending with a WAL returned by Reader.
 type WAL struct {
 	dir      string           // the living directory of the underlay files
 	metadata []byte           // metadata recorded at the head of each WAL
 	state    raftpb.HardState // hardstate recorded at the head of WAL
 
-	start   walpb.Snapshot // snapshot to start reading
-	decoder *decoder       // decoder to decode records
+	start    walpb.Snapshot // snapshot to start reading
+	lastSnap walpb.Snapshot // last snapshot read or saved
+	decoder  *decoder       // decoder to decode records
 
-	f       *os.File // underlay file opened for appending, sync
-	seq     uint64   // sequence of the wal file currently used for writes
-	enti    uint64   // index of the last entry saved to the wal
-	encoder *encoder // encoder to encode records
+	f        *os.File           // underlay file opened for appending, sync
+	seq      uint64             // sequence of the wal file currently used for writes
+	enti     uint64             // index of the last entry saved to the wal
+	snapi    uint64             // index of the last snapshot saved to the wal
+	encoder  *encoder           // encoder to encode records
+	checksum Checksum           // checksum of the records appended to the wal
+	padded   bool               // pads the records appended, as recorded in the files
+	gc       *groupCommit       // shares fsyncs among concurrent Saves, if enabled
+	observer Observer           // observes the writes and fsyncs, if set
+	appData  func([]byte) error // called with the application data read, if set
+	// entryFilter tells the types of the entries whose data is unmarshaled
+	// while reading, if set
+	entryFilter func(raftpb.EntryType) bool
+	cp          *compressor // compresses the entries appended, if enabled
+	aead        cipher.AEAD // encrypts the records, if enabled
+	// crcWorkers is the number of goroutines checksumming the entries of
+	// a Save in parallel, if more than one
+	crcWorkers int
+	fileMode   os.FileMode // mode of the WAL files created
+	bufSize    int         // size of the write buffer of the encoder
+	maxBytes   int64       // maximum size of a record
+	prealloc   int64       // bytes preallocated for each WAL file created
+	timestamps bool        // the records appended record the time
 
-	locks []fileutil.Lock // the file locks the WAL is holding (the name is increasing)
+	off       int64         // offset of the next record in the file being appended
+	entryOffs []entryOffset // locations of the entries in the file being appended
+	// scratch and rec are reused to marshal the entries and states
+	// appended and to hold their records, so appending does not allocate
+	scratch []byte
+	rec     walpb.Record
+
+	// appendMu serializes the operations that append records or switch
+	// the file, unless in group commit mode where gc.appendMu does
+	appendMu sync.Mutex
+
+	mu           sync.Mutex      // guards the fields below
+	locks        []fileutil.Lock // the file locks the WAL is holding (the name is increasing)
+	entries      int64           // number of entries saved to the wal
+	bytesWritten int64           // number of bytes appended to the wal
+	saves        int64           // number of Save and SaveNoSync calls
+	cuts         int64           // number of Cut calls
+	syncs        int64           // number of fsyncs
+	syncDuration time.Duration   // total time spent in fsync
+	maxSync      time.Duration   // duration of the longest fsync
+	syncedSeq    uint64          // sequence of the last file synced
+	syncedOff    int64           // offset the last file synced is synced up to
+
+	readOnly bool // the WAL can only be read, appending returns ErrReadOnly
+
+	positioned bool   // the WAL is opened at a position instead of a snapshot
+	readSeq    uint64 // sequence of the wal file that the last read record is in
+	readOff    int64  // offset right after the last read record
 }
 
 // Create creates a WAL ready for appending records. The given metadata is
-// recorded at the head of each WAL file, and can be retrieved with ReadAll.
-func Create(dirpath string, metadata []byte) (*WAL, error) {
+// recorded at the head of each WAL file after a header giving the version of
+// the WAL format, and can be retrieved with ReadAll.
+func Create(dirpath string, metadata []byte, opts ...Option) (*WAL, error) {
+	return create(dirpath, metadata, walpb.Snapshot{}, newOptions(opts))
+}
+
+// CreateAt is similar to Create, but the WAL starts at the given snapshot,
+// which is recorded in its first file, named with the snapshot index. The
+// first entry appended follows the snapshot, so a member starting from a
+// snapshot received or restored from a backup does not need the entries
+// before it. The WAL can then be opened at the snapshot.
+func CreateAt(dirpath string, metadata []byte, snap walpb.Snapshot, opts ...Option) (*WAL, error) {
+	return create(dirpath, metadata, snap, newOptions(opts))
+}
+
+// create creates a WAL whose first file starts at the given snapshot.
+func create(dirpath string, metadata []byte, snap walpb.Snapshot, o options) (*WAL, error) {
 	if Exist(dirpath) {
 		return nil, os.ErrExist
 	}
-
-	if err := os.MkdirAll(dirpath, privateDirMode); err != nil {
+	if !o.checksum.valid() || !o.compression.valid() {
+		return nil, ErrUnsupportedFormat
+	}
+	if o.fileMode&0002 != 0 || o.dirMode&0002 != 0 {
+		return nil, ErrWorldWritable
+	}
+	aead, err := newAEAD(o.key)
+	if err != nil {
 		return nil, err
 	}
 
-	p := path.Join(dirpath, walName(0, 0))
-	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
-	if err != nil {
+	// initialize the WAL in a temporary directory and rename it into place,
+	// so a crash never leaves a half-initialized WAL behind. The lock on the
+	// directory keeps Open and other Creates from removing it meanwhile.
+	tmpdir := tmpDir(dirpath)
+	if err = removeTmpDir(dirpath); err != nil {
 		return nil, err
 	}
-	l, err := fileutil.NewLock(f.Name())
-	if err != nil {
+	if err = os.MkdirAll(filepath.Dir(tmpdir), o.dirMode); err != nil {
 		return nil, err
 	}
-	err = l.Lock()
+	if err = os.Mkdir(tmpdir, o.dirMode); err != nil {
+		return nil, err
+	}
+	l, err := fileutil.NewLock(tmpdir)
 	if err != nil {
+		os.RemoveAll(tmpdir)
+		return nil, err
+	}
+	if err = l.TryLock(); err != nil {
+		l.Destroy()
 		return nil, err
 	}
 
+	name := walName(0, snap.Index)
 	w := &WAL{
-		dir:      dirpath,
-		metadata: metadata,
-		seq:      0,
-		f:        f,
-		encoder:  newEncoder(f, 0),
+		dir:        dirpath,
+		metadata:   encodeMetadata(metadata),
+		seq:        0,
+		checksum:   o.checksum,
+		padded:     o.padding,
+		aead:       aead,
+		bufSize:    o.writeBufferSize,
+		maxBytes:   o.maxRecordBytes,
+		prealloc:   o.preallocateBytes,
+		timestamps: o.timestamps,
+		cp:         newCompressor(o.compression),
 	}
-	w.locks = append(w.locks, l)
-	if err := w.saveCrc(0); err != nil {
+	err = w.createFirstFile(tmpdir, name, snap, o.fileMode)
+	if err == nil {
+		err = renameTmpDir(tmpdir, dirpath, name)
+	}
+	l.Unlock()
+	l.Destroy()
+	if err != nil {
+		os.RemoveAll(tmpdir)
+		return nil, err
+	}
+
+	// reopen the file at its final path to append to it
+	if w.f, err = os.OpenFile(filepath.Join(dirpath, name), os.O_WRONLY|os.O_APPEND, 0); err != nil {
 		return nil, err
 	}
-	if err := w.encoder.encode(&walpb.Record{Type: metadataType, Data: metadata}); err != nil {
+	if l, err = fileutil.NewLock(w.f.Name()); err != nil {
+		w.f.Close()
 		return nil, err
 	}
-	if err = w.SaveSnapshot(walpb.Snapshot{}); err != nil {
+	if err = l.Lock(); err != nil {
+		w.f.Close()
 		return nil, err
 	}
+	w.locks = append(w.locks, l)
+	w.reopenEncoder()
+	if o.groupCommit {
+		w.gc = newGroupCommit(o.groupCommitWindow)
+	}
+	w.observer = o.observer
+	w.crcWorkers = o.crcWorkers
+	w.fileMode = o.fileMode
 	return w, nil
 }
 
+// reopenEncoder replaces the encoder of w with one appending to w.f, which
+// continues the crc chain and the frames of the previous one.
+func (w *WAL) reopenEncoder() {
+	fs := w.encoder.frameSum()
+	w.encoder = w.newEncoder(w.f, w.encoder.crc.Sum64())
+	w.encoder.resumeFrames(fs)
+}
+
+// newEncoder returns an encoder appending to f with the write buffer size
+// and timestamps of the WAL, whose crc continues from prevCrc.
+func (w *WAL) newEncoder(f io.Writer, prevCrc uint64) *encoder {
+	e := newEncoderSize(f, prevCrc, w.checksum, w.bufSize)
+	e.padded, e.maxBytes = w.padded, w.maxBytes
+	if w.timestamps {
+		e.now = time.Now
+	}
+	return e
+}
+
+// createFirstFile writes the first file of w, with the given name, to the
+// given directory, and syncs it.
+func (w *WAL) createFirstFile(dir, name string, snap walpb.Snapshot, mode os.FileMode) error {
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, mode)
+	if err != nil {
+		return err
+	}
+	if err = w.preallocate(f); err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.encoder = w.newEncoder(f, 0)
+	if err = w.saveCrc(0); err != nil {
+		f.Close()
+		return err
+	}
+	if err = w.encodeSealed(&walpb.Record{Type: metadataType, Data: w.metadata}); err != nil {
+		f.Close()
+		return err
+	}
+	if err = w.SaveSnapshot(snap); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// renameTmpDir moves the WAL initialized in tmpdir, whose only file has
+// the given name, into dirpath. The directory is renamed if dirpath does
+// not exist. Otherwise the file is moved into it, since os.Rename does not
+// replace a directory, and dirpath may hold other files than WAL files.
+func renameTmpDir(tmpdir, dirpath, name string) error {
+	_, err := os.Stat(dirpath)
+	if os.IsNotExist(err) {
+		if err = os.Rename(tmpdir, dirpath); err != nil {
+			return err
+		}
+		return syncDir(filepath.Dir(dirpath))
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(filepath.Join(tmpdir, name), filepath.Join(dirpath, name)); err != nil {
+		return err
+	}
+	if err = syncDir(dirpath); err != nil {
+		return err
+	}
+	return os.RemoveAll(tmpdir)
+}
+
+// tmpDir returns the temporary directory where the WAL in dirpath is
+// initialized by Create.
+func tmpDir(dirpath string) string {
+	return filepath.Clean(dirpath) + ".tmp"
+}
+
+// removeTmpDir removes the temporary directory left by a Create of the WAL
+// in dirpath that crashed before completing, unless a Create in progress
+// holds its lock.
+func removeTmpDir(dirpath string) error {
+	tmpdir := tmpDir(dirpath)
+	err := withTryLock(tmpdir, func() error { return os.RemoveAll(tmpdir) })
+	if os.IsNotExist(err) || err == fileutil.ErrLocked {
+		return nil
+	}
+	return err
+}
+
 // Open opens the WAL at the given snap.
 // The snap SHOULD have been previously saved to the WAL, or the following
 // ReadAll will fail.
 // The returned WAL is ready to read and the first record will be the one after
 // the given snap. The WAL cannot be appended to before reading out all of its
 // previous records.
-func Open(dirpath string, snap walpb.Snapshot) (*WAL, error) {
-	return openAtIndex(dirpath, snap, true)
+// The files left by an interrupted Cut, Compact or Reset are cleaned up:
+// the new file of a Reset that crashed after removing the old files is
+// renamed into place, and the temporary files of Compact are removed once
+// the locks on the files they replace are held. Open returns a *SeqError if
+// the WAL file names are out of sequence.
+func Open(dirpath string, snap walpb.Snapshot, opts ...Option) (*WAL, error) {
+	return openAtIndex(dirpath, snap, true, newOptions(opts))
+}
+
+// OpenWithContext is similar to Open, but if a WAL file is locked by
+// another WAL, it waits for the lock to be released until ctx is done,
+// and then returns the *LockedError.
+func OpenWithContext(ctx context.Context, dirpath string, snap walpb.Snapshot, opts ...Option) (*WAL, error) {
+	o := newOptions(opts)
+	for {
+		w, err := openAtIndex(dirpath, snap, true, o)
+		if !errors.Is(err, fileutil.ErrLocked) {
+			return w, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(lockRetryInterval):
+		}
+	}
 }
 
 // OpenNotInUse only opens the wal files that are not in use.
 // Other than that, it is similar to Open.
-func OpenNotInUse(dirpath string, snap walpb.Snapshot) (*WAL, error) {
-	return openAtIndex(dirpath, snap, false)
+func OpenNotInUse(dirpath string, snap walpb.Snapshot, opts ...Option) (*WAL, error) {
+	return openAtIndex(dirpath, snap, false, newOptions(opts))
 }
 
-func openAtIndex(dirpath string, snap walpb.Snapshot, all bool) (*WAL, error) {
+// OpenForAppend opens the WAL for appending after the entry at the given
+// index and term, without reading out all of its records. Only the last
+// WAL file is read, to verify its records against their crcs and to chain
+// the crc of the records appended. It fails if the last file is corrupted,
+// with a *TornTailError if its last record is torn, or if its last entry
+// is not the given one. The returned WAL is ready for appending, and
+// cannot be read.
+func OpenForAppend(dirpath string, lastIndex, lastTerm uint64, opts ...Option) (*WAL, error) {
 	names, err := fileutil.ReadDir(dirpath)
 	if err != nil {
 		return nil, err
@@ -142,271 +651,1773 @@ func openAtIndex(dirpath string, snap walpb.Snapshot, all bool) (*WAL, error) {
 	if len(names) == 0 {
 		return nil, ErrFileNotFound
 	}
+	seq, index, err := parseWalName(names[len(names)-1])
+	if err != nil {
+		return nil, err
+	}
+	w, err := openAtIndex(dirpath, walpb.Snapshot{Index: index}, true, newOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	// the last file does not start at a snapshot
+	w.start = walpb.Snapshot{}
+	w.positioned = true
+	var last *raftpb.Entry
+	_, state, err := w.readRecords(context.Background(), func(_ *walpb.Record, e *raftpb.Entry) error {
+		last = e
+		return nil
+	})
+	if err == nil && last != nil && (last.Index != lastIndex || last.Term != lastTerm) {
+		err = ErrLastEntryMismatch
+	}
+	if err == nil && last == nil && !emptyFileMatches(seq, index, w.lastSnap, lastIndex, lastTerm) {
+		err = ErrLastEntryMismatch
+	}
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	w.state = state
+	w.enti = lastIndex
+	return w, nil
+}
+
+// emptyFileMatches reports whether the given entry can be the last one of
+// the WAL when its last file, of the given sequence and index, holds no
+// entries. The entry is then the snapshot saved in the file, if any, or the
+// entry before the index of the file, which is the one its name starts at
+// for the first file. Only the index is checked against the file name, as
+// it does not record the term.
+func emptyFileMatches(seq, index uint64, snap walpb.Snapshot, lastIndex, lastTerm uint64) bool {
+	if seq > 0 && index > 0 {
+		index--
+	}
+	if snap.Index > 0 && snap.Index >= index {
+		return snap.Index == lastIndex && snap.Term == lastTerm
+	}
+	return index == lastIndex
+}
 
+// OpenMulti is similar to Open, but the WAL files are spread over the given
+// directories, which are read as a single WAL directory, so the older files
+// can be moved to other disks. The first directory is the active one, where
+// Cut creates the new files. It returns ErrDuplicateFile if a WAL file is
+// found in more than one directory.
+func OpenMulti(dirs []string, snap walpb.Snapshot, opts ...Option) (*WAL, error) {
+	if len(dirs) == 0 {
+		return nil, ErrFileNotFound
+	}
+	return openDirs(dirs, snap, true, newOptions(opts))
+}
+
+// OpenReader opens a read-only WAL that reads records from the given reader
+// instead of the files in a WAL directory. The reader should contain the
+// content of WAL files starting from the given snap.
+// The returned WAL supports ReadAll, but Save, SaveSnapshot and Cut
+// return ErrReadOnly. If r is an io.Closer, Close closes it.
+// Only the encryption key and the maximum size of a record are used among
+// the options.
+func OpenReader(r io.Reader, snap walpb.Snapshot, opts ...Option) (*WAL, error) {
+	o := newOptions(opts)
+	aead, err := newAEAD(o.key)
+	if err != nil {
+		return nil, err
+	}
+	rc, ok := r.(io.ReadCloser)
+	if !ok {
+		rc = ioutil.NopCloser(r)
+	}
+	w := &WAL{
+		start:    snap,
+		decoder:  newDecoder(rc),
+		readOnly: true,
+		maxBytes: o.maxRecordBytes,
+	}
+	w.decoder.aead, w.decoder.maxBytes = aead, o.maxRecordBytes
+	return w, nil
+}
+
+// OpenAtPosition opens a read-only WAL that starts reading at the given
+// position, which is usually returned by Position after a previous read.
+// The position is the sequence of a WAL file and an offset in it, and
+// it must be right after a record.
+// ReadAll of the returned WAL returns the records after the position.
+// Since reading does not start from a snapshot, it never returns
+// ErrSnapshotNotFound, and the returned metadata is empty unless a new
+// WAL file is reached. Only the encryption key, the store and the maximum
+// size of a record are used among the options.
+func OpenAtPosition(dirpath string, seq uint64, offset int64, opts ...Option) (*WAL, error) {
+	o := newOptions(opts)
+	aead, err := newAEAD(o.key)
+	if err != nil {
+		return nil, err
+	}
+	names, err := readDir(o.store, dirpath)
+	if err != nil {
+		return nil, err
+	}
+	names = checkWalNames(names)
+	nameIndex := -1
+	for i, name := range names {
+		if s, _, _ := parseWalName(name); s == seq {
+			nameIndex = i
+			break
+		}
+	}
+	if nameIndex < 0 {
+		return nil, ErrFileNotFound
+	}
+	if err = checkSeq(names[nameIndex:]); err != nil {
+		return nil, err
+	}
+
+	decoder, err := openDecoder(o.store, dirpath, names[nameIndex:])
+	if err != nil {
+		return nil, err
+	}
+	decoder.aead, decoder.maxBytes = aead, o.maxRecordBytes
+	// decode the records before the position to chain the crc
+	if err := decoder.skipTo(offset); err != nil {
+		decoder.close()
+		return nil, err
+	}
+
+	w := &WAL{
+		dir:        dirpath,
+		decoder:    decoder,
+		readOnly:   true,
+		positioned: true,
+		maxBytes:   o.maxRecordBytes,
+		appData:    o.appData,
+	}
+	return w, nil
+}
+
+// OpenReadOnly opens the WAL at the given snap for reading only, like
+// OpenReader. It neither locks the WAL files nor opens them for writing,
+// so it works on a read-only filesystem and on a WAL in use. Only the
+// encryption key, the store and the maximum size of a record are used
+// among the options.
+func OpenReadOnly(dirpath string, snap walpb.Snapshot, opts ...Option) (*WAL, error) {
+	o := newOptions(opts)
+	aead, err := newAEAD(o.key)
+	if err != nil {
+		return nil, err
+	}
+	names, err := readDir(o.store, dirpath)
+	if err != nil {
+		return nil, err
+	}
+	names = checkWalNames(names)
+	if len(names) == 0 {
+		return nil, ErrFileNotFound
+	}
 	nameIndex, ok := searchIndex(names, snap.Index)
-	if !ok || !isValidSeq(names[nameIndex:]) {
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	if err = checkSeq(names[nameIndex:]); err != nil {
+		return nil, err
+	}
+
+	decoder, err := openDecoder(o.store, dirpath, names[nameIndex:])
+	if err != nil {
+		return nil, err
+	}
+	decoder.aead, decoder.maxBytes = aead, o.maxRecordBytes
+	w := &WAL{
+		dir:      dirpath,
+		start:    snap,
+		decoder:  decoder,
+		readOnly: true,
+		maxBytes: o.maxRecordBytes,
+		appData:  o.appData,
+	}
+	return w, nil
+}
+
+// LastIndex returns the index of the last entry in the WAL in the given
+// directory, or 0 if the WAL has no entries. It decodes the WAL files
+// backwards from the last one, until a file with entries is found, so it
+// does not read the whole WAL. It neither locks nor writes the files.
+// Only the encryption key, the store and the maximum size of a record are
+// used among the options.
+func LastIndex(dirpath string, opts ...Option) (uint64, error) {
+	o := newOptions(opts)
+	aead, err := newAEAD(o.key)
+	if err != nil {
+		return 0, err
+	}
+	names, err := readDir(o.store, dirpath)
+	if err != nil {
+		return 0, err
+	}
+	names = checkWalNames(names)
+	if len(names) == 0 {
+		return 0, ErrFileNotFound
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		index, ok, err := lastIndexInFile(o.store, dirpath, names[i], aead, o.maxRecordBytes)
+		if err != nil || ok {
+			return index, err
+		}
+	}
+	return 0, nil
+}
+
+// lastIndexInFile returns the index of the last entry in the given WAL
+// file, or false if it has no entries.
+func lastIndexInFile(s WALStore, dirpath, name string, aead cipher.AEAD, maxBytes int64) (index uint64, ok bool, err error) {
+	d, err := openDecoder(s, dirpath, []string{name})
+	if err != nil {
+		return 0, false, err
+	}
+	defer d.close()
+	d.aead, d.maxBytes = aead, maxBytes
+	rec := &walpb.Record{}
+	for {
+		if err = d.decode(rec); err != nil {
+			break
+		}
+		switch rec.Type {
+		case entryType:
+			var e raftpb.Entry
+			if err = unmarshal(&e, rec.Data); err != nil {
+				return 0, false, d.decodeError(rec.Type, err)
+			}
+			index, ok = e.Index, true
+		case encryptedType:
+			return 0, false, ErrKeyRequired
+		case crcType:
+			// the crc chain of the file starts at its crc record
+			d.updateCRC(recordCrc(rec))
+		}
+	}
+	if err != io.EOF {
+		return 0, false, err
+	}
+	return index, ok, nil
+}
+
+// ValidSnapshotEntries returns the snapshots recorded in the WAL in the
+// given directory whose index is covered by the commit index of the last
+// HardState saved. Any of them can be used to open the WAL, so the newest
+// snapshot file on disk that the WAL knows about can be chosen. It neither
+// locks nor writes the files. Only the encryption key, the store and the
+// maximum size of a record are used among the options.
+func ValidSnapshotEntries(dirpath string, opts ...Option) ([]walpb.Snapshot, error) {
+	o := newOptions(opts)
+	aead, err := newAEAD(o.key)
+	if err != nil {
+		return nil, err
+	}
+	names, err := readDir(o.store, dirpath)
+	if err != nil {
+		return nil, err
+	}
+	names = checkWalNames(names)
+	if len(names) == 0 {
 		return nil, ErrFileNotFound
 	}
+	if err = checkSeq(names); err != nil {
+		return nil, err
+	}
+	d, err := openDecoder(o.store, dirpath, names)
+	if err != nil {
+		return nil, err
+	}
+	defer d.close()
+	d.aead, d.maxBytes = aead, o.maxRecordBytes
 
-	// open the wal files for reading
+	var snaps []walpb.Snapshot
+	var state raftpb.HardState
+	rec := &walpb.Record{}
+	for {
+		if err = d.decode(rec); err != nil {
+			break
+		}
+		switch rec.Type {
+		case snapshotType:
+			var snap walpb.Snapshot
+			if err = unmarshal(&snap, rec.Data); err != nil {
+				return nil, d.decodeError(rec.Type, err)
+			}
+			snaps = append(snaps, snap)
+		case stateType:
+			state.Reset()
+			if err = unmarshal(&state, rec.Data); err != nil {
+				return nil, d.decodeError(rec.Type, err)
+			}
+		case encryptedType:
+			return nil, ErrKeyRequired
+		case crcType:
+			crc := d.crc.Sum64()
+			want := recordCrc(rec)
+			if crc != 0 && d.checksum.validate(rec, crc) != nil {
+				return nil, d.crcError(crcType, want, crc)
+			}
+			d.updateCRC(want)
+		}
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	// the snapshots after the commit index may not be saved yet
+	n := 0
+	for _, snap := range snaps {
+		if snap.Index <= state.Commit {
+			snaps[n] = snap
+			n++
+		}
+	}
+	return snaps[:n], nil
+}
+
+// openDecoder opens the given WAL files for reading, and returns a decoder
+// that decodes them in order.
+func openDecoder(s WALStore, dirpath string, names []string) (*decoder, error) {
 	rcs := make([]io.ReadCloser, 0)
-	ls := make([]fileutil.Lock, 0)
-	for _, name := range names[nameIndex:] {
-		f, err := os.Open(path.Join(dirpath, name))
+	for _, name := range names {
+		f, err := s.Open(filepath.Join(dirpath, name))
 		if err != nil {
+			newDecoder(rcs...).close()
 			return nil, err
 		}
-		l, err := fileutil.NewLock(f.Name())
+		rcs = append(rcs, f)
+	}
+	decoder := newDecoder(rcs...)
+	decoder.names = names
+	return decoder, nil
+}
+
+// Position returns the position right after the last record read from the
+// WAL, which is the sequence of the WAL file that contains the record and
+// the offset in the file. A WAL opened by OpenAtPosition at the returned
+// position continues reading from the next record.
+func (w *WAL) Position() (seq uint64, offset int64) {
+	if w.decoder != nil {
+		return w.decoder.seq(w.decoder.i), w.decoder.off
+	}
+	return w.readSeq, w.readOff
+}
+
+// LastSnapshot returns the last snapshot record read by ReadAll or saved
+// since, together with the ConfState saved with it, which is nil if the
+// snapshot was saved without one, such as by older versions. It returns an
+// empty snapshot if no snapshot record was read or saved.
+func (w *WAL) LastSnapshot() (walpb.Snapshot, *raftpb.ConfState, error) {
+	snap := w.lastSnap
+	if snap.ConfState == nil {
+		return snap, nil, nil
+	}
+	var cs raftpb.ConfState
+	if err := unmarshal(&cs, snap.ConfState); err != nil {
+		return snap, nil, err
+	}
+	return snap, &cs, nil
+}
+
+func openAtIndex(dirpath string, snap walpb.Snapshot, all bool, o options) (*WAL, error) {
+	return openDirs([]string{dirpath}, snap, all, o)
+}
+
+// openDirs opens the WAL whose files are spread over the given directories.
+// The new files are created in the first one.
+func openDirs(dirs []string, snap walpb.Snapshot, all bool, o options) (*WAL, error) {
+	dirpath := dirs[0]
+	if !o.compression.valid() {
+		return nil, ErrUnsupportedFormat
+	}
+	if o.fileMode&0002 != 0 {
+		return nil, ErrWorldWritable
+	}
+	aead, err := newAEAD(o.key)
+	if err != nil {
+		return nil, err
+	}
+	if err := recoverTmp(dirs); err != nil {
+		return nil, err
+	}
+	names, dirOf, err := readWalNames(dirs)
+	if err != nil {
+		return nil, err
+	}
+	if names, err = removeStray(names, dirOf); err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, ErrFileNotFound
+	}
+
+	nameIndex, ok := searchIndex(names, snap.Index)
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	if err = checkSeq(names[nameIndex:]); err != nil {
+		return nil, err
+	}
+	if err = checkMetadata(dirOf, names[nameIndex:], aead); err != nil {
+		return nil, err
+	}
+
+	// open the wal files for reading. Each file is opened when the decoder
+	// reaches it and closed once decoded, so a WAL of many files does not
+	// hold a descriptor to read each of them.
+	rcs := make([]io.ReadCloser, 0)
+	ls := make([]fileutil.Lock, 0)
+	rnames := make([]string, 0)
+	// release closes the files and releases the locks taken on failure,
+	// so a following open is not blocked by them
+	release := func() {
+		for _, rc := range rcs {
+			rc.Close()
+		}
+		for _, l := range ls {
+			l.Unlock()
+			l.Destroy()
+		}
+	}
+	for _, name := range names[nameIndex:] {
+		fpath := filepath.Join(dirOf[name], name)
+		l, err := fileutil.NewLock(fpath)
 		if err != nil {
+			release()
 			return nil, err
 		}
 		err = l.TryLock()
 		if err != nil {
+			l.Destroy()
+			if err == fileutil.ErrLocked {
+				err = &LockedError{File: name, PID: fileutil.LockOwner(fpath)}
+			}
 			if all {
+				release()
 				return nil, err
 			} else {
-				log.Printf("wal: opened all the files until %s, since it is still in use by an etcd server", name)
+				logger.Printf("wal: opened all the files until %s, since it is still in use by an etcd server", name)
 				break
 			}
 		}
-		rcs = append(rcs, f)
+		rcs = append(rcs, &lazyFile{path: fpath})
 		ls = append(ls, l)
+		rnames = append(rnames, name)
+	}
+	// the temporary files are removed only once the locks on their WAL
+	// files are held, so the ones of a Compact in progress are kept
+	if err = removeTmp(dirs, ls); err != nil {
+		release()
+		return nil, err
+	}
+	// remove the leftover of a Create that crashed before completing
+	if len(ls) != 0 {
+		if err = removeTmpDir(dirpath); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	if o.strictNames {
+		if err = checkUnexpected(dirs); err != nil {
+			release()
+			return nil, err
+		}
 	}
-	rc := MultiReadCloser(rcs...)
 
 	// open the lastest wal file for appending
 	seq, _, err := parseWalName(names[len(names)-1])
 	if err != nil {
-		rc.Close()
+		release()
 		return nil, err
 	}
-	last := path.Join(dirpath, names[len(names)-1])
+	last := filepath.Join(dirOf[names[len(names)-1]], names[len(names)-1])
 	f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0)
 	if err != nil {
-		rc.Close()
+		release()
 		return nil, err
 	}
+	decoder := newDecoder(rcs...)
+	decoder.names = rnames
+	decoder.aead, decoder.maxBytes = aead, o.maxRecordBytes
 
 	// create a WAL ready for reading
 	w := &WAL{
 		dir:     dirpath,
 		start:   snap,
-		decoder: newDecoder(rc),
+		decoder: decoder,
 
 		f:     f,
 		seq:   seq,
 		locks: ls,
+		aead:  aead,
+	}
+	if o.groupCommit {
+		w.gc = newGroupCommit(o.groupCommitWindow)
 	}
+	w.observer = o.observer
+	w.cp = newCompressor(o.compression)
+	w.crcWorkers = o.crcWorkers
+	w.fileMode = o.fileMode
+	w.bufSize = o.writeBufferSize
+	w.maxBytes = o.maxRecordBytes
+	w.prealloc = o.preallocateBytes
+	w.timestamps = o.timestamps
+	w.appData = o.appData
 	return w, nil
 }
 
+// checkMetadata reads the metadata recorded at the head of the given WAL
+// files, and returns a *MetadataConflictError if it differs between them,
+// so mixed files of different WALs are found before replaying them. The
+// files whose head cannot be read are left to ReadAll.
+func checkMetadata(dirOf map[string]string, names []string, aead cipher.AEAD) error {
+	var (
+		first    string
+		metadata []byte
+	)
+	for _, name := range names {
+		md, off, ok, err := headMetadata(filepath.Join(dirOf[name], name), aead)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if first == "" {
+			first, metadata = name, md
+			continue
+		}
+		if !bytes.Equal(md, metadata) {
+			return &MetadataConflictError{File: name, Offset: off, Expected: metadata, Found: md, ExpectedFile: first}
+		}
+	}
+	return nil
+}
+
+// headMetadata returns the metadata recorded at the head of the given WAL
+// file and the offset of its record, or false if the head has no metadata
+// record that can be read, such as when it is encrypted without the key.
+func headMetadata(fpath string, aead cipher.AEAD) (metadata []byte, off int64, ok bool, err error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	d := newDecoder(f)
+	defer d.close()
+	d.aead = aead
+	rec := &walpb.Record{}
+	for {
+		if d.decode(rec) != nil {
+			return nil, 0, false, nil
+		}
+		if rec.Type != crcType {
+			break
+		}
+		// the crc chain of the file starts at its crc record
+		d.updateCRC(recordCrc(rec))
+	}
+	if rec.Type != metadataType {
+		return nil, 0, false, nil
+	}
+	md, _, err := decodeMetadata(rec.Data)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("%w in %q", err, filepath.Base(fpath))
+	}
+	return md, d.lastOff, true, nil
+}
+
 // ReadAll reads out all records of the current WAL.
-// If it cannot read out the expected snap, it will return ErrSnapshotNotFound.
+// If it cannot read out the expected snap, it will return ErrSnapshotNotFound,
+// or ErrSnapshotTooOld or ErrSnapshotTooNew if the snap is before or after
+// all the records read, together with all the records. If the snap is too
+// old, the entries returned start from the first one in the WAL.
 // If loaded snap doesn't match with the expected one, it will return
 // all the records and error ErrSnapshotMismatch.
 // TODO: detect not-last-snap error.
 // TODO: maybe loose the checking of match.
 // After ReadAll, the WAL will be ready for appending new records.
 func (w *WAL) ReadAll() (metadata []byte, state raftpb.HardState, ents []raftpb.Entry, err error) {
+	return w.ReadAllContext(context.Background())
+}
+
+// ReadAllContext is similar to ReadAll, but stops reading and returns an
+// error wrapping ctx.Err() once ctx is done. The files being read are then
+// closed, and the WAL is neither readable nor ready for appending: reading
+// again returns ErrAlreadyRead, and it should be closed.
+func (w *WAL) ReadAllContext(ctx context.Context) (metadata []byte, state raftpb.HardState, ents []raftpb.Entry, err error) {
+	metadata, state, err = w.readRecords(ctx, func(_ *walpb.Record, e *raftpb.Entry) error {
+		i, err := w.entrySlot(e.Index, len(ents))
+		if err != nil {
+			return err
+		}
+		ents = append(ents[:i], *e)
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrSnapshotNotFound) {
+		return nil, state, nil, err
+	}
+	return metadata, state, ents, err
+}
+
+// entrySlot returns the position of the entry at the given index among the
+// n entries read after the snapshot. An entry replaces the one at the same
+// index and all the entries after it, but it must not skip forward.
+func (w *WAL) entrySlot(index uint64, n int) (int, error) {
+	i := index - w.start.Index - 1
+	if i > uint64(n) {
+		return 0, &EntryGapError{Expected: w.start.Index + uint64(n) + 1, Found: index}
+	}
+	return int(i), nil
+}
+
+// ReadAllLimit is similar to ReadAll, but retains only the newest entries
+// within the given limits: at most maxEntries entries, and at most maxBytes
+// bytes of marshaled entries, for each limit that is positive. All the
+// records are still read, so their crcs are checked and the state is the
+// last one saved. The entries returned are contiguous, and first is the
+// index of the first of them, so the entries from the snapshot up to it
+// are the ones dropped. If no entry is retained, first is the index after
+// the last entry. The entries dropped are not read again, so fewer entries
+// than the limits allow are returned if the newest ones overwrite the
+// ones retained before them.
+func (w *WAL) ReadAllLimit(maxEntries int, maxBytes int64) (metadata []byte, state raftpb.HardState, ents []raftpb.Entry, first uint64, err error) {
+	var (
+		start   = w.start.Index // index of the snapshot
+		dropped int             // number of entries dropped before ents
+		size    int64           // bytes of the entries in ents
+	)
+	metadata, state, err = w.readRecords(context.Background(), func(_ *walpb.Record, e *raftpb.Entry) error {
+		// a WAL opened at a position starts at the first entry read
+		start = w.start.Index
+		i, err := w.entrySlot(e.Index, dropped+len(ents))
+		if err != nil {
+			return err
+		}
+		// the entries replaced by e are no longer counted
+		if i < dropped {
+			dropped, ents, size = i, ents[:0], 0
+		}
+		for _, re := range ents[i-dropped:] {
+			size -= int64(re.Size())
+		}
+		ents = append(ents[:i-dropped], *e)
+		size += int64(e.Size())
+		for len(ents) > 0 && (maxEntries > 0 && len(ents) > maxEntries || maxBytes > 0 && size > maxBytes) {
+			size -= int64(ents[0].Size())
+			// release the data of the dropped entry
+			ents[0] = raftpb.Entry{}
+			ents = ents[1:]
+			dropped++
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrSnapshotNotFound) {
+		return nil, state, nil, 0, err
+	}
+	if len(ents) == 0 {
+		ents = nil
+	}
+	return metadata, state, ents, start + uint64(dropped) + 1, err
+}
+
+// ReadAllFiltered is similar to ReadAll, but returns only the entries of
+// the given types. The other entries are still read, so the crcs of all
+// the records are checked and the state and the snapshot are matched as by
+// ReadAll, but their data is not unmarshaled. An entry of the given types
+// is still dropped if a later entry overwrites it.
+func (w *WAL) ReadAllFiltered(types ...raftpb.EntryType) (metadata []byte, state raftpb.HardState, ents []raftpb.Entry, err error) {
+	w.entryFilter = func(t raftpb.EntryType) bool {
+		for _, typ := range types {
+			if t == typ {
+				return true
+			}
+		}
+		return false
+	}
+	defer func() { w.entryFilter = nil }()
+	n := 0 // number of entries after the snapshot, of all types
+	metadata, state, err = w.readRecords(context.Background(), func(_ *walpb.Record, e *raftpb.Entry) error {
+		i, err := w.entrySlot(e.Index, n)
+		if err != nil {
+			return err
+		}
+		n = i + 1
+		// e replaces the entries from its index on
+		j := len(ents)
+		for j > 0 && ents[j-1].Index >= e.Index {
+			j--
+		}
+		ents = ents[:j]
+		if w.entryFilter(e.Type) {
+			ents = append(ents, *e)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrSnapshotNotFound) {
+		return nil, state, nil, err
+	}
+	return metadata, state, ents, err
+}
+
+// entryHead decodes the type, term and index of the marshaled entry in
+// data, without its data.
+func entryHead(data []byte) (e raftpb.Entry, err error) {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return e, io.ErrUnexpectedEOF
+		}
+		data = data[n:]
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return e, io.ErrUnexpectedEOF
+		}
+		data = data[n:]
+		switch wire := key & 0x7; {
+		case wire == 2:
+			// a length-delimited field, such as the data, is skipped
+			if v > uint64(len(data)) {
+				return e, io.ErrUnexpectedEOF
+			}
+			data = data[v:]
+		case wire != 0:
+			return e, fmt.Errorf("wal: unexpected wire type %d in entry", wire)
+		case key>>3 == 1:
+			e.Type = raftpb.EntryType(v)
+		case key>>3 == 2:
+			e.Term = v
+		case key>>3 == 3:
+			e.Index = v
+		}
+	}
+	return e, nil
+}
+
+// EntryLocation is an entry together with the location of its record
+// in the WAL files.
+type EntryLocation struct {
+	Entry raftpb.Entry
+	// Seq is the sequence of the WAL file that contains the entry.
+	Seq uint64
+	// Offset is the offset in the WAL file where the record of the
+	// entry starts.
+	Offset int64
+}
+
+// ReadAllWithOffsets is similar to ReadAll, but returns the entries
+// together with their locations in the WAL files instead.
+func (w *WAL) ReadAllWithOffsets() (metadata []byte, state raftpb.HardState, locs []EntryLocation, err error) {
+	metadata, state, err = w.readRecords(context.Background(), func(_ *walpb.Record, e *raftpb.Entry) error {
+		i, off := w.decoder.lastPosition()
+		loc := EntryLocation{Entry: *e, Seq: w.decoder.seq(i), Offset: off}
+		j, err := w.entrySlot(e.Index, len(locs))
+		if err != nil {
+			return err
+		}
+		locs = append(locs[:j], loc)
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrSnapshotNotFound) {
+		return nil, state, nil, err
+	}
+	return metadata, state, locs, err
+}
+
+// CorruptRange is a range of bytes in a WAL file that is skipped by
+// ReadAllSkipCorrupt, since the records in it cannot be decoded.
+type CorruptRange struct {
+	File  string // name of the WAL file, if known
+	Start int64  // offset of the first skipped byte
+	End   int64  // offset right after the last skipped byte
+	Err   error  // the error decoding the record at Start
+}
+
+// ReadAllSkipCorrupt is similar to ReadAll, but skips the corrupted records
+// instead of failing, which is meant for recovering as much as possible of
+// a damaged WAL. Decoding resumes at the next valid record after each
+// corrupted one, and the skipped ranges are logged and returned, so the
+// entries in them are lost. ReadAllSkipCorrupt reads the rest of the WAL
+// files into memory, and must be called instead of ReadAll.
+func (w *WAL) ReadAllSkipCorrupt() (metadata []byte, state raftpb.HardState, ents []raftpb.Entry, skipped []CorruptRange, err error) {
+	decoder := w.decoder
+	if err = decoder.skipCorrupt(); err != nil {
+		return nil, state, nil, nil, err
+	}
+	metadata, state, err = w.readRecords(context.Background(), func(_ *walpb.Record, e *raftpb.Entry) error {
+		// entries may be missing in the skipped ranges, so the entries
+		// replaced by e are searched for instead of located by index
+		i := len(ents)
+		for i > 0 && ents[i-1].Index >= e.Index {
+			i--
+		}
+		ents = append(ents[:i], *e)
+		return nil
+	})
+	for _, r := range decoder.skipped {
+		logger.Warningf("wal: skipped corrupted bytes [%d, %d) in %s: %v", r.Start, r.End, r.File, r.Err)
+	}
+	if err != nil && !errors.Is(err, ErrSnapshotNotFound) {
+		return nil, state, nil, decoder.skipped, err
+	}
+	return metadata, state, ents, decoder.skipped, err
+}
+
+// ReadRecords is similar to ReadAll, but passes the records of the entries
+// to fn one at a time instead of returning the entries, so they are never
+// held in memory all at once. The record is reused once fn returns.
+// An entry may be followed by another one with the same or a lower index,
+// which replaces it and all the entries after it.
+// If fn returns an error, ReadRecords stops and returns the error.
+// After ReadRecords, the WAL will be ready for appending new records.
+func (w *WAL) ReadRecords(fn func(rec *walpb.Record) error) (metadata []byte, state raftpb.HardState, err error) {
+	return w.readRecords(context.Background(), func(rec *walpb.Record, _ *raftpb.Entry) error {
+		return fn(rec)
+	})
+}
+
+// readRecords reads out all records of the WAL, and calls fn with each
+// record of an entry after the snapshot together with the entry.
+func (w *WAL) readRecords(ctx context.Context, fn func(rec *walpb.Record, e *raftpb.Entry) error) (metadata []byte, state raftpb.HardState, err error) {
 	rec := &walpb.Record{}
 	decoder := w.decoder
+	if decoder == nil {
+		return nil, state, ErrAlreadyRead
+	}
+	// metadataFile is the name of the WAL file the metadata is read from
+	var metadataFile string
 
-	var match bool
-	for err = decoder.decode(rec); err == nil; err = decoder.decode(rec) {
+	// there is no snapshot to match when reading from a position
+	positioned := w.positioned
+	match := positioned
+	// the range of indexes covered by the records read, to tell why the
+	// snapshot is not found
+	var (
+		covered     bool
+		tooOld      bool
+		first, last uint64
+	)
+	// cover extends the range by a record. If the records start after the
+	// snapshot, it is never found, and the entries are read from the first
+	// one instead.
+	cover := func(from, to uint64) {
+		if !covered {
+			first, covered = from, true
+			if !match && w.start.Index < first {
+				tooOld = true
+				w.start.Index = first
+			}
+		}
+		if to > last {
+			last = to
+		}
+	}
+	for n := 1; ; n++ {
+		prevCrc, prevFrames := decoder.lastCRC(), decoder.frameSum()
+		if err = decoder.decode(rec); err != nil {
+			break
+		}
+		if n%ctxCheckRecords == 0 && ctx.Err() != nil {
+			// the files being read are closed right away, and the
+			// reading cannot resume
+			decoder.close()
+			w.decoder = nil
+			state.Reset()
+			return nil, state, fmt.Errorf("wal: reading aborted: %w", ctx.Err())
+		}
 		switch rec.Type {
 		case entryType:
-			e := mustUnmarshalEntry(rec.Data)
+			var e raftpb.Entry
+			if w.entryFilter != nil {
+				// the entries filtered out are passed to fn without
+				// their data, which is not unmarshaled
+				if e, err = entryHead(rec.Data); err == nil && w.entryFilter(e.Type) {
+					err = unmarshal(&e, rec.Data)
+				}
+			} else {
+				err = unmarshal(&e, rec.Data)
+			}
+			if err != nil {
+				state.Reset()
+				return nil, state, decoder.decodeError(rec.Type, err)
+			}
+			if e.Index > 0 {
+				cover(e.Index-1, e.Index)
+			}
+			if w.positioned && e.Index > 0 {
+				// entries are read from the first one after the position
+				w.start.Index = e.Index - 1
+				w.positioned = false
+			}
 			if e.Index > w.start.Index {
-				ents = append(ents[:e.Index-w.start.Index-1], e)
+				if err = fn(rec, &e); err != nil {
+					state.Reset()
+					return nil, state, err
+				}
+			}
+			if !w.readOnly && decoder.seq(decoder.i) == w.seq {
+				w.entryOffs = append(w.entryOffs, entryOffset{index: e.Index, off: decoder.lastOff, crc: prevCrc, state: state, frames: prevFrames})
 			}
 			w.enti = e.Index
 		case stateType:
-			state = mustUnmarshalState(rec.Data)
+			state.Reset()
+			if err = unmarshal(&state, rec.Data); err != nil {
+				state.Reset()
+				return nil, state, decoder.decodeError(rec.Type, err)
+			}
 		case metadataType:
-			if metadata != nil && !reflect.DeepEqual(metadata, rec.Data) {
+			md, _, err := decodeMetadata(rec.Data)
+			if err != nil {
+				state.Reset()
+				return nil, state, fmt.Errorf("%w in %q", err, decoder.name(decoder.i))
+			}
+			if metadata != nil && !reflect.DeepEqual(metadata, md) {
 				state.Reset()
-				return nil, state, nil, ErrMetadataConflict
+				return nil, state, &MetadataConflictError{File: decoder.name(decoder.i), Offset: decoder.lastOff,
+					Expected: metadata, Found: md, ExpectedFile: metadataFile}
 			}
-			metadata = rec.Data
+			if metadata == nil {
+				metadataFile = decoder.name(decoder.i)
+				// the files cut from now on get the metadata as it is
+				// recorded, so they keep its version
+				w.metadata = rec.Data
+			}
+			metadata = md
 		case crcType:
-			crc := decoder.crc.Sum32()
+			if isEncryptedFormat(rec.Data) && decoder.aead == nil {
+				state.Reset()
+				return nil, state, ErrKeyRequired
+			}
+			crc := decoder.crc.Sum64()
+			want := recordCrc(rec)
 			// current crc of decoder must match the crc of the record.
 			// do no need to match 0 crc, since the decoder is a new one at this case.
-			if crc != 0 && rec.Validate(crc) != nil {
+			// the crc chain is broken once a corrupted range is skipped.
+			if crc != 0 && len(decoder.skipped) == 0 && decoder.checksum.validate(rec, crc) != nil {
 				state.Reset()
-				return nil, state, nil, ErrCRCMismatch
+				return nil, state, decoder.crcError(crcType, want, crc)
 			}
-			decoder.updateCRC(rec.Crc)
+			decoder.updateCRC(want)
 		case snapshotType:
 			var snap walpb.Snapshot
-			pbutil.MustUnmarshal(&snap, rec.Data)
-			if snap.Index == w.start.Index {
+			if err = unmarshal(&snap, rec.Data); err != nil {
+				state.Reset()
+				return nil, state, decoder.decodeError(rec.Type, err)
+			}
+			cover(snap.Index, snap.Index)
+			if !positioned && !tooOld && snap.Index == w.start.Index {
 				if snap.Term != w.start.Term {
 					state.Reset()
-					return nil, state, nil, ErrSnapshotMismatch
+					return nil, state, ErrSnapshotMismatch
 				}
 				match = true
 			}
+			if snap.Index > w.snapi {
+				w.snapi = snap.Index
+			}
+			w.lastSnap = snap
+		case appDataType:
+			if w.appData != nil {
+				if err = w.appData(rec.Data); err != nil {
+					state.Reset()
+					return nil, state, err
+				}
+			}
+		case encryptedType:
+			// the decoder has no key to decrypt it
+			state.Reset()
+			return nil, state, ErrKeyRequired
 		default:
+			// the record may have been written by a newer version, so
+			// it must not be skipped.
 			state.Reset()
-			return nil, state, nil, fmt.Errorf("unexpected block type %d", rec.Type)
+			return nil, state, decoder.decodeError(rec.Type, ErrUnknownRecordType)
 		}
 	}
 	if err != io.EOF {
 		state.Reset()
-		return nil, state, nil, err
+		return nil, state, err
+	}
+	var frames frameSum
+	if !w.readOnly {
+		// discard the zero padding at the tail, so new records are
+		// appended right after the last valid one.
+		if err = w.truncateTail(decoder); err != nil {
+			state.Reset()
+			return nil, state, err
+		}
+		w.off = decoder.endOffset()
+		w.setSynced(w.seq, w.off)
+		if frames, err = w.tailFrames(decoder); err != nil {
+			state.Reset()
+			return nil, state, err
+		}
 	}
 	err = nil
-	if !match {
+	switch {
+	case match:
+	case tooOld:
+		err = ErrSnapshotTooOld
+	case w.start.Index > last:
+		err = ErrSnapshotTooNew
+	default:
 		err = ErrSnapshotNotFound
 	}
 
 	// close decoder, disable reading
 	w.decoder.close()
 	w.start = walpb.Snapshot{}
+	w.positioned = false
+	w.readSeq, w.readOff = w.Position()
 
-	w.metadata = metadata
-	// create encoder (chain crc with the decoder), enable appending
-	w.encoder = newEncoder(w.f, w.decoder.lastCRC())
+	w.checksum, w.padded = w.decoder.checksum, w.decoder.padded
+	if !w.readOnly {
+		// create encoder (chain crc with the decoder), enable appending
+		w.encoder = w.newEncoder(w.f, w.decoder.lastCRC())
+		w.encoder.resumeFrames(frames)
+	}
 	w.decoder = nil
-	return metadata, state, ents, err
+	return metadata, state, err
+}
+
+// tailFrames returns the frames of the file opened for appending, which
+// are counted by the decoder if it has read the file to the end, and are
+// read from the file otherwise.
+func (w *WAL) tailFrames(d *decoder) (frameSum, error) {
+	if w.f == nil {
+		return frameSum{}, nil
+	}
+	if i, _ := d.lastPosition(); i == len(d.names)-1 && d.seq(i) == w.seq {
+		return d.frameSum(), nil
+	}
+	return sumFrames(w.f.Name(), d.checksum, d.maxBytes)
+}
+
+// truncateTail truncates the file opened for appending at the end of its
+// last valid record, if the decoder has read it to the end.
+func (w *WAL) truncateTail(d *decoder) error {
+	i, _ := d.lastPosition()
+	if w.f == nil || i != len(d.names)-1 || d.seq(i) != w.seq {
+		return nil
+	}
+	fi, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	if off := d.endOffset(); fi.Size() > off {
+		return w.f.Truncate(off)
+	}
+	return nil
 }
 
 // Cut closes current file written and creates a new one ready to append.
 func (w *WAL) Cut() error {
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	w.lockAppend()
+	defer w.unlockAppend()
 	// create a new wal file with name sequence + 1
-	fpath := path.Join(w.dir, walName(w.seq+1, w.enti+1))
-	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	f, err := w.createNext()
 	if err != nil {
 		return err
 	}
+	w.mu.Lock()
+	w.cuts++
+	w.mu.Unlock()
+	if w.observer != nil {
+		w.observer.ObserveCut()
+	}
+	if err = w.finalize(); err != nil {
+		return err
+	}
+	return w.startFile(f)
+}
+
+// createNext creates and locks the WAL file that follows the one being
+// appended, named after the last entry appended. The file is removed if it
+// cannot be set up, so it is not left behind without a header.
+func (w *WAL) createNext() (*os.File, error) {
+	fpath := filepath.Join(w.dir, walName(w.seq+1, w.enti+1))
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, w.fileMode)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*os.File, error) {
+		f.Close()
+		os.Remove(fpath)
+		return nil, err
+	}
+	if err := w.preallocate(f); err != nil {
+		return fail(err)
+	}
 	l, err := fileutil.NewLock(f.Name())
 	if err != nil {
-		return err
+		return fail(err)
 	}
 	err = l.Lock()
 	if err != nil {
-		return err
+		l.Destroy()
+		return fail(err)
 	}
+	w.mu.Lock()
 	w.locks = append(w.locks, l)
-	if err = w.sync(); err != nil {
+	w.mu.Unlock()
+	return f, nil
+}
+
+// finalize ends the file being appended with its footer, and closes it.
+func (w *WAL) finalize() error {
+	if err := w.saveFooter(); err != nil {
+		return err
+	}
+	// drop the preallocated space of the finalized file, so it ends with
+	// its footer, and zeros are only found at the tail of the last file
+	if err := w.encoder.flush(); err != nil {
+		return err
+	}
+	if err := w.f.Truncate(w.off); err != nil {
+		return err
+	}
+	if err := w.sync(); err != nil {
 		return err
 	}
-	w.f.Close()
+	return w.closeFile()
+}
 
+// startFile makes f, created by createNext, the file being appended, and
+// writes its header: the crc chained from the previous file, the metadata
+// and the state.
+func (w *WAL) startFile(f *os.File) error {
 	// update writer and save the previous crc
 	w.f = f
 	w.seq++
-	prevCrc := w.encoder.crc.Sum32()
-	w.encoder = newEncoder(w.f, prevCrc)
+	w.off, w.entryOffs = 0, nil
+	prevCrc := w.encoder.crc.Sum64()
+	w.encoder = w.newEncoder(w.f, prevCrc)
 	if err := w.saveCrc(prevCrc); err != nil {
 		return err
 	}
-	if err := w.encoder.encode(&walpb.Record{Type: metadataType, Data: w.metadata}); err != nil {
+	if err := w.encodeSealed(&walpb.Record{Type: metadataType, Data: w.metadata}); err != nil {
 		return err
 	}
 	if err := w.saveState(&w.state); err != nil {
 		return err
 	}
+	if err := w.sync(); err != nil {
+		return err
+	}
+	// sync the directory, so the new file is not lost on a power failure
+	return syncDir(w.dir)
+}
+
+// Truncate discards the entries after the given index, together with all
+// the records appended after the first of them, by truncating the file
+// being appended. The state is rolled back to the one saved before the
+// first discarded entry, with its commit index lowered to the index if it
+// is after it. The index must not be before the start of the file, unlike
+// with TruncateAfter. The WAL must be in append mode.
+func (w *WAL) Truncate(index uint64) error {
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	w.lockAppend()
+	defer w.unlockAppend()
+	_, start, err := parseWalName(filepath.Base(w.f.Name()))
+	if err != nil {
+		return err
+	}
+	if index+1 < start {
+		return ErrTruncateIndex
+	}
+	return w.truncate(index)
+}
+
+// truncate discards the entries of the file being appended after the
+// given index.
+func (w *WAL) truncate(index uint64) error {
+	// entries may be overwritten by later ones with smaller indexes, so
+	// search backwards for the first one of the entries after index
+	i := len(w.entryOffs)
+	for i > 0 && w.entryOffs[i-1].index > index {
+		i--
+	}
+	if i == len(w.entryOffs) {
+		return nil
+	}
+	eo := w.entryOffs[i]
+	if err := w.encoder.flush(); err != nil {
+		return err
+	}
+	if err := w.f.Truncate(eo.off); err != nil {
+		return err
+	}
+	w.encoder = w.newEncoder(w.f, eo.crc)
+	w.encoder.resumeFrames(eo.frames)
+	w.off, w.entryOffs = eo.off, w.entryOffs[:i]
+	w.enti, w.state = index, eo.state
+	if eo.state.Commit > index {
+		// the state is appended with its commit index clamped, so the
+		// one read back does not commit the discarded entries
+		st := clampCommit(eo.state, index)
+		if err := w.saveState(&st); err != nil {
+			return err
+		}
+	}
 	return w.sync()
 }
 
+// clampCommit returns the state with its commit index lowered to the given
+// index if it is after it, since the entries after the index are discarded
+// and raft cannot restart with a commit index beyond its last entry.
+func clampCommit(st raftpb.HardState, index uint64) raftpb.HardState {
+	if st.Commit > index {
+		st.Commit = index
+	}
+	return st
+}
+
+// preallocate allocates the bytes on disk of the new WAL file f, if
+// preallocation is enabled.
+func (w *WAL) preallocate(f *os.File) error {
+	if w.prealloc <= 0 {
+		return nil
+	}
+	return preallocateFile(f, w.prealloc)
+}
+
 func (w *WAL) sync() error {
 	if w.encoder != nil {
 		if err := w.encoder.flush(); err != nil {
 			return err
 		}
 	}
-	return w.f.Sync()
+	if err := w.syncFile(w.f); err != nil {
+		return err
+	}
+	w.setSynced(w.seq, w.off)
+	return nil
+}
+
+// setSynced records that the WAL is synced up to the given offset in the
+// file of the given sequence.
+func (w *WAL) setSynced(seq uint64, off int64) {
+	w.mu.Lock()
+	w.syncedSeq, w.syncedOff = seq, off
+	w.mu.Unlock()
+}
+
+// syncFile syncs the file, and records the duration of the sync.
+func (w *WAL) syncFile(f *os.File) error {
+	start := time.Now()
+	err := f.Sync()
+	took := time.Since(start)
+	if took > WarnSyncDuration {
+		logger.Warningf("wal: sync took %v, longer than %v, the disk may be too slow", took, WarnSyncDuration)
+	}
+
+	w.mu.Lock()
+	w.syncs++
+	w.syncDuration += took
+	if took > w.maxSync {
+		w.maxSync = took
+	}
+	w.mu.Unlock()
+	if w.observer != nil {
+		w.observer.ObserveSync(took)
+	}
+	return err
 }
 
-// ReleaseLockTo releases the locks w is holding, which
-// have index smaller or equal to the given index.
+// ReleaseLockTo releases the locks w is holding, which have index smaller
+// than the given index, except the one that covers the given index.
+// The covering file is still needed to open the WAL at the given index,
+// so it is kept locked and cannot be purged.
+// For example, if WAL is holding lock 1,3,5,7, ReleaseLockTo(6) will release
+// lock 1 and 3 but keep 5. The lock of the last file is never released,
+// even if the index is beyond the last saved entry.
 func (w *WAL) ReleaseLockTo(index uint64) error {
-	for _, l := range w.locks {
-		_, i, err := parseWalName(path.Base(l.Name()))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.releaseCount(index)
+	if err != nil {
+		return err
+	}
+	for i, l := range w.locks[:n] {
+		if err = l.Unlock(); err == nil {
+			err = l.Destroy()
+		}
 		if err != nil {
+			w.locks = w.locks[i:]
 			return err
 		}
+	}
+	w.locks = w.locks[n:]
+	return nil
+}
+
+// LockedFiles returns the base names of the WAL files that w is holding
+// locks on, in increasing order.
+func (w *WAL) LockedFiles() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return lockNames(w.locks)
+}
+
+// FilesReleasedBy returns the base names of the WAL files that would be
+// unlocked by calling ReleaseLockTo with the given index, in increasing order.
+// It returns an error if the name of a locked file cannot be parsed, as
+// ReleaseLockTo does.
+func (w *WAL) FilesReleasedBy(index uint64) ([]string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.releaseCount(index)
+	if err != nil {
+		return nil, err
+	}
+	return lockNames(w.locks[:n]), nil
+}
+
+// releaseCount returns the number of the leading locks that can be
+// released up to the given index. The lock of the file covering the
+// given index is never counted.
+func (w *WAL) releaseCount(index uint64) (int, error) {
+	n := 0
+	for ; n+1 < len(w.locks); n++ {
+		_, i, err := parseWalName(filepath.Base(w.locks[n+1].Name()))
+		if err != nil {
+			return 0, err
+		}
 		if i > index {
-			return nil
+			break
 		}
-		err = l.Unlock()
-		if err != nil {
+	}
+	return n, nil
+}
+
+// Close syncs and closes the files of the WAL, and releases their locks.
+// All the locks are released even if some fail, and the first failure is
+// returned. Calling Close again does nothing.
+func (w *WAL) Close() error {
+	if w.decoder != nil {
+		if err := w.decoder.close(); err != nil {
 			return err
 		}
-		err = l.Destroy()
-		if err != nil {
+		w.decoder = nil
+	}
+	if w.f != nil {
+		w.lockAppend()
+		defer w.unlockAppend()
+		if err := w.sync(); err != nil {
+			return err
+		}
+		if err := w.closeFile(); err != nil {
 			return err
 		}
-		w.locks = w.locks[1:]
+		w.f = nil
 	}
-	return nil
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var lerr error
+	for _, l := range w.locks {
+		if err := l.Unlock(); err != nil {
+			logger.Warningf("wal: unlock %s error: %v", l.Name(), err)
+			if lerr == nil {
+				lerr = err
+			}
+		}
+		if err := l.Destroy(); err != nil {
+			logger.Warningf("wal: destroy lock %s error: %v", l.Name(), err)
+			if lerr == nil {
+				lerr = err
+			}
+		}
+	}
+	w.locks = nil
+	return lerr
 }
 
-func (w *WAL) Close() error {
+// Reset reinitializes the directory of the WAL in place. It closes the
+// files of the WAL, removes all the WAL files in the directory, and creates
+// a new first file with the given metadata. The locks on the old files are
+// held until the new file replaces them. The WAL keeps its options, and is
+// ready for appending even if it was opened for reading. The new file is
+// written under a temporary name first, and the old files are removed
+// newest first, so a crash during Reset leaves either a valid prefix of the
+// old WAL, or only the new file under its temporary name, which Open then
+// renames into place. A WAL spread over several directories only has the
+// files in its first directory removed.
+func (w *WAL) Reset(metadata []byte) error {
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if w.decoder != nil {
+		if err := w.decoder.close(); err != nil {
+			return err
+		}
+		w.decoder = nil
+	}
+	w.lockAppend()
+	defer w.unlockAppend()
 	if w.f != nil {
 		if err := w.sync(); err != nil {
 			return err
 		}
-		if err := w.f.Close(); err != nil {
+		if err := w.closeFile(); err != nil {
 			return err
 		}
+		w.f = nil
 	}
-	for _, l := range w.locks {
-		// TODO: log the error
+
+	// write the new file under a temporary name, which is not a WAL file
+	// name, so the old WAL is intact until it is removed. The lock on the
+	// new file tells Open that the Reset is in progress.
+	fpath := filepath.Join(w.dir, walName(0, 0))
+	tmp := fpath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, w.fileMode)
+	if err != nil {
+		return err
+	}
+	l, err := fileutil.NewLock(tmp)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err = l.Lock(); err != nil {
+		l.Destroy()
+		f.Close()
+		return err
+	}
+	// fail releases the lock on the new file and removes it, so the old
+	// WAL is left as it was if no old file is removed yet
+	fail := func(err error) error {
+		f.Close()
+		w.f = nil
+		os.Remove(tmp)
 		l.Unlock()
 		l.Destroy()
+		return err
+	}
+	if err = w.preallocate(f); err != nil {
+		return fail(err)
+	}
+	w.f, w.seq, w.enti, w.snapi = f, 0, 0, 0
+	w.off, w.entryOffs = 0, nil
+	w.metadata, w.state, w.start = encodeMetadata(metadata), raftpb.HardState{}, walpb.Snapshot{}
+	w.positioned, w.readSeq, w.readOff = false, 0, 0
+	w.encoder = w.newEncoder(f, 0)
+	if err = w.saveCrc(0); err != nil {
+		return fail(err)
+	}
+	if err = w.encodeSealed(&walpb.Record{Type: metadataType, Data: w.metadata}); err != nil {
+		return fail(err)
+	}
+	if err = w.saveSnapshot(walpb.Snapshot{}); err != nil {
+		return fail(err)
 	}
+	if err = w.sync(); err != nil {
+		return fail(err)
+	}
+	if err = f.Close(); err != nil {
+		return fail(err)
+	}
+	if err = syncDir(w.dir); err != nil {
+		return fail(err)
+	}
+
+	names, err := fileutil.ReadDir(w.dir)
+	if err != nil {
+		return fail(err)
+	}
+	names = checkWalNames(names)
+	// remove the newest files first, so a crash leaves a valid prefix
+	for i := len(names) - 1; i >= 0; i-- {
+		if err = os.Remove(filepath.Join(w.dir, names[i])); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(tmp, fpath); err != nil {
+		return err
+	}
+	if err = syncDir(w.dir); err != nil {
+		return err
+	}
+
+	// reopen the file at its final path to append to it
+	if w.f, err = os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND, 0); err != nil {
+		return err
+	}
+	w.reopenEncoder()
+	w.mu.Lock()
+	for _, ol := range w.locks {
+		ol.Unlock()
+		ol.Destroy()
+	}
+	// the lock is held on the renamed file
+	w.locks = []fileutil.Lock{&renamedLock{l: l, name: fpath}}
+	w.mu.Unlock()
 	return nil
 }
 
+// renamedLock is a lock taken on a file that was renamed since, whose
+// name is the new one.
+type renamedLock struct {
+	l    fileutil.Lock
+	name string
+}
+
+func (l *renamedLock) Name() string   { return l.name }
+func (l *renamedLock) TryLock() error { return l.l.TryLock() }
+func (l *renamedLock) Lock() error    { return l.l.Lock() }
+func (l *renamedLock) Unlock() error  { return l.l.Unlock() }
+func (l *renamedLock) Destroy() error { return l.l.Destroy() }
+
 func (w *WAL) saveEntry(e *raftpb.Entry) error {
-	b := pbutil.MustMarshal(e)
-	rec := &walpb.Record{Type: entryType, Data: b}
-	if err := w.encoder.encode(rec); err != nil {
+	w.scratch = resize(w.scratch, e.Size())
+	if _, err := e.MarshalTo(w.scratch); err != nil {
+		return err
+	}
+	rec, err := w.setEntryRecord(&w.rec, w.scratch)
+	if err != nil {
+		return err
+	}
+	eo := entryOffset{index: e.Index, off: w.off, crc: w.encoder.crc.Sum64(), state: w.state, frames: w.encoder.frameSum()}
+	if err := w.encode(rec); err != nil {
 		return err
 	}
-	w.enti = e.Index
+	w.entrySaved(e.Index, eo)
 	return nil
 }
 
+// entryRecord returns the record of the entry, compressed and encrypted
+// if enabled.
+func (w *WAL) entryRecord(e *raftpb.Entry) (*walpb.Record, error) {
+	return w.setEntryRecord(&walpb.Record{}, pbutil.MustMarshal(e))
+}
+
+// setEntryRecord sets rec to the record of the entry marshaled in b, and
+// returns the record to append.
+func (w *WAL) setEntryRecord(rec *walpb.Record, b []byte) (*walpb.Record, error) {
+	*rec = walpb.Record{Type: entryType, Data: b}
+	if w.cp != nil {
+		if cb, ok := w.cp.compress(b); ok {
+			*rec = walpb.Record{Type: compressedEntryType, Data: cb}
+		}
+	}
+	return w.seal(rec)
+}
+
+// entrySaved records that the entry at the given location is appended.
+func (w *WAL) entrySaved(index uint64, eo entryOffset) {
+	w.entryOffs = append(w.entryOffs, eo)
+	w.mu.Lock()
+	w.entries++
+	w.mu.Unlock()
+	w.enti = index
+}
+
 func (w *WAL) saveState(s *raftpb.HardState) error {
 	if raft.IsEmptyHardState(*s) {
 		return nil
 	}
 	w.state = *s
-	b := pbutil.MustMarshal(s)
-	rec := &walpb.Record{Type: stateType, Data: b}
-	return w.encoder.encode(rec)
+	w.scratch = resize(w.scratch, s.Size())
+	if _, err := s.MarshalTo(w.scratch); err != nil {
+		return err
+	}
+	w.rec = walpb.Record{Type: stateType, Data: w.scratch}
+	return w.encodeSealed(&w.rec)
 }
 
+// Save appends the given HardState and entries to the WAL, and syncs them
+// to disk before returning. The sync is skipped unless entries are given
+// or the term or vote changes, since raft does not need the commit index
+// to be durable. A HardState with only a new commit index is still
+// appended, and is synced with the records appended after it.
 func (w *WAL) Save(st raftpb.HardState, ents []raftpb.Entry) error {
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if w.gc != nil {
+		return w.groupSave(st, ents)
+	}
+	w.lockAppend()
+	defer w.unlockAppend()
+	sync := mustSync(st, w.state, len(ents))
+	if err := w.saveNoSync(st, ents); err != nil {
+		return err
+	}
+	if !sync {
+		return nil
+	}
+	return w.sync()
+}
+
+// mustSync returns whether saving the given HardState and number of entries
+// after prev must be synced before the messages of raft are sent.
+func mustSync(st, prev raftpb.HardState, entsnum int) bool {
+	// the term, the vote and the entries must be on stable storage before
+	// responding to RPCs, while the commit index is recovered from peers.
+	// An empty HardState is not saved, so it leaves them unchanged.
+	if raft.IsEmptyHardState(st) {
+		return entsnum != 0
+	}
+	return entsnum != 0 || st.Vote != prev.Vote || st.Term != prev.Term
+}
+
+// SaveNoSync appends the given HardState and entries to the WAL without
+// syncing them to disk. The records may still be buffered in memory when it
+// returns, and they are lost on crash until a following Sync, Save,
+// SaveSnapshot or Cut returns successfully. It allows the caller to save
+// several batches and pay for a single sync.
+func (w *WAL) SaveNoSync(st raftpb.HardState, ents []raftpb.Entry) error {
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if w.gc != nil {
+		_, _, err := w.groupAppend(st, ents)
+		return err
+	}
+	w.lockAppend()
+	defer w.unlockAppend()
+	return w.saveNoSync(st, ents)
+}
+
+func (w *WAL) saveNoSync(st raftpb.HardState, ents []raftpb.Entry) error {
+	w.mu.Lock()
+	before := w.bytesWritten
+	w.mu.Unlock()
 	// TODO(xiangli): no more reference operator
 	if err := w.saveState(&st); err != nil {
 		return err
 	}
-	for i := range ents {
-		if err := w.saveEntry(&ents[i]); err != nil {
+	if w.crcWorkers > 1 && len(ents) > 1 {
+		if err := w.saveEntriesParallel(ents); err != nil {
 			return err
 		}
+	} else {
+		for i := range ents {
+			if err := w.saveEntry(&ents[i]); err != nil {
+				return err
+			}
+		}
+	}
+	w.mu.Lock()
+	w.saves++
+	n := w.bytesWritten - before
+	w.mu.Unlock()
+	if w.observer != nil {
+		w.observer.ObserveSave(n)
+	}
+	return nil
+}
+
+// Sync flushes the buffered records and syncs the file being appended to
+// disk. Once it returns successfully, all the records appended before it
+// are durable, including the ones appended by SaveNoSync: the WAL reopened
+// after a crash reads them. The WAL directory is not synced, since Create
+// and Cut already sync it when they add a file.
+func (w *WAL) Sync() error {
+	if w.readOnly {
+		return ErrReadOnly
 	}
+	if w.gc != nil {
+		w.gc.appendMu.Lock()
+		seq := w.gc.appended
+		w.gc.appendMu.Unlock()
+		return w.groupSync(seq)
+	}
+	w.lockAppend()
+	defer w.unlockAppend()
 	return w.sync()
 }
 
+// SaveSnapshot appends the given snapshot to the WAL, and syncs it to disk.
+// The snapshot index must be after the one of the last snapshot saved, or
+// SaveSnapshot returns ErrSnapshotOutOfOrder, except for the empty snapshot
+// before any other is saved.
 func (w *WAL) SaveSnapshot(e walpb.Snapshot) error {
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	w.lockAppend()
+	defer w.unlockAppend()
+	if err := w.saveSnapshot(e); err != nil {
+		return err
+	}
+	return w.sync()
+}
+
+// SaveAppData appends the given application data to the WAL as a record
+// of its own, and syncs it to disk, so it is durable in order with the
+// entries. The data is passed back when reading the WAL to the function
+// given by WithAppData. Compact drops the application data.
+func (w *WAL) SaveAppData(b []byte) error {
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	w.lockAppend()
+	defer w.unlockAppend()
+	if err := w.encodeSealed(&walpb.Record{Type: appDataType, Data: b}); err != nil {
+		return err
+	}
+	return w.sync()
+}
+
+// SaveSnapshotAndState appends the given snapshot and HardState to the WAL,
+// and syncs them to disk with a single fsync, so they are durable together.
+// Calling SaveSnapshot and then Save leaves a window where a crash records
+// the snapshot without the HardState that accompanies it. The snapshot index
+// must be after the one of the last snapshot saved, as for SaveSnapshot.
+func (w *WAL) SaveSnapshotAndState(snap walpb.Snapshot, st raftpb.HardState) error {
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	w.lockAppend()
+	defer w.unlockAppend()
+	if err := w.saveSnapshot(snap); err != nil {
+		return err
+	}
+	if err := w.saveState(&st); err != nil {
+		return err
+	}
+	return w.sync()
+}
+
+func (w *WAL) saveSnapshot(e walpb.Snapshot) error {
+	if w.snapi > 0 && e.Index <= w.snapi {
+		return ErrSnapshotOutOfOrder
+	}
 	b := pbutil.MustMarshal(&e)
-	rec := &walpb.Record{Type: snapshotType, Data: b}
-	if err := w.encoder.encode(rec); err != nil {
+	if err := w.encodeSealed(&walpb.Record{Type: snapshotType, Data: b}); err != nil {
 		return err
 	}
 	// update enti only when snapshot is ahead of last index
 	if w.enti < e.Index {
 		w.enti = e.Index
 	}
-	return w.sync()
+	w.snapi, w.lastSnap = e.Index, e
+	return nil
+}
+
+func (w *WAL) saveCrc(prevCrc uint64) error {
+	rec := &walpb.Record{Type: crcType, Data: w.format(w.checksum)}
+	w.checksum.setCrc(rec, prevCrc)
+	return w.encode(rec)
+}
+
+// encode appends the record with the encoder, and counts the appended bytes.
+func (w *WAL) encode(rec *walpb.Record) error {
+	if err := w.encoder.encode(rec); err != nil {
+		return err
+	}
+	w.appended(rec)
+	return nil
 }
 
-func (w *WAL) saveCrc(prevCrc uint32) error {
-	return w.encoder.encode(&walpb.Record{Type: crcType, Crc: prevCrc})
+// appended counts the bytes of the record appended.
+func (w *WAL) appended(rec *walpb.Record) {
+	// the record is written after its length field, and padded
+	n := frameSize(rec.Size(), w.padded)
+	w.off += n
+	w.mu.Lock()
+	w.bytesWritten += n
+	w.mu.Unlock()
 }
@@ -15,11 +15,18 @@
 package wal
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/coreos/etcd/pkg/pbutil"
 	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/wal/walpb"
 )
 
 func BenchmarkWrite100EntryWithoutBatch(b *testing.B) { benchmarkWriteEntry(b, 100, 0) }
@@ -65,3 +72,399 @@ func benchmarkWriteEntry(b *testing.B, size int, batch int) {
 		}
 	}
 }
+
+func BenchmarkSaveWithoutPreallocation(b *testing.B) { benchmarkSave(b, 0) }
+func BenchmarkSaveWithPreallocation(b *testing.B)    { benchmarkSave(b, 64*1024*1024) }
+
+func benchmarkSave(b *testing.B, prealloc int64) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("somedata"), WithPreallocateBytes(prealloc))
+	if err != nil {
+		b.Fatalf("err = %v, want nil", err)
+	}
+	defer w.Close()
+	data := make([]byte, 100)
+	for i := 0; i < len(data); i++ {
+		data[i] = byte(i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		es := []raftpb.Entry{{Index: uint64(i + 1), Data: data}}
+		if err := w.Save(raftpb.HardState{}, es); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSaveSyncEach(b *testing.B)       { benchmarkSaveNoSync(b, 1) }
+func BenchmarkSaveNoSyncBatch10(b *testing.B)  { benchmarkSaveNoSync(b, 10) }
+func BenchmarkSaveNoSyncBatch100(b *testing.B) { benchmarkSaveNoSync(b, 100) }
+
+// benchmarkSaveNoSync saves an entry per iteration, and syncs once every
+// batch entries.
+func benchmarkSaveNoSync(b *testing.B, batch int) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("somedata"))
+	if err != nil {
+		b.Fatalf("err = %v, want nil", err)
+	}
+	defer w.Close()
+	data := make([]byte, 100)
+	for i := 0; i < len(data); i++ {
+		data[i] = byte(i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		es := []raftpb.Entry{{Index: uint64(i + 1), Data: data}}
+		if err := w.SaveNoSync(raftpb.HardState{}, es); err != nil {
+			b.Fatal(err)
+		}
+		if (i+1)%batch == 0 {
+			if err := w.Sync(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkSaveConcurrent100(b *testing.B) { benchmarkSaveConcurrent(b, 100) }
+func BenchmarkSaveConcurrent100GroupCommit(b *testing.B) {
+	benchmarkSaveConcurrent(b, 100, WithGroupCommit())
+}
+func BenchmarkSaveConcurrent100GroupCommitWindow(b *testing.B) {
+	benchmarkSaveConcurrent(b, 100, WithGroupCommitWindow(100*time.Microsecond))
+}
+
+// benchmarkSaveConcurrent saves an entry per iteration from the given
+// number of goroutines. Without group commit, the Saves are serialized
+// by a mutex and each pays for its own fsync.
+func benchmarkSaveConcurrent(b *testing.B, savers int, opts ...Option) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("somedata"), opts...)
+	if err != nil {
+		b.Fatalf("err = %v, want nil", err)
+	}
+	defer w.Close()
+	data := make([]byte, 100)
+	for i := 0; i < len(data); i++ {
+		data[i] = byte(i)
+	}
+
+	groupCommit := w.gc != nil
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for i := 0; i < savers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < b.N; j += savers {
+				es := []raftpb.Entry{{Index: uint64(j + 1), Data: data}}
+				if !groupCommit {
+					mu.Lock()
+				}
+				err := w.Save(raftpb.HardState{}, es)
+				if !groupCommit {
+					mu.Unlock()
+				}
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func BenchmarkSave4KBJSON(b *testing.B)       { benchmarkSaveJSON(b, CompressionNone) }
+func BenchmarkSave4KBJSONFlate(b *testing.B)  { benchmarkSaveJSON(b, CompressionFlate) }
+func BenchmarkSave4KBJSONSnappy(b *testing.B) { benchmarkSaveJSON(b, CompressionSnappy) }
+func BenchmarkSave4KBJSONZstd(b *testing.B)   { benchmarkSaveJSON(b, CompressionZstd) }
+func BenchmarkSave4KBJSONGzip(b *testing.B)   { benchmarkSaveJSON(b, CompressionGzip) }
+
+// benchmarkSaveJSON saves entries of about 4KB of JSON-like data with the
+// given compression, and reports the bytes appended per entry.
+func benchmarkSaveJSON(b *testing.B, c Compression) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("somedata"), WithCompression(c))
+	if err != nil {
+		b.Fatalf("err = %v, want nil", err)
+	}
+	defer w.Close()
+	data := jsonData()
+
+	b.SetBytes(int64(len(data)))
+	start := w.BytesWritten()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		es := []raftpb.Entry{{Index: uint64(i + 1), Data: data}}
+		if err := w.Save(raftpb.HardState{}, es); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(w.BytesWritten()-start)/float64(b.N), "disk-B/op")
+}
+
+// jsonData returns about 4KB of JSON-like data, as stored by etcd in the
+// entries.
+func jsonData() []byte {
+	var data []byte
+	for i := 0; len(data) < 4096; i++ {
+		data = append(data, fmt.Sprintf(`{"action":"set","node":{"key":"/registry/pods/%d","value":"{\"status\":\"running\",\"host\":\"10.0.0.%d\"}","modifiedIndex":%d}}`, i, i%256, i*7)...)
+	}
+	return data[:4096]
+}
+
+func BenchmarkReadAll4KBJSON(b *testing.B)       { benchmarkReadAllJSON(b, CompressionNone) }
+func BenchmarkReadAll4KBJSONFlate(b *testing.B)  { benchmarkReadAllJSON(b, CompressionFlate) }
+func BenchmarkReadAll4KBJSONSnappy(b *testing.B) { benchmarkReadAllJSON(b, CompressionSnappy) }
+func BenchmarkReadAll4KBJSONZstd(b *testing.B)   { benchmarkReadAllJSON(b, CompressionZstd) }
+func BenchmarkReadAll4KBJSONGzip(b *testing.B)   { benchmarkReadAllJSON(b, CompressionGzip) }
+
+// benchmarkReadAllJSON reads back 1000 entries of about 4KB of JSON-like
+// data saved with the given compression.
+func benchmarkReadAllJSON(b *testing.B, c Compression) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("somedata"), WithCompression(c))
+	if err != nil {
+		b.Fatalf("err = %v, want nil", err)
+	}
+	data := jsonData()
+	for i := 0; i < 1000; i++ {
+		es := []raftpb.Entry{{Index: uint64(i + 1), Data: data}}
+		if err = w.SaveNoSync(raftpb.HardState{}, es); err != nil {
+			b.Fatal(err)
+		}
+	}
+	w.Close()
+
+	b.SetBytes(int64(1000 * len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w, err := Open(p, walpb.Snapshot{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, _, err = w.ReadAll(); err != nil {
+			b.Fatal(err)
+		}
+		w.Close()
+	}
+}
+
+func BenchmarkSave16x256KBEntries(b *testing.B)            { benchmarkSaveLargeEntries(b, 0) }
+func BenchmarkSave16x256KBEntriesParallelCRC(b *testing.B) { benchmarkSaveLargeEntries(b, 4) }
+
+// benchmarkSaveLargeEntries saves 16 entries of 256KB per iteration,
+// checksummed on the given number of goroutines.
+func benchmarkSaveLargeEntries(b *testing.B, workers int) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("somedata"), WithParallelCRC(workers))
+	if err != nil {
+		b.Fatalf("err = %v, want nil", err)
+	}
+	defer w.Close()
+	data := make([]byte, 256*1024)
+	for i := 0; i < len(data); i++ {
+		data[i] = byte(i)
+	}
+
+	b.SetBytes(16 * int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		es := make([]raftpb.Entry, 16)
+		for j := range es {
+			es[j] = raftpb.Entry{Index: uint64(i*16 + j + 1), Data: data}
+		}
+		if err := w.SaveNoSync(raftpb.HardState{}, es); err != nil {
+			b.Fatal(err)
+		}
+		// cut before the file grows too large, as etcd does
+		if (i+1)%16 == 0 {
+			if err := w.Cut(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkSaveNoSyncAllocs reports the allocations of appending an entry
+// and a HardState, which should be near zero in steady state.
+func BenchmarkSaveNoSyncAllocs(b *testing.B) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("somedata"))
+	if err != nil {
+		b.Fatalf("err = %v, want nil", err)
+	}
+	defer w.Close()
+	data := make([]byte, 100)
+	for i := 0; i < len(data); i++ {
+		data[i] = byte(i)
+	}
+	es := make([]raftpb.Entry, 1)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		es[0] = raftpb.Entry{Index: uint64(i + 1), Term: 1, Data: data}
+		st := raftpb.HardState{Term: 1, Commit: uint64(i + 1)}
+		if err := w.SaveNoSync(st, es); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSave32KBEntriesBuffer4KB(b *testing.B)   { benchmarkSaveBufferSize(b, 4*1024) }
+func BenchmarkSave32KBEntriesBuffer64KB(b *testing.B)  { benchmarkSaveBufferSize(b, 64*1024) }
+func BenchmarkSave32KBEntriesBuffer256KB(b *testing.B) { benchmarkSaveBufferSize(b, 256*1024) }
+func BenchmarkSave32KBEntriesBuffer1MB(b *testing.B)   { benchmarkSaveBufferSize(b, 1024*1024) }
+
+// benchmarkSaveBufferSize saves an entry of 32KB per iteration through a
+// write buffer of the given size, and syncs once every 64 entries.
+func benchmarkSaveBufferSize(b *testing.B, size int) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("somedata"), WithWriteBufferSize(size))
+	if err != nil {
+		b.Fatalf("err = %v, want nil", err)
+	}
+	defer w.Close()
+	data := make([]byte, 32*1024)
+	for i := 0; i < len(data); i++ {
+		data[i] = byte(i)
+	}
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		es := []raftpb.Entry{{Index: uint64(i + 1), Data: data}}
+		if err := w.SaveNoSync(raftpb.HardState{}, es); err != nil {
+			b.Fatal(err)
+		}
+		if (i+1)%64 == 0 {
+			if err := w.Sync(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkRoundTrip1000x100B(b *testing.B)          { benchmarkRoundTrip(b, 1000, 100, 1) }
+func BenchmarkRoundTrip1000x100B4Segments(b *testing.B) { benchmarkRoundTrip(b, 1000, 100, 4) }
+func BenchmarkRoundTrip1000x4KB(b *testing.B)           { benchmarkRoundTrip(b, 1000, 4*1024, 1) }
+func BenchmarkRoundTrip1000x4KB4Segments(b *testing.B)  { benchmarkRoundTrip(b, 1000, 4*1024, 4) }
+func BenchmarkRoundTrip100x64KB4Segments(b *testing.B)  { benchmarkRoundTrip(b, 100, 64*1024, 4) }
+
+// benchmarkRoundTrip encodes n entries of the given size per iteration into
+// memory with the encoder, and decodes them back with the decoder, so the
+// framing is measured without disk I/O. The entries are split into the
+// given number of segments, each starting with a crc record that chains
+// the crc from the segment before, as after a Cut.
+func benchmarkRoundTrip(b *testing.B, n, size, segments int) {
+	data := make([]byte, size)
+	for i := 0; i < len(data); i++ {
+		data[i] = byte(i)
+	}
+	recs := make([]walpb.Record, n)
+	for i := range recs {
+		e := raftpb.Entry{Index: uint64(i + 1), Term: 1, Data: data}
+		recs[i] = walpb.Record{Type: entryType, Data: pbutil.MustMarshal(&e)}
+	}
+	bufs := make([]bytes.Buffer, segments)
+	per := (n + segments - 1) / segments
+
+	b.SetBytes(int64(n * size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var prevCrc uint64
+		for s := range bufs {
+			bufs[s].Reset()
+			enc := newEncoder(&bufs[s], prevCrc, ChecksumCRC32C)
+			if err := enc.encode(&walpb.Record{Type: crcType, Data: formatData(ChecksumCRC32C, false)}); err != nil {
+				b.Fatal(err)
+			}
+			for j := s * per; j < (s+1)*per && j < n; j++ {
+				if err := enc.encode(&recs[j]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := enc.flush(); err != nil {
+				b.Fatal(err)
+			}
+			prevCrc = enc.crc.Sum64()
+		}
+
+		rcs := make([]io.ReadCloser, segments)
+		for s := range bufs {
+			rcs[s] = ioutil.NopCloser(bytes.NewReader(bufs[s].Bytes()))
+		}
+		d := newDecoder(rcs...)
+		rec := &walpb.Record{}
+		var ents int
+		for {
+			err := d.decode(rec)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			switch rec.Type {
+			case entryType:
+				ents++
+			case crcType:
+				// the crc chain continues from the segment before
+				if c := d.lastCRC(); c != 0 && d.checksum.validate(rec, c) != nil {
+					b.Fatal(ErrCRCMismatch)
+				}
+				d.updateCRC(recordCrc(rec))
+			}
+		}
+		if ents != n {
+			b.Fatalf("decoded %d entries, want %d", ents, n)
+		}
+	}
+}
@@ -16,12 +16,20 @@ package wal
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/etcd/pkg/fileutil"
 	"github.com/coreos/etcd/pkg/pbutil"
 	"github.com/coreos/etcd/raft/raftpb"
 	"github.com/coreos/etcd/wal/walpb"
@@ -48,12 +56,12 @@ func TestNew(t *testing.T) {
 	}
 
 	var wb bytes.Buffer
-	e := newEncoder(&wb, 0)
-	err = e.encode(&walpb.Record{Type: crcType, Crc: 0})
+	e := newEncoder(&wb, 0, ChecksumCRC32C)
+	err = e.encode(&walpb.Record{Type: crcType, Crc: 0, Data: formatData(ChecksumCRC32C, false)})
 	if err != nil {
 		t.Fatalf("err = %v, want nil", err)
 	}
-	err = e.encode(&walpb.Record{Type: metadataType, Data: []byte("somedata")})
+	err = e.encode(&walpb.Record{Type: metadataType, Data: encodeMetadata([]byte("somedata"))})
 	if err != nil {
 		t.Fatalf("err = %v, want nil", err)
 	}
@@ -83,6 +91,232 @@ func TestNewForInitedDir(t *testing.T) {
 	}
 }
 
+func TestCreateAt(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+	p = path.Join(p, "wal")
+
+	snap := walpb.Snapshot{Index: 10, Term: 2}
+	w, err := CreateAt(p, []byte("metadata"), snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := path.Base(w.f.Name()); g != walName(0, 10) {
+		t.Errorf("name = %+v, want %+v", g, walName(0, 10))
+	}
+	w.Close()
+
+	// the WAL opens at the snapshot without any entry
+	if w, err = Open(p, snap); err != nil {
+		t.Fatal(err)
+	}
+	metadata, _, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "metadata")
+	}
+	if len(ents) != 0 {
+		t.Errorf("len(ents) = %d, want 0", len(ents))
+	}
+	wents := []raftpb.Entry{{Index: 11, Term: 2}, {Index: 12, Term: 2}}
+	if err = w.Save(raftpb.HardState{Term: 2, Commit: 12}, wents); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, snap); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, _, ents, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ents, wents) {
+		t.Errorf("ents = %+v, want %+v", ents, wents)
+	}
+}
+
+func TestCreateAfterInterruptedCreate(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(p)
+	defer os.RemoveAll(p)
+
+	// a crash before the rename leaves a partial WAL in the tmp dir
+	if err = os.MkdirAll(tmpDir(p), privateDirMode); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path.Join(tmpDir(p), walName(0, 0)), []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(p); !os.IsNotExist(err) {
+		t.Fatalf("err = %v, want not exist", err)
+	}
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if _, err = os.Stat(tmpDir(p)); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+
+	// Open removes a tmp dir left by another interrupted create
+	if err = os.MkdirAll(tmpDir(p), privateDirMode); err != nil {
+		t.Fatal(err)
+	}
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err = os.Stat(tmpDir(p)); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+	metadata, _, _, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "metadata")
+	}
+}
+
+func TestCreateTmpDir(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	// the tmp dir is removed if Create fails
+	errSync := errors.New("sync error")
+	syncDir = func(dir string) error { return errSync }
+	_, err = Create(p, []byte("metadata"))
+	syncDir = fileutil.SyncDir
+	if err != errSync {
+		t.Errorf("err = %v, want %v", err, errSync)
+	}
+	if _, err = os.Stat(tmpDir(p)); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+
+	// a dir holding only other files than WAL files is created into
+	if err = ioutil.WriteFile(path.Join(p, "other"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	names, err := fileutil.ReadDir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wnames := []string{walName(0, 0), "other"}; !reflect.DeepEqual(names, wnames) {
+		t.Errorf("names = %v, want %v", names, wnames)
+	}
+	if _, err = os.Stat(tmpDir(p)); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+	w.Close()
+
+	// the tmp dir of a Create in progress is not removed, and another
+	// Create of the same dir fails
+	if err = os.Mkdir(tmpDir(p), privateDirMode); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir(p))
+	l, err := fileutil.NewLock(tmpDir(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Destroy()
+	if err = l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if _, err = os.Stat(tmpDir(p)); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+	if err = os.Remove(path.Join(p, walName(0, 0))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Create(p, nil); !os.IsExist(err) {
+		t.Errorf("err = %v, want exist", err)
+	}
+	if _, err = os.Stat(tmpDir(p)); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
+
+func TestCreateWithMode(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(p)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil, WithFileMode(0640), WithDirMode(0750))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := fi.Mode().Perm(); m != 0750 {
+		t.Errorf("dir mode = %v, want %v", m, os.FileMode(0750))
+	}
+
+	// the mode given to Open applies to the files cut after reopening
+	if w, err = Open(p, walpb.Snapshot{}, WithFileMode(0640)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	for _, name := range []string{walName(0, 0), walName(1, 1), walName(2, 1)} {
+		if fi, err = os.Stat(path.Join(p, name)); err != nil {
+			t.Fatal(err)
+		}
+		if m := fi.Mode().Perm(); m != 0640 {
+			t.Errorf("%s: mode = %v, want %v", name, m, os.FileMode(0640))
+		}
+	}
+
+	if _, err = Open(p, walpb.Snapshot{}, WithFileMode(0666)); err != ErrWorldWritable {
+		t.Errorf("err = %v, want %v", err, ErrWorldWritable)
+	}
+	os.RemoveAll(p)
+	for _, opt := range []Option{WithFileMode(0666), WithDirMode(0777)} {
+		if _, err = Create(p, nil, opt); err != ErrWorldWritable {
+			t.Errorf("err = %v, want %v", err, ErrWorldWritable)
+		}
+	}
+}
+
 func TestOpenAtIndex(t *testing.T) {
 	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
 	if err != nil {
@@ -201,6 +435,50 @@ func TestCut(t *testing.T) {
 	}
 }
 
+func TestCutPreallocateError(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err = w.Save(raftpb.HardState{Term: 1}, []raftpb.Entry{{Index: 1, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new file is removed if it cannot be preallocated
+	errPrealloc := errors.New("preallocate error")
+	preallocateFile = func(f *os.File, n int64) error { return errPrealloc }
+	err = w.Cut()
+	preallocateFile = fileutil.Preallocate
+	if err != errPrealloc {
+		t.Fatalf("err = %v, want %v", err, errPrealloc)
+	}
+	names, err := fileutil.ReadDir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wnames := []string{walName(0, 0)}; !reflect.DeepEqual(names, wnames) {
+		t.Errorf("names = %v, want %v", names, wnames)
+	}
+	if names = w.LockedFiles(); !reflect.DeepEqual(names, []string{walName(0, 0)}) {
+		t.Errorf("locked files = %v, want %v", names, []string{walName(0, 0)})
+	}
+
+	// cutting again succeeds
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	if g, wname := path.Base(w.f.Name()), walName(1, 2); g != wname {
+		t.Errorf("name = %s, want %s", g, wname)
+	}
+}
+
 func TestRecover(t *testing.T) {
 	p, err := ioutil.TempDir(os.TempDir(), "waltest")
 	if err != nil {
@@ -301,6 +579,8 @@ func TestScanWalName(t *testing.T) {
 		{"0000000000000000-0000000000000000.wal", 0, 0, true},
 		{"0000000000000000.wal", 0, 0, false},
 		{"0000000000000000-0000000000000000.snap", 0, 0, false},
+		{"0000000000000000-0000000000000000.wal.broken", 0, 0, false},
+		{"0000000000000000-0000000000000000.wal.tmp", 0, 0, false},
 	}
 	for i, tt := range tests {
 		s, index, err := parseWalName(tt.str)
@@ -349,7 +629,7 @@ func TestRecoverAfterCut(t *testing.T) {
 		w, err := Open(p, walpb.Snapshot{Index: uint64(i)})
 		if err != nil {
 			if i <= 4 {
-				if err != ErrFileNotFound {
+				if !errors.Is(err, ErrFileNotFound) {
 					t.Errorf("#%d: err = %v, want %v", i, err, ErrFileNotFound)
 				}
 			} else {
@@ -432,6 +712,9 @@ func TestOpenNotInUse(t *testing.T) {
 		}
 	}
 	// release the lock to 5
+	// ReleaseLockTo keeps the file that covers index 5 locked, since the
+	// WAL is opened at index 5 from it, so only the files of the entries
+	// before it are released, and the last entry read is 4.
 	unlockIndex := uint64(5)
 	w.ReleaseLockTo(unlockIndex)
 
@@ -444,8 +727,8 @@ func TestOpenNotInUse(t *testing.T) {
 	if err != nil {
 		t.Fatalf("err = %v, want nil", err)
 	}
-	if g := ents[len(ents)-1].Index; g != unlockIndex {
-		t.Errorf("last index read = %d, want %d", g, unlockIndex)
+	if g := ents[len(ents)-1].Index; g != unlockIndex-1 {
+		t.Errorf("last index read = %d, want %d", g, unlockIndex-1)
 	}
 }
 
@@ -453,7 +736,7 @@ func TestSaveEmpty(t *testing.T) {
 	var buf bytes.Buffer
 	var est raftpb.HardState
 	w := WAL{
-		encoder: newEncoder(&buf, 0),
+		encoder: newEncoder(&buf, 0, ChecksumCRC32C),
 	}
 	if err := w.saveState(&est); err != nil {
 		t.Errorf("err = %v, want nil", err)
@@ -462,3 +745,3398 @@ func TestSaveEmpty(t *testing.T) {
 		t.Errorf("buf.Bytes = %d, want 0", len(buf.Bytes()))
 	}
 }
+
+// TestReleaseLockToAndPurge tests that the files released by ReleaseLockTo
+// can be purged, and the WAL can still be opened at the latest snapshot
+// after purging.
+func TestReleaseLockToAndPurge(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i := 1; i <= 10; i++ {
+		es := []raftpb.Entry{{Index: uint64(i)}}
+		if err = w.Save(raftpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.SaveSnapshot(walpb.Snapshot{Index: uint64(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.ReleaseLockTo(uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the files are purged up to the first one still locked
+	removed, err := fileutil.PurgeFileOnce(p, "wal", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 9 {
+		t.Errorf("removed = %v, want 9 files", removed)
+	}
+
+	names, err := fileutil.ReadDir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wnames := []string{walName(9, 10), walName(10, 11)}
+	if !reflect.DeepEqual(names, wnames) {
+		t.Errorf("names = %v, want %v", names, wnames)
+	}
+	w.Close()
+
+	w, err = Open(p, walpb.Snapshot{Index: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+	w.Close()
+}
+
+func TestOpenReader(t *testing.T) {
+	var buf bytes.Buffer
+	e := newEncoder(&buf, 0, ChecksumCRC32C)
+	snap := walpb.Snapshot{Index: 1, Term: 1}
+	ents := []raftpb.Entry{{Index: 2, Term: 1, Data: []byte{2}}, {Index: 3, Term: 1, Data: []byte{3}}}
+	st := raftpb.HardState{Term: 1, Vote: 1, Commit: 3}
+	recs := []*walpb.Record{
+		{Type: crcType, Crc: 0},
+		{Type: metadataType, Data: []byte("metadata")},
+		{Type: snapshotType, Data: pbutil.MustMarshal(&snap)},
+		{Type: entryType, Data: pbutil.MustMarshal(&ents[0])},
+		{Type: entryType, Data: pbutil.MustMarshal(&ents[1])},
+		{Type: stateType, Data: pbutil.MustMarshal(&st)},
+	}
+	for _, rec := range recs {
+		if err := e.encode(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := OpenReader(&buf, snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	metadata, state, entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "metadata")
+	}
+	if !reflect.DeepEqual(state, st) {
+		t.Errorf("state = %+v, want %+v", state, st)
+	}
+	if !reflect.DeepEqual(entries, ents) {
+		t.Errorf("ents = %+v, want %+v", entries, ents)
+	}
+
+	if err = w.Save(raftpb.HardState{}, ents); err != ErrReadOnly {
+		t.Errorf("err = %v, want %v", err, ErrReadOnly)
+	}
+	if err = w.SaveSnapshot(snap); err != ErrReadOnly {
+		t.Errorf("err = %v, want %v", err, ErrReadOnly)
+	}
+	if err = w.Cut(); err != ErrReadOnly {
+		t.Errorf("err = %v, want %v", err, ErrReadOnly)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the WAL is kept open, holding the locks
+	defer w.Close()
+	ents := []raftpb.Entry{{Index: 1, Term: 1, Data: []byte{1}}}
+	if err = w.Save(raftpb.HardState{}, ents); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	es := []raftpb.Entry{{Index: 2, Term: 1, Data: []byte{2}}}
+	if err = w.Save(raftpb.HardState{}, es); err != nil {
+		t.Fatal(err)
+	}
+	ents = append(ents, es...)
+
+	r, err := OpenReadOnly(p, walpb.Snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	metadata, _, entries, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "metadata")
+	}
+	if !reflect.DeepEqual(entries, ents) {
+		t.Errorf("ents = %+v, want %+v", entries, ents)
+	}
+	if g := r.LockedFiles(); len(g) != 0 {
+		t.Errorf("locked files = %v, want none", g)
+	}
+
+	if err = r.Save(raftpb.HardState{}, ents); err != ErrReadOnly {
+		t.Errorf("err = %v, want %v", err, ErrReadOnly)
+	}
+	if err = r.SaveSnapshot(walpb.Snapshot{}); err != ErrReadOnly {
+		t.Errorf("err = %v, want %v", err, ErrReadOnly)
+	}
+	if err = r.Cut(); err != ErrReadOnly {
+		t.Errorf("err = %v, want %v", err, ErrReadOnly)
+	}
+
+	emptydir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(emptydir)
+	if _, err = OpenReadOnly(emptydir, walpb.Snapshot{}); err != ErrFileNotFound {
+		t.Errorf("err = %v, want %v", err, ErrFileNotFound)
+	}
+}
+
+func TestOpenReadOnlyConcurrentWithWriter(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 100; i++ {
+			ents := []raftpb.Entry{{Index: uint64(i), Term: 1, Data: []byte{byte(i)}}}
+			if err := w.Save(raftpb.HardState{}, ents); err != nil {
+				t.Error(err)
+				return
+			}
+			if i%10 == 0 {
+				if err := w.Cut(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		r, err := OpenReadOnly(p, walpb.Snapshot{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the writer may be midway through a record, so the tail is torn
+		if _, _, _, err = r.ReadAll(); err != nil && !errors.Is(err, ErrTornTail) {
+			t.Errorf("#%d: err = %v, want nil or %v", i, err, ErrTornTail)
+		}
+		r.Close()
+	}
+	wg.Wait()
+
+	r, err := OpenReadOnly(p, walpb.Snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, _, ents, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 100 {
+		t.Errorf("len(ents) = %d, want 100", len(ents))
+	}
+	if g := len(w.LockedFiles()); g == 0 {
+		t.Errorf("writer locked files = %d, want > 0", g)
+	}
+}
+
+func TestLockedFiles(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		es := []raftpb.Entry{{Index: uint64(i)}}
+		if err = w.Save(raftpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wlocked := []string{walName(0, 0), walName(1, 2), walName(2, 3), walName(3, 4)}
+	if g := w.LockedFiles(); !reflect.DeepEqual(g, wlocked) {
+		t.Errorf("locked files = %v, want %v", g, wlocked)
+	}
+
+	tests := []struct {
+		index     uint64
+		wreleased []string
+	}{
+		{0, []string{}},
+		{1, []string{}},
+		{2, []string{walName(0, 0)}},
+		{3, []string{walName(0, 0), walName(1, 2)}},
+		{100, []string{walName(0, 0), walName(1, 2), walName(2, 3)}},
+	}
+	for i, tt := range tests {
+		g, err := w.FilesReleasedBy(tt.index)
+		if err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		if !reflect.DeepEqual(g, tt.wreleased) {
+			t.Errorf("#%d: released files = %v, want %v", i, g, tt.wreleased)
+		}
+	}
+	// a locked file whose name cannot be parsed is reported
+	bw := &WAL{locks: []fileutil.Lock{&renamedLock{name: walName(0, 0)}, &renamedLock{name: "bad.wal"}}}
+	if _, err = bw.FilesReleasedBy(1); err == nil {
+		t.Errorf("err = nil, want an error")
+	}
+
+	if err = w.ReleaseLockTo(3); err != nil {
+		t.Fatal(err)
+	}
+	wlocked = []string{walName(2, 3), walName(3, 4)}
+	g := w.LockedFiles()
+	if !reflect.DeepEqual(g, wlocked) {
+		t.Errorf("locked files = %v, want %v", g, wlocked)
+	}
+	// the returned names are a copy
+	g[0] = "changed"
+	if g = w.LockedFiles(); !reflect.DeepEqual(g, wlocked) {
+		t.Errorf("locked files = %v, want %v", g, wlocked)
+	}
+
+	w.Close()
+	if g = w.LockedFiles(); len(g) != 0 {
+		t.Errorf("locked files = %v, want none after Close", g)
+	}
+}
+
+// TestReleaseLockToKeepsCoveringFile ensures that ReleaseLockTo keeps the
+// file that contains the given index locked, and always keeps a lock.
+func TestReleaseLockToKeepsCoveringFile(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	// each file after the first one holds three entries
+	for i := 0; i < 3; i++ {
+		var es []raftpb.Entry
+		for j := 1; j <= 3; j++ {
+			es = append(es, raftpb.Entry{Index: uint64(3*i + j)})
+		}
+		if err = w.Save(raftpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		index     uint64
+		wlocked   string // the first locked file
+		wunlocked []string
+	}{
+		// index 5 is in the middle of the file starting at index 4
+		{5, walName(1, 4), []string{walName(0, 0)}},
+		{8, walName(2, 7), []string{walName(1, 4)}},
+		// the last file is never released
+		{100, walName(3, 10), []string{walName(2, 7)}},
+	}
+	for i, tt := range tests {
+		if err = w.ReleaseLockTo(tt.index); err != nil {
+			t.Fatal(err)
+		}
+		if g := w.LockedFiles(); len(g) == 0 || g[0] != tt.wlocked {
+			t.Errorf("#%d: locked files = %v, want starting with %s", i, g, tt.wlocked)
+		}
+		if err = tryLockFile(path.Join(p, tt.wlocked)); err != fileutil.ErrLocked {
+			t.Errorf("#%d: err = %v, want %v", i, err, fileutil.ErrLocked)
+		}
+		for _, name := range tt.wunlocked {
+			if err = tryLockFile(path.Join(p, name)); err != nil {
+				t.Errorf("#%d: err = %v, want nil", i, err)
+			}
+		}
+	}
+}
+
+// tryLockFile tries to lock the file, and releases the lock right away.
+func tryLockFile(name string) error {
+	l, err := fileutil.NewLock(name)
+	if err != nil {
+		return err
+	}
+	defer l.Destroy()
+	if err = l.TryLock(); err != nil {
+		return err
+	}
+	return l.Unlock()
+}
+
+func TestOpenWithContext(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 1, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	// only the last file is locked
+	if err = w.ReleaseLockTo(2); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = OpenWithContext(ctx, p, walpb.Snapshot{})
+	if took := time.Since(start); took < 200*time.Millisecond {
+		t.Errorf("took %v, want at least %v", took, 200*time.Millisecond)
+	}
+	var lerr *LockedError
+	if !errors.Is(err, fileutil.ErrLocked) || !errors.As(err, &lerr) {
+		t.Fatalf("err = %v, want %v", err, fileutil.ErrLocked)
+	}
+	if lerr.File != walName(1, 2) {
+		t.Errorf("file = %s, want %s", lerr.File, walName(1, 2))
+	}
+	if runtime.GOOS == "linux" && lerr.PID != os.Getpid() {
+		t.Errorf("pid = %d, want %d", lerr.PID, os.Getpid())
+	}
+	// the failed opens released the lock of the first file
+	if err = tryLockFile(path.Join(p, walName(0, 0))); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+
+	// the WAL is opened once the lock is released
+	go func(w *WAL) {
+		time.Sleep(100 * time.Millisecond)
+		w.Close()
+	}(w)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if w, err = OpenWithContext(ctx, p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadAllWithOffsets(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 6; i++ {
+		es := []raftpb.Entry{{Index: uint64(i), Term: 1, Data: []byte{byte(i)}}}
+		if err = w.Save(raftpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			if err = w.Cut(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	_, _, locs, err := w.ReadAllWithOffsets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if len(locs) != 6 {
+		t.Fatalf("len(locs) = %d, want 6", len(locs))
+	}
+
+	names, err := fileutil.ReadDir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, loc := range locs {
+		if loc.Entry.Index != uint64(i+1) {
+			t.Errorf("#%d: index = %d, want %d", i, loc.Entry.Index, i+1)
+		}
+		if wseq := uint64(i / 2); loc.Seq != wseq {
+			t.Errorf("#%d: seq = %d, want %d", i, loc.Seq, wseq)
+		}
+		// decode the record at the reported offset manually
+		f, err := os.Open(path.Join(p, names[loc.Seq]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Seek(loc.Offset, os.SEEK_SET); err != nil {
+			t.Fatal(err)
+		}
+		lenField, err := readInt64(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, _, _ := decodeFrameSize(lenField)
+		data := make([]byte, l)
+		if _, err = io.ReadFull(f, data); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		var rec walpb.Record
+		if err = rec.Unmarshal(data); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Type != entryType {
+			t.Fatalf("#%d: type = %d, want %d", i, rec.Type, entryType)
+		}
+		var e raftpb.Entry
+		pbutil.MustUnmarshal(&e, rec.Data)
+		if !reflect.DeepEqual(e, loc.Entry) {
+			t.Errorf("#%d: entry = %+v, want %+v", i, e, loc.Entry)
+		}
+	}
+}
+
+func TestRecoverZeroPaddedTail(t *testing.T) {
+	header := func(n int64) []byte {
+		var b bytes.Buffer
+		writeInt64(&b, n)
+		return b.Bytes()
+	}
+	tests := [][]byte{
+		make([]byte, 1),
+		make([]byte, 7),
+		make([]byte, 8),
+		make([]byte, 100),
+		make([]byte, 4096),
+		// the zero padding starts in the middle of a length
+		append(header(14)[:1], make([]byte, 100)...),
+	}
+	for i, tt := range tests {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := Create(p, []byte("metadata"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ents := []raftpb.Entry{{Index: 1, Term: 1, Data: []byte{1}}}
+		if err = w.Save(raftpb.HardState{}, ents); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+
+		fpath := path.Join(p, walName(0, 0))
+		f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Write(tt); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		if w, err = Open(p, walpb.Snapshot{}); err != nil {
+			t.Fatal(err)
+		}
+		_, _, entries, err := w.ReadAll()
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if !reflect.DeepEqual(entries, ents) {
+			t.Errorf("#%d: ents = %+v, want %+v", i, entries, ents)
+		}
+		// new records are appended right after the last valid one
+		es := []raftpb.Entry{{Index: 2, Term: 1, Data: []byte{2}}}
+		if err = w.Save(raftpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+		ents = append(ents, es...)
+		w.Close()
+
+		if w, err = Open(p, walpb.Snapshot{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, entries, err = w.ReadAll(); err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if !reflect.DeepEqual(entries, ents) {
+			t.Errorf("#%d: ents = %+v, want %+v", i, entries, ents)
+		}
+		w.Close()
+		os.RemoveAll(p)
+	}
+}
+
+func TestReadAllZeroedRecord(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: uint64(i), Term: 1, Data: []byte("data")}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start, end := w.entryOffs[1].off, w.entryOffs[2].off
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 4, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// zeros in a file before the last one are not its end, so the
+	// records after them are not silently dropped
+	f, err := os.OpenFile(path.Join(p, walName(0, 0)), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt(make([]byte, end-start), start); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, _, err = w.ReadAll()
+	var derr *DecodeError
+	if !errors.As(err, &derr) || !errors.Is(err, ErrZeroRecord) {
+		t.Fatalf("err = %v, want %v", err, ErrZeroRecord)
+	}
+	if derr.File != walName(0, 0) || derr.Offset != start {
+		t.Errorf("file, offset = %s, %d, want %s, %d", derr.File, derr.Offset, walName(0, 0), start)
+	}
+}
+
+func TestRecoverCorruptedTailAfterValidRecords(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1, Data: []byte{1}}}
+	if err = w.Save(raftpb.HardState{}, ents); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// append a well-formed record that does not follow the crc chain
+	f, err := os.OpenFile(path.Join(p, walName(0, 0)), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := fi.Size()
+	e := newEncoder(f, 0, ChecksumCRC32C)
+	if err = e.encode(&walpb.Record{Type: entryType, Data: []byte("garbage")}); err != nil {
+		t.Fatal(err)
+	}
+	e.flush()
+	f.Write(make([]byte, 100))
+	f.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, _, err = w.ReadAll()
+	derr, ok := err.(*DecodeError)
+	if !ok || !errors.Is(err, walpb.ErrCRCMismatch) {
+		t.Fatalf("err = %v, want %v", err, walpb.ErrCRCMismatch)
+	}
+	if derr.File != walName(0, 0) || derr.Offset != size {
+		t.Errorf("location = %s:%d, want %s:%d", derr.File, derr.Offset, walName(0, 0), size)
+	}
+}
+
+func TestReadAllCRCError(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		ents := []raftpb.Entry{{Index: uint64(i), Term: 1, Data: []byte("data")}}
+		if err = w.Save(raftpb.HardState{}, ents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	_, _, locs, err := w.ReadAllWithOffsets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// corrupt the last byte of the record of the second entry
+	off := locs[1].Offset
+	corruptLastByte(t, path.Join(p, walName(0, 0)), off)
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, _, err = w.ReadAll()
+	if !errors.Is(err, ErrCRCMismatch) {
+		t.Fatalf("err = %v, want %v", err, ErrCRCMismatch)
+	}
+	var cerr *CRCError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("err = %v, want a *CRCError", err)
+	}
+	if cerr.Seq != 0 || cerr.Offset != off {
+		t.Errorf("location = %d:%d, want %d:%d", cerr.Seq, cerr.Offset, 0, off)
+	}
+	if cerr.Expected == cerr.Actual {
+		t.Errorf("expected crc = actual crc = %#x, want different", cerr.Expected)
+	}
+}
+
+func TestReadAllEntryGap(t *testing.T) {
+	tests := []struct {
+		indexes []uint64
+
+		wents []uint64
+		werr  *EntryGapError
+	}{
+		// contiguous
+		{[]uint64{1, 2, 3}, []uint64{1, 2, 3}, nil},
+		// overwrite
+		{[]uint64{1, 2, 3, 2, 3}, []uint64{1, 2, 3}, nil},
+		{[]uint64{1, 2, 3, 4, 2}, []uint64{1, 2}, nil},
+		// gap
+		{[]uint64{1, 2, 4}, nil, &EntryGapError{Expected: 3, Found: 4}},
+		{[]uint64{2}, nil, &EntryGapError{Expected: 1, Found: 2}},
+		// gap after overwrite
+		{[]uint64{1, 2, 3, 2, 4}, nil, &EntryGapError{Expected: 3, Found: 4}},
+		// overwrite after gap
+		{[]uint64{1, 3, 2}, nil, &EntryGapError{Expected: 2, Found: 3}},
+	}
+	for i, tt := range tests {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := Create(p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, idx := range tt.indexes {
+			if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: idx, Term: 1}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.Close()
+
+		if w, err = Open(p, walpb.Snapshot{}); err != nil {
+			t.Fatal(err)
+		}
+		_, _, ents, err := w.ReadAll()
+		w.Close()
+		// reading with the offsets fails alike
+		w, oerr := Open(p, walpb.Snapshot{})
+		if oerr != nil {
+			t.Fatal(oerr)
+		}
+		_, _, locs, lerr := w.ReadAllWithOffsets()
+		w.Close()
+		os.RemoveAll(p)
+		if !reflect.DeepEqual(lerr, err) {
+			t.Errorf("#%d: offsets err = %v, want %v", i, lerr, err)
+		}
+		if len(locs) != len(ents) {
+			t.Errorf("#%d: len(locs) = %d, want %d", i, len(locs), len(ents))
+		}
+
+		if tt.werr != nil {
+			if !errors.Is(err, ErrEntryGap) {
+				t.Errorf("#%d: err = %v, want %v", i, err, ErrEntryGap)
+				continue
+			}
+			var gerr *EntryGapError
+			if !errors.As(err, &gerr) || !reflect.DeepEqual(gerr, tt.werr) {
+				t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: err = %v, want nil", i, err)
+			continue
+		}
+		var indexes []uint64
+		for _, e := range ents {
+			indexes = append(indexes, e.Index)
+		}
+		if !reflect.DeepEqual(indexes, tt.wents) {
+			t.Errorf("#%d: indexes = %v, want %v", i, indexes, tt.wents)
+		}
+	}
+}
+
+func TestReadAllUnknownRecordType(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 1, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	off := w.off
+	// a record with a valid crc, of a type added by a later version
+	typ := int64(appDataType + 1)
+	if err = w.encode(&walpb.Record{Type: typ, Data: []byte("data")}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, _, err = w.ReadAll()
+	werr := &DecodeError{File: walName(0, 0), Offset: off, Type: typ, Err: ErrUnknownRecordType}
+	if !reflect.DeepEqual(err, werr) {
+		t.Errorf("err = %v, want %v", err, werr)
+	}
+	if !errors.Is(err, ErrUnknownRecordType) {
+		t.Errorf("err = %v, want %v", err, ErrUnknownRecordType)
+	}
+}
+
+func TestReadAllErrorsReportFile(t *testing.T) {
+	for i, corrupt := range []bool{false, true} {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := Create(p, []byte("metadata"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 1, Term: 1}}); err != nil {
+			t.Fatal(err)
+		}
+		if !corrupt {
+			// the next file looks like one of another member
+			w.metadata = []byte("othermetadata")
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+		off := w.off
+		if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 2, Term: 1, Data: []byte("data")}}); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		name := walName(1, 2)
+		if corrupt {
+			// corrupt the entry in the second file
+			corruptLastByte(t, path.Join(p, name), off)
+		}
+
+		// the metadata conflict is found by Open, before ReadAll
+		if w, err = Open(p, walpb.Snapshot{}); err == nil {
+			_, _, _, err = w.ReadAll()
+			w.Close()
+		} else if corrupt {
+			t.Fatal(err)
+		}
+		os.RemoveAll(p)
+
+		if corrupt {
+			var derr *DecodeError
+			var cerr *CRCError
+			if !errors.Is(err, ErrCRCMismatch) || !errors.As(err, &derr) || !errors.As(err, &cerr) {
+				t.Errorf("#%d: err = %v, want a crc mismatch", i, err)
+				continue
+			}
+			if derr.File != name || cerr.Seq != 1 || cerr.Offset != off {
+				t.Errorf("#%d: location = %s %d:%d, want %s %d:%d", i, derr.File, cerr.Seq, cerr.Offset, name, 1, off)
+			}
+			continue
+		}
+		var merr *MetadataConflictError
+		if !errors.Is(err, ErrMetadataConflict) || !errors.As(err, &merr) {
+			t.Errorf("#%d: err = %v, want %v", i, err, ErrMetadataConflict)
+			continue
+		}
+		if merr.File != name || merr.Offset <= 0 || merr.Offset >= off {
+			t.Errorf("#%d: location = %s:%d, want %s before %d", i, merr.File, merr.Offset, name, off)
+		}
+		if string(merr.Expected) != "metadata" || string(merr.Found) != "othermetadata" {
+			t.Errorf("#%d: metadata = %s, %s, want %s, %s", i, merr.Expected, merr.Found, "metadata", "othermetadata")
+		}
+		if merr.ExpectedFile != walName(0, 0) {
+			t.Errorf("#%d: expected file = %s, want %s", i, merr.ExpectedFile, walName(0, 0))
+		}
+	}
+}
+
+// mustCreateWAL creates a WAL in a new temporary directory, and saves the
+// entries of index 1 to n and term 1, one per Save. The caller removes the
+// directory.
+func mustCreateWAL(t *testing.T, n int) (string, *WAL) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := Create(p, nil)
+	if err != nil {
+		os.RemoveAll(p)
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		ents := []raftpb.Entry{{Index: uint64(i), Term: 1}}
+		if err = w.Save(raftpb.HardState{}, ents); err != nil {
+			w.Close()
+			os.RemoveAll(p)
+			t.Fatal(err)
+		}
+	}
+	return p, w
+}
+
+func TestTruncate(t *testing.T) {
+	p, w := mustCreateWAL(t, 100)
+	defer os.RemoveAll(p)
+
+	err := w.Truncate(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	_, _, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 50 || ents[49].Index != 50 {
+		t.Fatalf("len(ents) = %d, want 50", len(ents))
+	}
+
+	// the entries read are truncated alike, and appending continues
+	// with the crc chained correctly
+	if err = w.Truncate(40); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 41, Term: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, _, ents, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 41 || ents[40].Term != 2 {
+		t.Fatalf("len(ents) = %d, want 41", len(ents))
+	}
+
+	// the entries before the file being appended cannot be truncated
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Truncate(40); err != ErrTruncateIndex {
+		t.Errorf("err = %v, want %v", err, ErrTruncateIndex)
+	}
+}
+
+func TestTruncateState(t *testing.T) {
+	p, w := mustCreateWAL(t, 0)
+	defer os.RemoveAll(p)
+
+	var ents []raftpb.Entry
+	for i := 1; i <= 10; i++ {
+		ents = append(ents, raftpb.Entry{Index: uint64(i), Term: 1})
+	}
+	st1 := raftpb.HardState{Term: 1, Vote: 1, Commit: 1}
+	st2 := raftpb.HardState{Term: 1, Vote: 1, Commit: 5}
+	st3 := raftpb.HardState{Term: 1, Vote: 1, Commit: 8}
+	err := w.Save(st1, ents[:5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(st2, ents[5:8]); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(st3, ents[8:]); err != nil {
+		t.Fatal(err)
+	}
+	// st3 is saved after entry 8, so it is discarded with it
+	if err = w.Truncate(7); err != nil {
+		t.Fatal(err)
+	}
+	// the new file starts with the state rolled back
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	// nothing is left after index 7 in the new file
+	if err = w.Truncate(7); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, state, entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state, st2) {
+		t.Errorf("state = %+v, want %+v", state, st2)
+	}
+	if !reflect.DeepEqual(entries, ents[:7]) {
+		t.Errorf("ents = %+v, want %+v", entries, ents[:7])
+	}
+}
+
+func TestTruncateClampsCommit(t *testing.T) {
+	p, w := mustCreateWAL(t, 3)
+	defer os.RemoveAll(p)
+
+	// the state is saved ahead of the entries it commits
+	st := raftpb.HardState{Term: 1, Vote: 1, Commit: 5}
+	err := w.Save(st, []raftpb.Entry{{Index: 4, Term: 1}, {Index: 5, Term: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Truncate(4); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, state, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wst := (raftpb.HardState{Term: 1, Vote: 1, Commit: 4}); !reflect.DeepEqual(state, wst) {
+		t.Errorf("state = %+v, want %+v", state, wst)
+	}
+	if len(ents) != 4 {
+		t.Errorf("len(ents) = %d, want 4", len(ents))
+	}
+}
+
+func TestLastIndex(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	if _, err = LastIndex(p); err != ErrFileNotFound {
+		t.Errorf("err = %v, want %v", err, ErrFileNotFound)
+	}
+	os.RemoveAll(p)
+
+	w, err := Create(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	wantIndex := func(wi uint64) {
+		i, err := LastIndex(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i != wi {
+			t.Errorf("last index = %d, want %d", i, wi)
+		}
+	}
+	wantIndex(0)
+
+	var ents []raftpb.Entry
+	for i := 1; i <= 5; i++ {
+		ents = append(ents, raftpb.Entry{Index: uint64(i), Term: 1})
+	}
+	if err = w.Save(raftpb.HardState{}, ents); err != nil {
+		t.Fatal(err)
+	}
+	wantIndex(5)
+	// the last file has no entries yet
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	wantIndex(5)
+	if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 6, Term: 1}, {Index: 7, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	wantIndex(7)
+	// the last entry overwrites the previous ones
+	if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 6, Term: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	wantIndex(6)
+}
+
+func TestValidSnapshotEntries(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	snap0 := walpb.Snapshot{}
+	snap1 := walpb.Snapshot{Index: 1, Term: 1}
+	snap2 := walpb.Snapshot{Index: 2, Term: 1}
+	snap3 := walpb.Snapshot{Index: 3, Term: 1}
+	w, err := Create(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}}
+	if err = w.Save(raftpb.HardState{Term: 1, Commit: 1}, ents[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveSnapshot(snap1); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(raftpb.HardState{Term: 1, Commit: 2}, ents[1:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveSnapshot(snap2); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(raftpb.HardState{Term: 1, Commit: 2}, ents[2:]); err != nil {
+		t.Fatal(err)
+	}
+	// the snapshot is ahead of the commit index
+	if err = w.SaveSnapshot(snap3); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	snaps, err := ValidSnapshotEntries(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsnaps := []walpb.Snapshot{snap0, snap1, snap2}
+	if !reflect.DeepEqual(snaps, wsnaps) {
+		t.Errorf("snaps = %+v, want %+v", snaps, wsnaps)
+	}
+	// the WAL can be opened at any of them
+	for i, snap := range snaps {
+		r, err := OpenReadOnly(p, snap)
+		if err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		_, _, rents, err := r.ReadAll()
+		r.Close()
+		if err != nil {
+			t.Errorf("#%d: err = %v, want nil", i, err)
+		}
+		if wents := ents[snap.Index:]; !reflect.DeepEqual(rents, wents) {
+			t.Errorf("#%d: ents = %+v, want %+v", i, rents, wents)
+		}
+	}
+
+	if _, err = ValidSnapshotEntries(path.Join(p, "nonexistent")); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+}
+
+func TestSaveNoSync(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ents := []raftpb.Entry{
+		{Index: 1, Term: 1, Data: []byte{1}},
+		{Index: 2, Term: 1, Data: []byte{2}},
+		{Index: 3, Term: 1, Data: []byte{3}},
+	}
+	for i := range ents[:2] {
+		if err = w.SaveNoSync(raftpb.HardState{}, ents[i:i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveNoSync(raftpb.HardState{}, ents[2:]); err != nil {
+		t.Fatal(err)
+	}
+
+	// read the file directly to see what would survive a crash
+	f, err := os.Open(path.Join(p, walName(0, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenReader(f, walpb.Snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, _, entries, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, ents[:2]) {
+		t.Errorf("ents = %+v, want %+v", entries, ents[:2])
+	}
+}
+
+func TestReadAllRecordTooLarge(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	fpath := path.Join(p, walName(0, 0))
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// append a record with a corrupted length
+	writeInt64(f, 2<<30)
+	f.Write([]byte("corrupted"))
+	f.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, _, err = w.ReadAll()
+	werr := &RecordTooLargeError{File: walName(0, 0), Offset: fi.Size(), Size: 2 << 30, Max: MaxRecordBytes}
+	if !reflect.DeepEqual(err, werr) {
+		t.Errorf("err = %v, want %v", err, werr)
+	}
+}
+
+func TestMaxRecordBytes(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithMaxRecordBytes(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := []raftpb.Entry{{Index: 1, Term: 1, Data: make([]byte, 1024)}}
+	if err = w.Save(raftpb.HardState{}, big); err != ErrRecordTooLarge {
+		t.Errorf("err = %v, want %v", err, ErrRecordTooLarge)
+	}
+	w.Close()
+	os.RemoveAll(p)
+
+	// an entry larger than MaxRecordBytes is saved and read with a
+	// larger limit
+	max := 2 * MaxRecordBytes
+	if w, err = Create(p, []byte("metadata"), WithMaxRecordBytes(max)); err != nil {
+		t.Fatal(err)
+	}
+	big = []raftpb.Entry{{Index: 1, Term: 1, Data: make([]byte, MaxRecordBytes)}}
+	if err = w.Save(raftpb.HardState{}, big); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("err = %v, want %v", err, ErrRecordTooLarge)
+	}
+	w.Close()
+	if err = Verify(p); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("verify err = %v, want %v", err, ErrRecordTooLarge)
+	}
+
+	if w, err = Open(p, walpb.Snapshot{}, WithMaxRecordBytes(max)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if !reflect.DeepEqual(ents, big) {
+		t.Errorf("ents = %d entries, want the saved one", len(ents))
+	}
+	if err = Verify(p, WithMaxRecordBytes(max)); err != nil {
+		t.Errorf("verify err = %v, want nil", err)
+	}
+}
+
+func TestReadAllTornTail(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithPadding())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1, Data: []byte("a")}, {Index: 2, Term: 1, Data: make([]byte, 100)}}
+	if err = w.Save(raftpb.HardState{}, ents[:1]); err != nil {
+		t.Fatal(err)
+	}
+	off := w.off
+	if err = w.Save(raftpb.HardState{}, ents[1:]); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// the last record is cut short in the middle of its data
+	fpath := path.Join(p, walName(0, 0))
+	if err = os.Truncate(fpath, off+40); err != nil {
+		t.Fatal(err)
+	}
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = w.ReadAll()
+	w.Close()
+	werr := &TornTailError{File: walName(0, 0), Offset: off}
+	if !reflect.DeepEqual(err, werr) {
+		t.Errorf("err = %v, want %v", err, werr)
+	}
+	if !errors.Is(err, ErrTornTail) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("err = %v, want to match %v and %v", err, ErrTornTail, io.ErrUnexpectedEOF)
+	}
+
+	// truncating at the offset of the torn record repairs the WAL
+	if err = os.Truncate(fpath, off); err != nil {
+		t.Fatal(err)
+	}
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, ents[:1]) {
+		t.Errorf("ents = %+v, want %+v", entries, ents[:1])
+	}
+}
+
+func TestReadAllTornLength(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1, Data: []byte("a")}, {Index: 2, Term: 1, Data: []byte("b")}}
+	if err = w.Save(raftpb.HardState{}, ents[:1]); err != nil {
+		t.Fatal(err)
+	}
+	off := w.off
+	if err = w.Save(raftpb.HardState{}, ents[1:]); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// the last record is cut short in the middle of its length
+	if err = os.Truncate(path.Join(p, walName(0, 0)), off+3); err != nil {
+		t.Fatal(err)
+	}
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, _, err = w.ReadAll()
+	werr := &TornTailError{File: walName(0, 0), Offset: off}
+	if !reflect.DeepEqual(err, werr) {
+		t.Errorf("err = %v, want %v", err, werr)
+	}
+}
+
+func TestPadding(t *testing.T) {
+	for _, padded := range []bool{false, true} {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := []Option{WithPreallocateBytes(0)}
+		if padded {
+			opts = append(opts, WithPadding())
+		}
+		w, err := Create(p, []byte("metadata"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		// the framing is recorded, and kept when opened without the option
+		if w, err = Open(p, walpb.Snapshot{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err = w.ReadAll(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 3; i++ {
+			es := []raftpb.Entry{{Index: uint64(i), Term: 1, Data: make([]byte, i)}}
+			if err = w.Save(raftpb.HardState{Term: 1, Commit: uint64(i)}, es); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.Close()
+
+		b, err := ioutil.ReadFile(path.Join(p, walName(0, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// without padding, the lengths are written as before, so the
+		// previous releases read the files
+		for off := 0; off < len(b); {
+			lf := binary.LittleEndian.Uint64(b[off:])
+			n, pad, ok := decodeFrameSize(int64(lf))
+			if !ok {
+				t.Fatalf("padded %v: bad length %x at offset %d", padded, lf, off)
+			}
+			if plain := lf>>56 == 0; plain == padded {
+				t.Errorf("padded %v: length %x at offset %d", padded, lf, off)
+			}
+			if padded && (n+pad)%8 != 0 {
+				t.Errorf("padded %v: record size = %d, want a multiple of 8", padded, n+pad)
+			}
+			off += 8 + int(n+pad)
+		}
+		os.RemoveAll(p)
+	}
+}
+
+func TestReadAllCorruptLength(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithPadding())
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := w.off
+	ents := []raftpb.Entry{{Index: 1, Term: 1, Data: []byte("a")}, {Index: 2, Term: 1, Data: []byte("b")}}
+	if err = w.Save(raftpb.HardState{}, ents); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// a bit flip in the length of the first entry makes it run past the
+	// end of the file, which must not be taken for a torn write
+	f, err := os.OpenFile(path.Join(p, walName(0, 0)), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	if _, err = f.ReadAt(b, off+1); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0x10
+	if _, err = f.WriteAt(b, off+1); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, _, err = w.ReadAll()
+	werr := &DecodeError{File: walName(0, 0), Offset: off, Err: ErrCorruptLength}
+	if !reflect.DeepEqual(err, werr) {
+		t.Errorf("err = %v, want %v", err, werr)
+	}
+	if errors.Is(err, ErrTornTail) {
+		t.Errorf("err = %v, want not to match %v", err, ErrTornTail)
+	}
+}
+
+func TestOpenAtPosition(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	var ents []raftpb.Entry
+	for i := 1; i <= 8; i++ {
+		ents = append(ents, raftpb.Entry{Index: uint64(i), Term: 1, Data: []byte{byte(i)}})
+	}
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(raftpb.HardState{}, ents[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(raftpb.HardState{}, ents[3:5]); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// read all and remember the position
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	seq, off := w.Position()
+	if seq != 1 {
+		t.Errorf("seq = %d, want 1", seq)
+	}
+	// append more entries
+	if err = w.Save(raftpb.HardState{}, ents[5:7]); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(raftpb.HardState{}, ents[7:]); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// resume reading from the position
+	r, err := OpenAtPosition(p, seq, off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, _, entries, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "metadata")
+	}
+	if !reflect.DeepEqual(entries, ents[5:]) {
+		t.Errorf("ents = %+v, want %+v", entries, ents[5:])
+	}
+	if seq, _ = r.Position(); seq != 2 {
+		t.Errorf("seq = %d, want 2", seq)
+	}
+	r.Close()
+
+	if _, err = OpenAtPosition(p, seq, off-1); err != ErrInvalidPosition {
+		t.Errorf("err = %v, want %v", err, ErrInvalidPosition)
+	}
+	if _, err = OpenAtPosition(p, 10, 0); err != ErrFileNotFound {
+		t.Errorf("err = %v, want %v", err, ErrFileNotFound)
+	}
+}
+
+func TestReadRecords(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveSnapshot(walpb.Snapshot{Index: 1, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}}
+	st := raftpb.HardState{Term: 1, Commit: 3}
+	if err = w.Save(st, ents); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{Index: 1, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var indexes []uint64
+	metadata, state, err := w.ReadRecords(func(rec *walpb.Record) error {
+		var e raftpb.Entry
+		pbutil.MustUnmarshal(&e, rec.Data)
+		indexes = append(indexes, e.Index)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "metadata")
+	}
+	if !reflect.DeepEqual(state, st) {
+		t.Errorf("state = %+v, want %+v", state, st)
+	}
+	// the entry covered by the snapshot is skipped
+	if windexes := []uint64{2, 3}; !reflect.DeepEqual(indexes, windexes) {
+		t.Errorf("indexes = %v, want %v", indexes, windexes)
+	}
+	// the WAL is ready for appending
+	if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 4, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// an error from fn stops reading
+	if w, err = Open(p, walpb.Snapshot{Index: 1, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	errStop := errors.New("stop")
+	n := 0
+	_, _, err = w.ReadRecords(func(rec *walpb.Record) error {
+		n++
+		return errStop
+	})
+	if err != errStop {
+		t.Errorf("err = %v, want %v", err, errStop)
+	}
+	if n != 1 {
+		t.Errorf("n = %d, want 1", n)
+	}
+	w.Close()
+}
+
+func TestReadAllSkipCorrupt(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ents []raftpb.Entry
+	for i := 1; i <= 5; i++ {
+		ents = append(ents, raftpb.Entry{Index: uint64(i), Term: 1, Data: bytes.Repeat([]byte{byte(i)}, 100)})
+	}
+	if err = w.Save(raftpb.HardState{}, ents[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(raftpb.HardState{}, ents[3:]); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	_, _, locs, err := w.ReadAllWithOffsets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// corrupt the data of the second entry in the middle of the first file
+	f, err := os.OpenFile(path.Join(p, walName(0, 0)), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte{0xff}, locs[1].Offset+50); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// the default path is strict
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); err == nil {
+		t.Errorf("err = nil, want corruption error")
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	metadata, _, entries, skipped, err := w.ReadAllSkipCorrupt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "metadata")
+	}
+	wents := []raftpb.Entry{ents[0], ents[2], ents[3], ents[4]}
+	if !reflect.DeepEqual(entries, wents) {
+		t.Errorf("ents = %+v, want %+v", entries, wents)
+	}
+	if len(skipped) != 1 {
+		t.Fatalf("len(skipped) = %d, want 1", len(skipped))
+	}
+	r := skipped[0]
+	if r.File != walName(0, 0) || r.Start != locs[1].Offset || r.End != locs[2].Offset {
+		t.Errorf("skipped = %s [%d, %d), want %s [%d, %d)", r.File, r.Start, r.End, walName(0, 0), locs[1].Offset, locs[2].Offset)
+	}
+
+	// the WAL is ready for appending after skipping
+	es := []raftpb.Entry{{Index: 6, Term: 1}}
+	if err = w.Save(raftpb.HardState{}, es); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+}
+
+func TestSaveGroupCommit(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithGroupCommit())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const savers = 100
+	var wg sync.WaitGroup
+	for i := 0; i < savers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			es := []raftpb.Entry{{Index: uint64(i + 1), Term: 1}}
+			if err := w.Save(raftpb.HardState{}, es); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if w.gc.synced != savers {
+		t.Errorf("synced = %d, want %d", w.gc.synced, savers)
+	}
+	w.Close()
+
+	// every Save is appended exactly once
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	seen := make(map[uint64]bool)
+	_, _, err = w.ReadRecords(func(rec *walpb.Record) error {
+		var e raftpb.Entry
+		pbutil.MustUnmarshal(&e, rec.Data)
+		if seen[e.Index] {
+			t.Errorf("entry %d is appended twice", e.Index)
+		}
+		seen[e.Index] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != savers {
+		t.Errorf("len(entries) = %d, want %d", len(seen), savers)
+	}
+}
+
+func TestReadAllDecodeError(t *testing.T) {
+	ent := raftpb.Entry{Index: 1, Term: 1, Data: []byte("somedata")}
+	st := raftpb.HardState{Term: 1, Vote: 1, Commit: 1}
+	snap := walpb.Snapshot{Index: 1, Term: 1}
+	tests := []struct {
+		typ  int64
+		data []byte
+	}{
+		{entryType, pbutil.MustMarshal(&ent)},
+		{stateType, pbutil.MustMarshal(&st)},
+		{snapshotType, pbutil.MustMarshal(&snap)},
+	}
+	for i, tt := range tests {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := Create(p, []byte("metadata"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := w.f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		off := fi.Size()
+		// a record with a valid crc, whose payload is truncated
+		if err = w.encode(&walpb.Record{Type: tt.typ, Data: tt.data[:len(tt.data)-1]}); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+
+		if w, err = Open(p, walpb.Snapshot{}); err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, err = w.ReadAll()
+		if !errors.Is(err, ErrDecode) {
+			t.Errorf("#%d: err = %v, want %v", i, err, ErrDecode)
+		}
+		werr := &DecodeError{File: walName(0, 0), Offset: off, Type: tt.typ, Err: io.ErrUnexpectedEOF}
+		if !reflect.DeepEqual(err, werr) {
+			t.Errorf("#%d: err = %v, want %v", i, err, werr)
+		}
+		w.Close()
+		os.RemoveAll(p)
+	}
+}
+
+func TestReadAllContextCanceled(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := make([]raftpb.Entry, 10*ctxCheckRecords)
+	for i := range ents {
+		ents[i] = raftpb.Entry{Index: uint64(i + 1), Term: 1}
+	}
+	if err = w.Save(raftpb.HardState{}, ents); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	metadata, _, entries, err := w.ReadAllContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+	if metadata != nil || entries != nil {
+		t.Errorf("metadata, ents = %v, %v, want nil, nil", metadata, entries)
+	}
+	// the reading does not resume in the middle of the records
+	if _, _, _, err = w.ReadAll(); err != ErrAlreadyRead {
+		t.Errorf("err = %v, want %v", err, ErrAlreadyRead)
+	}
+	if err = w.Close(); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
+
+func TestReadAllLimit(t *testing.T) {
+	var ents []raftpb.Entry
+	for i := uint64(1); i <= 10; i++ {
+		ents = append(ents, raftpb.Entry{Index: i, Term: 1, Data: []byte("data")})
+	}
+	size := int64(ents[0].Size())
+	// entries overwriting the last ones, and the ones before them
+	over := []raftpb.Entry{{Index: 8, Term: 2}, {Index: 9, Term: 2}}
+	overOld := []raftpb.Entry{{Index: 3, Term: 2}}
+
+	tests := []struct {
+		over       []raftpb.Entry
+		maxEntries int
+		maxBytes   int64
+
+		wents  []raftpb.Entry
+		wfirst uint64
+	}{
+		{nil, 0, 0, ents, 1},
+		{nil, 3, 0, ents[7:], 8},
+		{nil, 0, 2 * size, ents[8:], 9},
+		{nil, 3, 2 * size, ents[8:], 9},
+		{nil, 20, 0, ents, 1},
+		// no entry fits
+		{nil, 0, size - 1, nil, 11},
+		// the entries dropped before the ones overwritten are not read
+		// again
+		{over, 3, 0, over, 8},
+		// the entries dropped are overwritten
+		{overOld, 3, 0, overOld, 3},
+	}
+	for i, tt := range tests {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := Create(p, []byte("metadata"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := raftpb.HardState{Term: 2, Commit: 1}
+		if err = w.Save(raftpb.HardState{Term: 1}, ents); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Save(st, tt.over); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+
+		if w, err = Open(p, walpb.Snapshot{}); err != nil {
+			t.Fatal(err)
+		}
+		metadata, state, entries, first, err := w.ReadAllLimit(tt.maxEntries, tt.maxBytes)
+		if err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		if !reflect.DeepEqual(metadata, []byte("metadata")) {
+			t.Errorf("#%d: metadata = %s, want %s", i, metadata, "metadata")
+		}
+		if !reflect.DeepEqual(state, st) {
+			t.Errorf("#%d: state = %+v, want %+v", i, state, st)
+		}
+		if !reflect.DeepEqual(entries, tt.wents) {
+			t.Errorf("#%d: ents = %+v, want %+v", i, entries, tt.wents)
+		}
+		if first != tt.wfirst {
+			t.Errorf("#%d: first = %d, want %d", i, first, tt.wfirst)
+		}
+		w.Close()
+		os.RemoveAll(p)
+	}
+}
+
+func TestReadAllFiltered(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{
+		{Index: 1, Term: 1, Type: raftpb.EntryConfChange, Data: []byte("cc1")},
+		{Index: 2, Term: 1, Data: []byte("normal")},
+		{Index: 3, Term: 1, Type: raftpb.EntryConfChange, Data: []byte("cc3")},
+		{Index: 4, Term: 1, Type: raftpb.EntryConfChange, Data: []byte("cc4")},
+	}
+	if err = w.Save(raftpb.HardState{Term: 1}, ents); err != nil {
+		t.Fatal(err)
+	}
+	// the conf change at 4 is overwritten by a normal entry
+	st := raftpb.HardState{Term: 2, Commit: 3}
+	if err = w.Save(st, []raftpb.Entry{{Index: 4, Term: 2, Data: []byte("normal")}}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	metadata, state, entries, err := w.ReadAllFiltered(raftpb.EntryConfChange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "metadata")
+	}
+	if !reflect.DeepEqual(state, st) {
+		t.Errorf("state = %+v, want %+v", state, st)
+	}
+	if wents := []raftpb.Entry{ents[0], ents[2]}; !reflect.DeepEqual(entries, wents) {
+		t.Errorf("ents = %+v, want %+v", entries, wents)
+	}
+
+	// appending continues after the last entry of any type
+	if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 5, Term: 2}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEntryHead(t *testing.T) {
+	tests := []raftpb.Entry{
+		{},
+		{Index: 1, Term: 1},
+		{Index: 1 << 40, Term: 300, Type: raftpb.EntryConfChange, Data: []byte("data")},
+	}
+	for i, tt := range tests {
+		e, err := entryHead(pbutil.MustMarshal(&tt))
+		if err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		if e.Type != tt.Type || e.Term != tt.Term || e.Index != tt.Index || e.Data != nil {
+			t.Errorf("#%d: entry = %+v, want %+v without data", i, e, tt)
+		}
+	}
+	data := pbutil.MustMarshal(&tests[2])
+	if _, err := entryHead(data[:len(data)-1]); err != io.ErrUnexpectedEOF {
+		t.Errorf("err = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestSaveGroupCommitWindow(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithGroupCommitWindow(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	syncs := w.Metrics().Syncs
+	const savers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < savers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			es := []raftpb.Entry{{Index: uint64(i + 1), Term: 1}}
+			if err := w.Save(raftpb.HardState{}, es); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if w.gc.synced != savers {
+		t.Errorf("synced = %d, want %d", w.gc.synced, savers)
+	}
+	// the Saves arriving in the window share fsyncs
+	if g := w.Metrics().Syncs - syncs; g >= savers {
+		t.Errorf("syncs = %d, want less than %d", g, savers)
+	}
+}
+
+// corruptLastByte flips the last byte of the data of the record at the
+// given offset of the WAL file, which is covered by the crc.
+func corruptLastByte(t *testing.T, name string, off int64) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lb [8]byte
+	if _, err = f.ReadAt(lb[:], off); err != nil {
+		t.Fatal(err)
+	}
+	l, _, _ := decodeFrameSize(int64(binary.LittleEndian.Uint64(lb[:])))
+	last := off + 8 + l - 1
+	b := make([]byte, 1)
+	if _, err = f.ReadAt(b, last); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err = f.WriteAt(b, last); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenForAppend(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithPadding())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ents []raftpb.Entry
+	for i := 1; i <= 5; i++ {
+		if i == 4 {
+			if err = w.Cut(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		es := []raftpb.Entry{{Index: uint64(i), Term: 1, Data: []byte("data")}}
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: uint64(i)}, es); err != nil {
+			t.Fatal(err)
+		}
+		ents = append(ents, es...)
+	}
+	if err = w.SaveSnapshot(walpb.Snapshot{Index: 3, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = OpenForAppend(p, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+	es := []raftpb.Entry{{Index: 6, Term: 2, Data: []byte("data")}, {Index: 7, Term: 2, Data: []byte("data")}}
+	state := raftpb.HardState{Term: 2, Vote: 1, Commit: 6}
+	if err = w.Save(state, es); err != nil {
+		t.Fatal(err)
+	}
+	ents = append(ents, es...)
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	metadata, st, entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if !reflect.DeepEqual(metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "metadata")
+	}
+	if !reflect.DeepEqual(st, state) {
+		t.Errorf("state = %+v, want %+v", st, state)
+	}
+	if !reflect.DeepEqual(entries, ents) {
+		t.Errorf("ents = %+v, want %+v", entries, ents)
+	}
+
+	if _, err = OpenForAppend(p, 5, 1); err != ErrLastEntryMismatch {
+		t.Errorf("err = %v, want %v", err, ErrLastEntryMismatch)
+	}
+
+	// corrupt the record of the last entry
+	if w, err = OpenReadOnly(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	_, _, locs, err := w.ReadAllWithOffsets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	loc := locs[len(locs)-1]
+	corruptLastByte(t, path.Join(p, walName(loc.Seq, 4)), loc.Offset)
+	if _, err = OpenForAppend(p, 7, 2); !errors.Is(err, ErrCRCMismatch) {
+		t.Errorf("err = %v, want %v", err, ErrCRCMismatch)
+	}
+
+	// the record of the last entry is torn
+	if err = os.Truncate(path.Join(p, walName(loc.Seq, 4)), loc.Offset+12); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenForAppend(p, 7, 2); !errors.Is(err, ErrTornTail) {
+		t.Errorf("err = %v, want %v", err, ErrTornTail)
+	}
+}
+
+// TestOpenForAppendEmptyFile checks that the last entry is checked against
+// the name of the last WAL file when it holds no entries.
+func TestOpenForAppendEmptyFile(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if _, err = OpenForAppend(p, 3, 1); err != ErrLastEntryMismatch {
+		t.Errorf("err = %v, want %v", err, ErrLastEntryMismatch)
+	}
+	if w, err = OpenForAppend(p, 0, 0); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	es := []raftpb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}}
+	if err = w.Save(raftpb.HardState{Term: 1, Commit: 3}, es); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	tests := []struct {
+		index uint64
+		werr  error
+	}{
+		{3, nil},
+		{2, ErrLastEntryMismatch},
+		{4, ErrLastEntryMismatch},
+	}
+	for i, tt := range tests {
+		w, err := OpenForAppend(p, tt.index, 1)
+		if err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+		if err == nil {
+			w.Close()
+		}
+	}
+
+	// the snapshot saved in the last file is the last entry
+	if w, err = OpenForAppend(p, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveSnapshot(walpb.Snapshot{Index: 5, Term: 2}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if _, err = OpenForAppend(p, 3, 1); err != ErrLastEntryMismatch {
+		t.Errorf("err = %v, want %v", err, ErrLastEntryMismatch)
+	}
+	if w, err = OpenForAppend(p, 5, 2); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	w.Close()
+}
+
+// TestSaveCutInterleaved checks that the buffers reused to append records
+// are not shared across the encoders swapped by Cut. Run it with -race.
+func TestSaveCutInterleaved(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithGroupCommit())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 200
+	var ents []raftpb.Entry
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= n; i++ {
+			es := []raftpb.Entry{{Index: uint64(i), Term: 1, Data: []byte{byte(i)}}}
+			if err := w.Save(raftpb.HardState{Term: 1, Commit: uint64(i)}, es); err != nil {
+				t.Error(err)
+				return
+			}
+			ents = append(ents, es...)
+		}
+	}()
+	for cut := true; cut; {
+		select {
+		case <-done:
+			cut = false
+		default:
+			if err = w.Cut(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, state, entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wstate := (raftpb.HardState{Term: 1, Commit: n}); !reflect.DeepEqual(state, wstate) {
+		t.Errorf("state = %+v, want %+v", state, wstate)
+	}
+	if !reflect.DeepEqual(entries, ents) {
+		t.Errorf("ents = %+v, want %+v", entries, ents)
+	}
+}
+
+func TestReadAllSnapshotNotFound(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 6; i++ {
+		if i == 4 {
+			if err = w.Cut(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: uint64(i), Term: 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap := walpb.Snapshot{Index: 5, Term: 1}
+	if err = w.SaveSnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	// the records before the snapshot are dropped
+	if err = w.Compact(snap); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	tests := []struct {
+		snap walpb.Snapshot
+		werr error
+	}{
+		{snap, nil},
+		{walpb.Snapshot{Index: 4, Term: 1}, ErrSnapshotTooOld},
+		{walpb.Snapshot{Index: 6, Term: 1}, ErrSnapshotNotFound},
+		{walpb.Snapshot{Index: 10, Term: 1}, ErrSnapshotTooNew},
+	}
+	for i, tt := range tests {
+		w, err := Open(p, tt.snap)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		_, _, _, err = w.ReadAll()
+		w.Close()
+		if err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+		if err != nil && !errors.Is(err, ErrSnapshotNotFound) {
+			t.Errorf("#%d: err = %v, want an ErrSnapshotNotFound", i, err)
+		}
+	}
+
+	// with a snapshot too old, the WAL is still read to the end, and is
+	// ready for appending
+	w, err = Open(p, walpb.Snapshot{Index: 4, Term: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, ents, err := w.ReadAll()
+	if err != ErrSnapshotTooOld {
+		t.Errorf("err = %v, want %v", err, ErrSnapshotTooOld)
+	}
+	if wents := []raftpb.Entry{{Index: 6, Term: 1}}; !reflect.DeepEqual(ents, wents) {
+		t.Errorf("ents = %+v, want %+v", ents, wents)
+	}
+	if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: 7, Term: 1}}); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
+
+func TestOpenMulti(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+	active, sealed := path.Join(p, "active"), path.Join(p, "sealed")
+
+	w, err := Create(active, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ents []raftpb.Entry
+	for i := 1; i <= 3; i++ {
+		es := []raftpb.Entry{{Index: uint64(i), Term: 1}}
+		if err = w.Save(raftpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+		ents = append(ents, es...)
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	// move the files before the last one to another directory
+	if err = os.Mkdir(sealed, privateDirMode); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{walName(0, 0), walName(1, 2), walName(2, 3)} {
+		if err = os.Rename(path.Join(active, name), path.Join(sealed, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirs := []string{active, sealed}
+	if w, err = OpenMulti(dirs, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	_, _, g, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, ents) {
+		t.Errorf("ents = %+v, want %+v", g, ents)
+	}
+	es := []raftpb.Entry{{Index: 4, Term: 1}}
+	if err = w.Save(raftpb.HardState{}, es); err != nil {
+		t.Fatal(err)
+	}
+	ents = append(ents, es...)
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	// the new file is created in the active directory
+	if _, err = os.Stat(path.Join(active, walName(4, 5))); err != nil {
+		t.Error(err)
+	}
+
+	if w, err = OpenMulti(dirs, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, g, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if !reflect.DeepEqual(g, ents) {
+		t.Errorf("ents = %+v, want %+v", g, ents)
+	}
+
+	// a file in both directories is ambiguous
+	f, err := os.Create(path.Join(sealed, walName(4, 5)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err = OpenMulti(dirs, walpb.Snapshot{}); err != ErrDuplicateFile {
+		t.Errorf("err = %v, want %v", err, ErrDuplicateFile)
+	}
+}
+
+func TestSaveSnapshotAndState(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}}
+	if err = w.Save(raftpb.HardState{Term: 1, Commit: 1}, ents); err != nil {
+		t.Fatal(err)
+	}
+	// the node crashes right after SaveSnapshot, before the HardState
+	// that accompanies the snapshot is saved
+	snap := walpb.Snapshot{Index: 2, Term: 2}
+	state := raftpb.HardState{Term: 2, Vote: 1, Commit: 2}
+	if err = w.SaveSnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, snap); err != nil {
+		t.Fatal(err)
+	}
+	_, st, _, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(st, state) {
+		t.Fatalf("state = %+v, want the state before the snapshot", st)
+	}
+
+	// with SaveSnapshotAndState, the state is synced with the snapshot
+	if err = w.Save(raftpb.HardState{Term: 2, Vote: 1, Commit: 2}, []raftpb.Entry{{Index: 3, Term: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	snap = walpb.Snapshot{Index: 3, Term: 2}
+	state = raftpb.HardState{Term: 3, Vote: 2, Commit: 3}
+	syncs := w.Metrics().Syncs
+	if err = w.SaveSnapshotAndState(snap, state); err != nil {
+		t.Fatal(err)
+	}
+	if n := w.Metrics().Syncs - syncs; n != 1 {
+		t.Errorf("syncs = %d, want 1", n)
+	}
+	w.Close()
+
+	if w, err = Open(p, snap); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, st, _, err = w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(st, state) {
+		t.Errorf("state = %+v, want %+v", st, state)
+	}
+}
+
+func TestSaveSnapshotOutOfOrder(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveSnapshot(walpb.Snapshot{Index: 5, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, snap := range []walpb.Snapshot{{Index: 5, Term: 1}, {Index: 4, Term: 1}, {}} {
+		if err = w.SaveSnapshot(snap); err != ErrSnapshotOutOfOrder {
+			t.Errorf("snap %+v: err = %v, want %v", snap, err, ErrSnapshotOutOfOrder)
+		}
+	}
+	if err = w.SaveSnapshot(walpb.Snapshot{Index: 6, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// the last snapshot saved is known after reopening
+	if w, err = Open(p, walpb.Snapshot{Index: 6, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveSnapshotAndState(walpb.Snapshot{Index: 6, Term: 1}, raftpb.HardState{Term: 1}); err != ErrSnapshotOutOfOrder {
+		t.Errorf("err = %v, want %v", err, ErrSnapshotOutOfOrder)
+	}
+	if err = w.SaveSnapshot(walpb.Snapshot{Index: 7, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		es := []raftpb.Entry{{Index: uint64(i), Term: 1, Data: []byte("data")}}
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: uint64(i)}, es); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	// reset a WAL in read mode
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Reset([]byte("newmetadata")); err != nil {
+		t.Fatal(err)
+	}
+	names, err := fileutil.ReadDir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wnames := []string{walName(0, 0)}; !reflect.DeepEqual(names, wnames) {
+		t.Errorf("names = %v, want %v", names, wnames)
+	}
+	if g := w.LockedFiles(); !reflect.DeepEqual(g, names) {
+		t.Errorf("locked files = %v, want %v", g, names)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 2, Data: []byte("newdata")}}
+	state := raftpb.HardState{Term: 2, Commit: 1}
+	if err = w.Save(state, ents); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	metadata, st, entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, []byte("newmetadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "newmetadata")
+	}
+	if !reflect.DeepEqual(st, state) {
+		t.Errorf("state = %+v, want %+v", st, state)
+	}
+	if !reflect.DeepEqual(entries, ents) {
+		t.Errorf("ents = %+v, want %+v", entries, ents)
+	}
+}
+
+func TestResetHoldsLocks(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old files and the new one are locked once the new file is
+	// written, before the old files are removed
+	var locked []string
+	syncDir = func(dir string) error {
+		if locked != nil {
+			return fileutil.SyncDir(dir)
+		}
+		names, err := fileutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			l, err := fileutil.NewLock(path.Join(dir, name))
+			if err != nil {
+				return err
+			}
+			if l.TryLock() == fileutil.ErrLocked {
+				locked = append(locked, name)
+			} else {
+				l.Unlock()
+			}
+			l.Destroy()
+		}
+		return fileutil.SyncDir(dir)
+	}
+	defer func() { syncDir = fileutil.SyncDir }()
+	if err = w.Reset([]byte("metadata")); err != nil {
+		t.Fatal(err)
+	}
+	wlocked := []string{walName(0, 0), walName(0, 0) + ".tmp", walName(1, 1)}
+	if !reflect.DeepEqual(locked, wlocked) {
+		t.Errorf("locked = %v, want %v", locked, wlocked)
+	}
+	if g, wnames := w.LockedFiles(), []string{walName(0, 0)}; !reflect.DeepEqual(g, wnames) {
+		t.Errorf("locked files = %v, want %v", g, wnames)
+	}
+	// the new file stays locked
+	l, err := fileutil.NewLock(path.Join(p, walName(0, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Destroy()
+	if err = l.TryLock(); err != fileutil.ErrLocked {
+		t.Errorf("err = %v, want %v", err, fileutil.ErrLocked)
+	}
+}
+
+func TestOpenMetadataConflict(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: uint64(i)}, []raftpb.Entry{{Index: uint64(i), Term: 1}}); err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 {
+			// the files from now on look like the ones of another cluster
+			w.metadata = []byte("othermetadata")
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	// the conflict is found when opening the WAL, even if ReadAll would
+	// have to decode all the records before it first
+	w, err = Open(p, walpb.Snapshot{})
+	var merr *MetadataConflictError
+	if !errors.As(err, &merr) {
+		w.Close()
+		t.Fatalf("err = %v, want %v", err, ErrMetadataConflict)
+	}
+	if merr.File != walName(2, 3) || merr.ExpectedFile != walName(0, 0) {
+		t.Errorf("files = %s, %s, want %s, %s", merr.File, merr.ExpectedFile, walName(2, 3), walName(0, 0))
+	}
+	// the files are not left locked
+	if w, err = Open(p, walpb.Snapshot{Index: 3, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+}
+
+func TestOpenSeqError(t *testing.T) {
+	tests := []struct {
+		// rename renames the file walName(2, 3), or removes it if to is empty
+		to   string
+		werr SeqError
+	}{
+		// gap
+		{"", SeqError{Expected: 2, Found: 3, Prev: walName(1, 2), File: walName(3, 4)}},
+		// duplicate seq with a different index
+		{walName(1, 3), SeqError{Expected: 2, Found: 1, Prev: walName(1, 2), File: walName(1, 3)}},
+	}
+	for i, tt := range tests {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(p)
+
+		w, err := Create(p, []byte("metadata"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 1; j <= 3; j++ {
+			if err = w.Save(raftpb.HardState{}, []raftpb.Entry{{Index: uint64(j), Term: 1}}); err != nil {
+				t.Fatal(err)
+			}
+			if err = w.Cut(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.Close()
+
+		from := path.Join(p, walName(2, 3))
+		if tt.to == "" {
+			err = os.Remove(from)
+		} else {
+			err = os.Rename(from, path.Join(p, tt.to))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w, err = Open(p, walpb.Snapshot{})
+		var serr *SeqError
+		if !errors.As(err, &serr) {
+			w.Close()
+			t.Errorf("#%d: err = %v, want %v", i, err, ErrInvalidSeq)
+			continue
+		}
+		if *serr != tt.werr {
+			t.Errorf("#%d: err = %+v, want %+v", i, *serr, tt.werr)
+		}
+		if !errors.Is(err, ErrInvalidSeq) || !errors.Is(err, ErrFileNotFound) {
+			t.Errorf("#%d: err = %v, want it to match %v and %v", i, err, ErrInvalidSeq, ErrFileNotFound)
+		}
+	}
+}
+
+func TestOpenRemovesStrayFiles(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}}
+	if err = w.Save(raftpb.HardState{}, ents); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// a Cut that crashed right after creating the new file, and a Compact
+	// that crashed before renaming the compacted file
+	stray := []string{walName(1, 3), walName(0, 0) + ".tmp"}
+	for _, name := range stray {
+		if err = ioutil.WriteFile(path.Join(p, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err = Open(p, walpb.Snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, _, entries, err := w.ReadAll(); err != nil || !reflect.DeepEqual(entries, ents) {
+		t.Errorf("entries, err = %+v, %v, want %+v, nil", entries, err, ents)
+	}
+	for _, name := range stray {
+		if _, err = os.Stat(path.Join(p, name)); !os.IsNotExist(err) {
+			t.Errorf("%s: err = %v, want not exist", name, err)
+		}
+	}
+}
+
+func TestOpenRecoversTmp(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}}
+	if err = w.Save(raftpb.HardState{}, ents); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// a Reset that crashed after removing the old files
+	fpath := path.Join(p, walName(0, 0))
+	if err = os.Rename(fpath, fpath+".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	// the file is kept while a Reset in progress holds its lock
+	l, err := fileutil.NewLock(fpath + ".tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(p, walpb.Snapshot{}); err != ErrFileNotFound {
+		t.Errorf("err = %v, want %v", err, ErrFileNotFound)
+	}
+	l.Unlock()
+	l.Destroy()
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, entries, err := w.ReadAll(); err != nil || !reflect.DeepEqual(entries, ents) {
+		t.Errorf("entries, err = %+v, %v, want %+v, nil", entries, err, ents)
+	}
+
+	// the temporary file of a Compact in progress is kept while another
+	// process holds the lock on the file compacted
+	if err = ioutil.WriteFile(fpath+".tmp", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenNotInUse(p, walpb.Snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if _, err = os.Stat(fpath + ".tmp"); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+	w.Close()
+}
+
+func TestOpenRemovesOrphanedTmp(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	snap := walpb.Snapshot{Index: 5, Term: 1}
+	w, err := CreateAt(p, []byte("metadata"), snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// a Reset that crashed while removing the files of a WAL starting at
+	// a snapshot leaves a valid prefix of them
+	tmp := path.Join(p, walName(0, 0)+".tmp")
+	if err = ioutil.WriteFile(tmp, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if w, err = Open(p, snap); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+}
+
+func TestOpenStrictNames(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// the stray file of an interrupted Compact is removed before checking
+	if err = ioutil.WriteFile(path.Join(p, walName(0, 0)+".tmp"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if w, err = Open(p, walpb.Snapshot{}, WithStrictNames()); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// a half-renamed file is not removed
+	if err = ioutil.WriteFile(path.Join(p, "0000000000000001"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(p, walpb.Snapshot{}, WithStrictNames())
+	werr := &UnexpectedFilesError{Dir: p, Names: []string{"0000000000000001"}}
+	if !reflect.DeepEqual(err, werr) {
+		t.Errorf("err = %v, want %v", err, werr)
+	}
+	if !errors.Is(err, ErrUnexpectedFile) {
+		t.Errorf("err = %v, want to match %v", err, ErrUnexpectedFile)
+	}
+	// the file is ignored without the option
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+}
+
+// stubLock is a fileutil.Lock whose Unlock and Destroy return the given
+// error, like a lock on a filesystem remounted read-only.
+type stubLock struct {
+	name string
+	err  error
+
+	unlocked, destroyed int
+}
+
+func (l *stubLock) Name() string   { return l.name }
+func (l *stubLock) TryLock() error { return nil }
+func (l *stubLock) Lock() error    { return nil }
+func (l *stubLock) Unlock() error  { l.unlocked++; return l.err }
+func (l *stubLock) Destroy() error { l.destroyed++; return l.err }
+
+func TestCloseLockErrors(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errReadOnlyFS := errors.New("read-only file system")
+	ls := []*stubLock{{name: "a", err: errReadOnlyFS}, {name: "b"}}
+	for _, l := range ls {
+		w.locks = append(w.locks, l)
+	}
+	if err = w.Close(); err != errReadOnlyFS {
+		t.Errorf("err = %v, want %v", err, errReadOnlyFS)
+	}
+	// all the locks are released despite the failure
+	for i, l := range ls {
+		if l.unlocked != 1 || l.destroyed != 1 {
+			t.Errorf("#%d: unlocked, destroyed = %d, %d, want 1, 1", i, l.unlocked, l.destroyed)
+		}
+	}
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+}
+
+func TestCloseTwice(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(raftpb.HardState{Term: 1}, []raftpb.Entry{{Index: 1, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	// the file of the lock is removed from under the WAL
+	if err = os.Remove(path.Join(p, walName(0, 0))); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Errorf("second close err = %v, want nil", err)
+	}
+}
+
+func TestWriteBufferSize(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithWriteBufferSize(64*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := w.encoder.bw.Size(); n != 64*1024 {
+		t.Errorf("buffer size = %d, want %d", n, 64*1024)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1, Data: make([]byte, 8*1024)}}
+	if err = w.SaveNoSync(raftpb.HardState{Term: 1, Commit: 1}, ents); err != nil {
+		t.Fatal(err)
+	}
+	// the records are buffered until synced
+	if n := w.encoder.bw.Buffered(); n == 0 {
+		t.Errorf("buffered = 0, want the records saved")
+	}
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	if n := w.encoder.bw.Size(); n != 64*1024 {
+		t.Errorf("buffer size after cut = %d, want %d", n, 64*1024)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}, WithWriteBufferSize(16*1024)); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, ents) {
+		t.Errorf("ents = %+v, want %+v", entries, ents)
+	}
+	if n := w.encoder.bw.Size(); n != 16*1024 {
+		t.Errorf("buffer size after open = %d, want %d", n, 16*1024)
+	}
+}
+
+func TestConcurrentAppends(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 100
+	var wg sync.WaitGroup
+	errc := make(chan error, 4*n)
+	// the entries are saved by a single goroutine to keep their order,
+	// while the others save states, sync and cut concurrently
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= n; i++ {
+			es := []raftpb.Entry{{Index: uint64(i), Term: 1, Data: []byte("data")}}
+			errc <- w.Save(raftpb.HardState{Term: 1, Commit: uint64(i)}, es)
+		}
+	}()
+	for g := 0; g < 3; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				switch {
+				case g == 0 && i%20 == 0:
+					errc <- w.Cut()
+				case g == 1:
+					errc <- w.SaveNoSync(raftpb.HardState{Term: 1}, nil)
+				default:
+					errc <- w.Sync()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != n {
+		t.Fatalf("len(ents) = %d, want %d", len(ents), n)
+	}
+	for i, e := range ents {
+		if e.Index != uint64(i+1) {
+			t.Errorf("#%d: index = %d, want %d", i, e.Index, i+1)
+		}
+	}
+}
+
+func TestSnapshotConfState(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(raftpb.HardState{Term: 1, Commit: 1}, []raftpb.Entry{{Index: 1, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// a snapshot saved without a ConfState, as by older versions
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	snap, cs, err := w.LastSnapshot()
+	if err != nil || cs != nil || snap.Index != 0 {
+		t.Errorf("snap, cs, err = %+v, %+v, %v, want an empty snapshot without ConfState", snap, cs, err)
+	}
+	wcs := raftpb.ConfState{Nodes: []uint64{1, 2, 3}}
+	wsnap := walpb.Snapshot{Index: 1, Term: 1, ConfState: pbutil.MustMarshal(&wcs)}
+	if err = w.SaveSnapshot(wsnap); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, walpb.Snapshot{Index: 1, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	snap, cs, err = w.LastSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snap, wsnap) {
+		t.Errorf("snap = %+v, want %+v", snap, wsnap)
+	}
+	if cs == nil || !reflect.DeepEqual(*cs, wcs) {
+		t.Errorf("cs = %+v, want %+v", cs, wcs)
+	}
+}
+
+func TestSaveAppData(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}}
+	for i, b := range []string{"a", "b"} {
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: uint64(i + 1)}, ents[i:i+1]); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.SaveAppData([]byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	var data []string
+	w, err = Open(p, walpb.Snapshot{}, WithAppData(func(b []byte) error {
+		data = append(data, string(b))
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, entries, err := w.ReadAll()
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, ents) {
+		t.Errorf("ents = %+v, want %+v", entries, ents)
+	}
+	if wdata := []string{"a", "b"}; !reflect.DeepEqual(data, wdata) {
+		t.Errorf("data = %v, want %v", data, wdata)
+	}
+
+	// the application data is skipped without the option
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, entries, err = w.ReadAll(); err != nil || !reflect.DeepEqual(entries, ents) {
+		t.Errorf("ents, err = %+v, %v, want %+v, nil", entries, err, ents)
+	}
+	w.Close()
+
+	// the error of the function stops the reading
+	errStop := errors.New("stop")
+	r, err := OpenReadOnly(p, walpb.Snapshot{}, WithAppData(func([]byte) error { return errStop }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, _, _, err = r.ReadAll(); err != errStop {
+		t.Errorf("err = %v, want %v", err, errStop)
+	}
+}
+
+func TestCreateAndCutSyncDir(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	var synced []string
+	syncDir = func(dir string) error {
+		synced = append(synced, dir)
+		return fileutil.SyncDir(dir)
+	}
+	defer func() { syncDir = fileutil.SyncDir }()
+
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	// the new file is synced in the temporary directory, and then moved
+	// into the existing directory
+	if wsynced := []string{tmpDir(p), p}; !reflect.DeepEqual(synced, wsynced) {
+		t.Errorf("synced = %v, want %v", synced, wsynced)
+	}
+
+	synced = nil
+	if err = w.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	if wsynced := []string{p}; !reflect.DeepEqual(synced, wsynced) {
+		t.Errorf("synced = %v, want %v", synced, wsynced)
+	}
+
+	// Reset syncs its new file into the directory before removing the old
+	// files, and again once it is renamed into place
+	synced = nil
+	if err = w.Reset([]byte("metadata")); err != nil {
+		t.Fatal(err)
+	}
+	if wsynced := []string{p, p}; !reflect.DeepEqual(synced, wsynced) {
+		t.Errorf("synced = %v, want %v", synced, wsynced)
+	}
+
+	// the new file may be lost if the directory is not synced
+	errSync := errors.New("sync error")
+	syncDir = func(dir string) error { return errSync }
+	if err = w.Cut(); err != errSync {
+		t.Errorf("err = %v, want %v", err, errSync)
+	}
+}
+
+func TestReadAllOpensFilesLazily(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("/proc/self/fd is not available")
+	}
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	const n = 50
+	w, err := Create(p, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: uint64(i)}, []raftpb.Entry{{Index: uint64(i), Term: 1}}); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	openFds := func() int {
+		fds, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(fds)
+	}
+	base := openFds()
+	if w, err = Open(p, walpb.Snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var peak int
+	_, _, err = w.ReadRecords(func(*walpb.Record) error {
+		if fds := openFds(); fds > peak {
+			peak = fds
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a lock per file, the file being appended and the file being read
+	if max := base + (n + 1) + 2; peak > max {
+		t.Errorf("peak open files = %d, want at most %d", peak, max)
+	}
+}
@@ -31,8 +31,10 @@ var _ = math.Inf
 type Record struct {
 	Type             int64  `protobuf:"varint,1,req,name=type" json:"type"`
 	Crc              uint32 `protobuf:"varint,2,req,name=crc" json:"crc"`
-	Data             []byte `protobuf:"bytes,3,opt,name=data" json:"data,omitempty"`
-	XXX_unrecognized []byte `json:"-"`
+	Data             []byte  `protobuf:"bytes,3,opt,name=data" json:"data,omitempty"`
+	Crc64            *uint64 `protobuf:"varint,4,opt,name=crc64" json:"crc64,omitempty"`
+	Timestamp        *int64  `protobuf:"varint,5,opt,name=timestamp" json:"timestamp,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
 }
 
 func (m *Record) Reset()         { *m = Record{} }
@@ -42,6 +44,7 @@ func (*Record) ProtoMessage()    {}
 type Snapshot struct {
 	Index            uint64 `protobuf:"varint,1,req,name=index" json:"index"`
 	Term             uint64 `protobuf:"varint,2,req,name=term" json:"term"`
+	ConfState        []byte `protobuf:"bytes,3,opt,name=conf_state" json:"conf_state,omitempty"`
 	XXX_unrecognized []byte `json:"-"`
 }
 
@@ -122,6 +125,40 @@ func (m *Record) Unmarshal(data []byte) error {
 			}
 			m.Data = append(m.Data, data[index:postIndex]...)
 			index = postIndex
+		case 4:
+			if wireType != 0 {
+				return code_google_com_p_gogoprotobuf_proto.ErrWrongType
+			}
+			var v uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Crc64 = &v
+		case 5:
+			if wireType != 0 {
+				return code_google_com_p_gogoprotobuf_proto.ErrWrongType
+			}
+			var v int64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Timestamp = &v
 		default:
 			var sizeOfWire int
 			for {
@@ -194,6 +231,28 @@ func (m *Snapshot) Unmarshal(data []byte) error {
 					break
 				}
 			}
+		case 3:
+			if wireType != 2 {
+				return code_google_com_p_gogoprotobuf_proto.ErrWrongType
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ConfState = append(m.ConfState, data[index:postIndex]...)
+			index = postIndex
 		default:
 			var sizeOfWire int
 			for {
@@ -226,6 +285,12 @@ func (m *Record) Size() (n int) {
 		l = len(m.Data)
 		n += 1 + l + sovRecord(uint64(l))
 	}
+	if m.Crc64 != nil {
+		n += 1 + sovRecord(uint64(*m.Crc64))
+	}
+	if m.Timestamp != nil {
+		n += 1 + sovRecord(uint64(*m.Timestamp))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -236,6 +301,10 @@ func (m *Snapshot) Size() (n int) {
 	_ = l
 	n += 1 + sovRecord(uint64(m.Index))
 	n += 1 + sovRecord(uint64(m.Term))
+	if m.ConfState != nil {
+		l = len(m.ConfState)
+		n += 1 + l + sovRecord(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -282,6 +351,16 @@ func (m *Record) MarshalTo(data []byte) (n int, err error) {
 		i = encodeVarintRecord(data, i, uint64(len(m.Data)))
 		i += copy(data[i:], m.Data)
 	}
+	if m.Crc64 != nil {
+		data[i] = 0x20
+		i++
+		i = encodeVarintRecord(data, i, uint64(*m.Crc64))
+	}
+	if m.Timestamp != nil {
+		data[i] = 0x28
+		i++
+		i = encodeVarintRecord(data, i, uint64(*m.Timestamp))
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -308,6 +387,12 @@ func (m *Snapshot) MarshalTo(data []byte) (n int, err error) {
 	data[i] = 0x10
 	i++
 	i = encodeVarintRecord(data, i, uint64(m.Term))
+	if m.ConfState != nil {
+		data[i] = 0x1a
+		i++
+		i = encodeVarintRecord(data, i, uint64(len(m.ConfState)))
+		i += copy(data[i:], m.ConfState)
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}